@@ -0,0 +1,189 @@
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Codes tell clients what went wrong without parsing the detail message
+const (
+	CodeBadRequest          = "bad_request"
+	CodeInvalidBody         = "invalid_body"
+	CodeValidationFailed    = "validation_failed"
+	CodeUnauthorized        = "unauthorized"
+	CodeInvalidCredentials  = "invalid_credentials"
+	CodeRoleChanged         = "role_changed"
+	CodeForbidden           = "forbidden"
+	CodePermissionDenied    = "permission_denied"
+	CodeTwoFactorRequired   = "two_factor_required"
+	CodeEmailNotVerified    = "email_not_verified"
+	CodeAccountDeactivated  = "account_deactivated"
+	CodeAccountSuspended    = "account_suspended"
+	CodeAccountInactive     = "account_inactive"
+	CodeNotFound            = "not_found"
+	CodeMethodNotAllowed    = "method_not_allowed"
+	CodeConflict            = "conflict"
+	CodeRateLimited         = "rate_limited"
+	CodeInternal            = "internal_error"
+	CodeUpstreamUnavailable = "upstream_unavailable"
+)
+
+// Error is an error answered to the client. The central error handler writes
+// it as an RFC 7807 problem.
+type Error struct {
+	Status int
+	Code   string
+	Detail string
+	// Fields lists the invalid fields of a validation error
+	Fields []FieldError
+	// Extensions are additional members of the problem, e.g. the reason an
+	// account was suspended
+	Extensions map[string]interface{}
+}
+
+// FieldError describes why one field of the request failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// New returns an error with the given status, code and detail message
+func New(status int, code, detail string) *Error {
+	return &Error{Status: status, Code: code, Detail: detail}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Detail)
+}
+
+// With adds a member to the problem
+func (e *Error) With(key string, value interface{}) *Error {
+	if e.Extensions == nil {
+		e.Extensions = map[string]interface{}{}
+	}
+	e.Extensions[key] = value
+	return e
+}
+
+func BadRequest(detail string) *Error {
+	return New(fiber.StatusBadRequest, CodeBadRequest, detail)
+}
+
+func Unauthorized(detail string) *Error {
+	return New(fiber.StatusUnauthorized, CodeUnauthorized, detail)
+}
+
+func Forbidden(detail string) *Error {
+	return New(fiber.StatusForbidden, CodeForbidden, detail)
+}
+
+func NotFound(detail string) *Error {
+	return New(fiber.StatusNotFound, CodeNotFound, detail)
+}
+
+func Conflict(detail string) *Error {
+	return New(fiber.StatusConflict, CodeConflict, detail)
+}
+
+func Internal(detail string) *Error {
+	return New(fiber.StatusInternalServerError, CodeInternal, detail)
+}
+
+// InvalidBody is the error for a request body that cannot be parsed
+func InvalidBody() *Error {
+	return New(fiber.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+}
+
+// Validation turns the error of validator.Struct into an error listing every
+// invalid field
+func Validation(err error) *Error {
+	e := New(fiber.StatusBadRequest, CodeValidationFailed, "Invalid input data")
+
+	var errs validator.ValidationErrors
+	if errors.As(err, &errs) {
+		for _, fe := range errs {
+			e.Fields = append(e.Fields, FieldError{
+				Field:   fe.Field(),
+				Rule:    fe.Tag(),
+				Message: fieldMessage(fe),
+			})
+		}
+	}
+	return e
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "required_without":
+		return fmt.Sprintf("is required without %s", fe.Param())
+	case "required_if":
+		// The param is "Field value"
+		if field, value, ok := strings.Cut(fe.Param(), " "); ok {
+			return fmt.Sprintf("is required when %s is %s", strings.ToLower(field), value)
+		}
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "min":
+		return fmt.Sprintf("must be at least %s", fe.Param())
+	case "max":
+		return fmt.Sprintf("must be at most %s", fe.Param())
+	case "oneof":
+		return fmt.Sprintf("must be one of: %s", fe.Param())
+	default:
+		return "is invalid"
+	}
+}
+
+// From returns err as an Error. Fiber's own errors, such as an unknown route,
+// keep their status; any other error is an internal error whose message is
+// not shown to the client.
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return New(fiberErr.Code, codeForStatus(fiberErr.Code), fiberErr.Message)
+	}
+
+	return Internal(http.StatusText(http.StatusInternalServerError))
+}
+
+// Status returns the status code err is answered with
+func Status(err error) int {
+	return From(err).Status
+}
+
+func codeForStatus(status int) string {
+	switch status {
+	case fiber.StatusBadRequest:
+		return CodeBadRequest
+	case fiber.StatusUnauthorized:
+		return CodeUnauthorized
+	case fiber.StatusForbidden:
+		return CodeForbidden
+	case fiber.StatusNotFound:
+		return CodeNotFound
+	case fiber.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case fiber.StatusConflict:
+		return CodeConflict
+	case fiber.StatusTooManyRequests:
+		return CodeRateLimited
+	}
+	if status >= fiber.StatusInternalServerError {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
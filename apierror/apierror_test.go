@@ -0,0 +1,69 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestHandler(t *testing.T) {
+	type input struct {
+		Email string `validate:"required,email"`
+	}
+
+	app := fiber.New(fiber.Config{ErrorHandler: Handler})
+	app.Post("/validate", func(c *fiber.Ctx) error {
+		return Validation(validator.New().Struct(input{Email: "not-an-email"}))
+	})
+	app.Get("/suspended", func(c *fiber.Ctx) error {
+		return Forbidden("Account suspended").With("reason", "spam")
+	})
+	app.Get("/broken", func(c *fiber.Ctx) error {
+		return errors.New("pq: connection refused")
+	})
+
+	problem := func(method, path string, wantStatus int) map[string]interface{} {
+		resp, err := app.Test(httptest.NewRequest(method, path, nil))
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", path, err)
+		}
+		if resp.StatusCode != wantStatus {
+			t.Errorf("Expected %s to answer %d, got %d", path, wantStatus, resp.StatusCode)
+		}
+		if got := resp.Header.Get(fiber.HeaderContentType); got != ContentType {
+			t.Errorf("Expected %s, got %q", ContentType, got)
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Decoding the problem failed: %v", err)
+		}
+		return body
+	}
+
+	body := problem("POST", "/validate", fiber.StatusBadRequest)
+	if body["code"] != CodeValidationFailed || body["instance"] != "/validate" {
+		t.Errorf("Unexpected problem: %v", body)
+	}
+	fields, _ := body["errors"].([]interface{})
+	if len(fields) != 1 || fields[0].(map[string]interface{})["rule"] != "email" {
+		t.Errorf("Expected the invalid email to be reported, got %v", body["errors"])
+	}
+
+	if body := problem("GET", "/suspended", fiber.StatusForbidden); body["reason"] != "spam" {
+		t.Errorf("Expected the reason as an extension member, got %v", body)
+	}
+
+	// Unknown errors do not leak their message
+	if body := problem("GET", "/broken", fiber.StatusInternalServerError); body["code"] != CodeInternal || body["detail"] != "Internal Server Error" {
+		t.Errorf("Unexpected problem for an unknown error: %v", body)
+	}
+
+	// Fiber's own errors keep their status
+	if body := problem("GET", "/missing", fiber.StatusNotFound); body["code"] != CodeNotFound {
+		t.Errorf("Unexpected problem for an unknown route: %v", body)
+	}
+}
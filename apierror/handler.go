@@ -0,0 +1,56 @@
+package apierror
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/logging"
+)
+
+// ContentType is the media type of RFC 7807 problems
+const ContentType = "application/problem+json"
+
+// Handler is the application's fiber.ErrorHandler. It answers every error
+// returned by a handler or middleware as a problem; the causes of internal
+// errors are left to the request log and never shown to the client:
+//
+//	{
+//	  "type": "about:blank",
+//	  "title": "Bad Request",
+//	  "status": 400,
+//	  "detail": "Invalid input data",
+//	  "code": "validation_failed",
+//	  "instance": "/register",
+//	  "request_id": "...",
+//	  "errors": [{"field": "email", "rule": "email", "message": "must be a valid email address"}]
+//	}
+func Handler(c *fiber.Ctx, err error) error {
+	e := From(err)
+
+	problem := fiber.Map{
+		"type":     "about:blank",
+		"title":    http.StatusText(e.Status),
+		"status":   e.Status,
+		"detail":   e.Detail,
+		"code":     e.Code,
+		"instance": c.Path(),
+	}
+	if requestID := logging.RequestID(c.UserContext()); requestID != "" {
+		problem["request_id"] = requestID
+	}
+	if len(e.Fields) > 0 {
+		problem["errors"] = e.Fields
+	}
+	for key, value := range e.Extensions {
+		if _, taken := problem[key]; !taken {
+			problem[key] = value
+		}
+	}
+
+	c.Status(e.Status)
+	if err := c.JSON(problem); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, ContentType)
+	return nil
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// apiKeyPrefix marks our API keys, so they are easy to recognise in logs and
+// by secret scanners
+const apiKeyPrefix = "bsk_"
+
+// NewAPIKey generates a new random API key
+func NewAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashAPIKey returns the hash an API key is stored and looked up by
+func HashAPIKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyPrefix returns the start of a key that is shown to tell keys apart
+func APIKeyPrefix(raw string) string {
+	if len(raw) > len(apiKeyPrefix)+6 {
+		return raw[:len(apiKeyPrefix)+6]
+	}
+	return raw
+}
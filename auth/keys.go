@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+)
+
+// SigningKey is a private key used to sign tokens, identified by the "kid"
+// header of the tokens it signs
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+}
+
+// Public returns the key's public half
+func (k *SigningKey) Public() crypto.PublicKey {
+	return k.Private.Public()
+}
+
+// KeySet holds the keys tokens are signed and verified with. Only the active
+// key signs new tokens; the others are kept so tokens they signed stay valid
+// while keys are rotated.
+type KeySet struct {
+	active *SigningKey
+	keys   map[string]*SigningKey
+}
+
+var keys *KeySet
+
+// NewKeySet creates a key set signing with the first key and verifying with
+// all of them
+func NewKeySet(active *SigningKey, others ...*SigningKey) *KeySet {
+	ks := &KeySet{
+		active: active,
+		keys:   map[string]*SigningKey{active.ID: active},
+	}
+	for _, key := range others {
+		ks.keys[key.ID] = key
+	}
+	return ks
+}
+
+// InitKeys loads the application-wide key set from the configured PEM files
+// (the first one signs). Without any keys configured an ephemeral key is
+// generated, so tokens do not survive a restart.
+func InitKeys() error {
+	paths := config.Get().Auth.SigningKeys
+
+	if len(paths) == 0 {
+		slog.Warn("JWT_SIGNING_KEYS is not set, signing tokens with an ephemeral key")
+		key, err := GenerateSigningKey()
+		if err != nil {
+			return err
+		}
+		keys = NewKeySet(key)
+		return nil
+	}
+
+	loaded := make([]*SigningKey, 0, len(paths))
+	for _, path := range paths {
+		key, err := LoadSigningKey(path)
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, key)
+	}
+
+	keys = NewKeySet(loaded[0], loaded[1:]...)
+	return nil
+}
+
+// Keys returns the application-wide key set
+func Keys() *KeySet {
+	return keys
+}
+
+// SetKeys replaces the application-wide key set, e.g. in tests
+func SetKeys(ks *KeySet) {
+	keys = ks
+}
+
+// GenerateSigningKey creates a new Ed25519 signing key
+func GenerateSigningKey() (*SigningKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey(private)
+}
+
+// LoadSigningKey reads an RSA or Ed25519 private key from a PEM file
+func LoadSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded key", path)
+	}
+
+	var private interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, private)
+	}
+	return NewSigningKey(signer)
+}
+
+// NewSigningKey wraps an RSA (RS256) or Ed25519 (EdDSA) private key. The key
+// ID is the key's RFC 7638 thumbprint, so it stays the same across restarts.
+func NewSigningKey(private crypto.Signer) (*SigningKey, error) {
+	key := &SigningKey{Private: private}
+
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+
+	thumbprint, err := key.thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	key.ID = thumbprint
+
+	return key, nil
+}
+
+// Sign signs the claims with the active key
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	key := ks.active
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.Private)
+}
+
+// Keyfunc looks up the key a token was signed with; it is meant for
+// jwt.Parse and the JWT middleware
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("token has no key ID")
+	}
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+
+	// Never let the token choose a different algorithm than the key's
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+
+	return key.Public(), nil
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public halves of all keys, so other services can verify
+// our tokens
+func (ks *KeySet) JWKS() JWKS {
+	set := JWKS{Keys: make([]JWK, 0, len(ks.keys))}
+
+	// The active key comes first
+	set.Keys = append(set.Keys, ks.active.jwk())
+	for id, key := range ks.keys {
+		if id != ks.active.ID {
+			set.Keys = append(set.Keys, key.jwk())
+		}
+	}
+
+	return set
+}
+
+func (k *SigningKey) jwk() JWK {
+	jwk := JWK{
+		KeyID:     k.ID,
+		Use:       "sig",
+		Algorithm: k.Method.Alg(),
+	}
+
+	switch public := k.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+
+	return jwk
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint: the SHA-256 of the
+// required members in lexicographic order
+func (k *SigningKey) thumbprint() (string, error) {
+	jwk := k.jwk()
+
+	var members interface{}
+	switch jwk.KeyType {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.KeyType, jwk.N}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Curve, jwk.KeyType, jwk.X}
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// Keyfunc verifies tokens against the application-wide key set
+func Keyfunc(token *jwt.Token) (interface{}, error) {
+	if keys == nil {
+		return nil, errors.New("signing keys are not initialized")
+	}
+	return keys.Keyfunc(token)
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestKeySetRotation(t *testing.T) {
+	oldKey, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	newKey, err := NewSigningKey(rsaPrivate)
+	if err != nil {
+		t.Fatalf("Failed to wrap RSA key: %v", err)
+	}
+
+	// A token signed before the rotation...
+	oldToken, err := NewKeySet(oldKey).Sign(jwt.MapClaims{"user_id": 1})
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	// ...stays valid once the new key signs and the old one only verifies
+	rotated := NewKeySet(newKey, oldKey)
+	if _, err := jwt.Parse(oldToken, rotated.Keyfunc); err != nil {
+		t.Errorf("Expected the old token to verify after rotation: %v", err)
+	}
+
+	newToken, err := rotated.Sign(jwt.MapClaims{"user_id": 1})
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	parsed, err := jwt.Parse(newToken, rotated.Keyfunc)
+	if err != nil {
+		t.Fatalf("Expected the new token to verify: %v", err)
+	}
+	if parsed.Header["kid"] != newKey.ID || parsed.Method.Alg() != "RS256" {
+		t.Errorf("Expected an RS256 token with kid %s, got %s with kid %v", newKey.ID, parsed.Method.Alg(), parsed.Header["kid"])
+	}
+
+	// Tokens from keys that were dropped are rejected
+	if _, err := jwt.Parse(oldToken, NewKeySet(newKey).Keyfunc); err == nil {
+		t.Error("Expected a token from a removed key to be rejected")
+	}
+
+	jwks := rotated.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].KeyID != newKey.ID || jwks.Keys[0].KeyType != "RSA" || jwks.Keys[1].KeyType != "OKP" {
+		t.Errorf("Unexpected JWKS: %+v", jwks)
+	}
+}
+
+func TestKeyfuncRejectsAlgorithmSwitch(t *testing.T) {
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	ks := NewKeySet(key)
+
+	// An HMAC token pointing at our key ID must not verify
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": 1})
+	forged.Header["kid"] = key.ID
+	raw, err := forged.SignedString([]byte("guessed-secret"))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	if _, err := jwt.Parse(raw, ks.Keyfunc); err == nil {
+		t.Error("Expected a token with a different algorithm to be rejected")
+	}
+}
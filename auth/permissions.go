@@ -0,0 +1,28 @@
+package auth
+
+// Permissions carried in tokens. They are derived from the user's role when
+// the token is issued.
+const (
+	PermissionManageBooks = "books:manage"
+	PermissionManageUsers = "users:manage"
+	PermissionManageCarts = "carts:manage"
+)
+
+// rolePermissions lists what each role may do beyond using its own account
+var rolePermissions = map[string][]string{
+	"admin": {PermissionManageBooks, PermissionManageUsers, PermissionManageCarts},
+}
+
+// IsPermission reports whether the permission exists
+func IsPermission(permission string) bool {
+	switch permission {
+	case PermissionManageBooks, PermissionManageUsers, PermissionManageCarts:
+		return true
+	}
+	return false
+}
+
+// PermissionsFor returns the permissions granted to a role
+func PermissionsFor(role string) []string {
+	return rolePermissions[role]
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+)
+
+// ThrottleConfig controls how a Throttle reacts to failed attempts
+type ThrottleConfig struct {
+	// FreeAttempts is how many failures are allowed before delays kick in
+	FreeAttempts int
+	// BaseDelay is the wait after the first failure past FreeAttempts; it
+	// doubles with every further failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutThreshold is the number of failures that locks the key out
+	// entirely for LockoutDuration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// Window is how long failures are remembered after the last one
+	Window time.Duration
+}
+
+// Throttle tracks failed attempts per key (an account or an IP address) and
+// tells callers how long a key has to wait before it may try again
+type Throttle struct {
+	config ThrottleConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*throttleEntry
+}
+
+type throttleEntry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	locked       bool
+}
+
+// maxThrottleEntries is the size above which stale entries are pruned
+const maxThrottleEntries = 10000
+
+// AccountThrottle tracks failed logins per email address and IPThrottle
+// per client IP. Both start with the default settings; InitThrottles applies
+// the configured ones.
+var AccountThrottle, IPThrottle = loginThrottles(config.Default().Throttle)
+
+// InitThrottles replaces the login throttles with ones using the configured
+// settings
+func InitThrottles() {
+	AccountThrottle, IPThrottle = loginThrottles(config.Get().Throttle)
+}
+
+func loginThrottles(c config.ThrottleConfig) (account, ip *Throttle) {
+	account = NewThrottle(ThrottleConfig{
+		FreeAttempts:     c.AccountFreeAttempts,
+		BaseDelay:        time.Second,
+		MaxDelay:         c.AccountMaxDelay,
+		LockoutThreshold: c.AccountLockoutThreshold,
+		LockoutDuration:  c.AccountLockout,
+		Window:           c.AccountLockout,
+	})
+	ip = NewThrottle(ThrottleConfig{
+		FreeAttempts:     c.IPFreeAttempts,
+		BaseDelay:        time.Second,
+		MaxDelay:         c.IPMaxDelay,
+		LockoutThreshold: c.IPLockoutThreshold,
+		LockoutDuration:  c.IPLockout,
+		Window:           c.IPLockout,
+	})
+	return account, ip
+}
+
+// NewThrottle creates an empty throttle
+func NewThrottle(config ThrottleConfig) *Throttle {
+	return &Throttle{
+		config:  config,
+		now:     time.Now,
+		entries: make(map[string]*throttleEntry),
+	}
+}
+
+// Check reports how long the key has to wait before its next attempt and
+// whether it is locked out. A zero duration means it may try right away.
+func (t *Throttle) Check(key string) (wait time.Duration, locked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[key]
+	if !ok {
+		return 0, false
+	}
+
+	now := t.now()
+	if t.expired(entry, now) {
+		delete(t.entries, key)
+		return 0, false
+	}
+
+	if now.Before(entry.blockedUntil) {
+		return entry.blockedUntil.Sub(now), entry.locked
+	}
+
+	return 0, false
+}
+
+// Fail records a failed attempt for the key
+func (t *Throttle) Fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if len(t.entries) > maxThrottleEntries {
+		t.prune(now)
+	}
+
+	entry, ok := t.entries[key]
+	if !ok || t.expired(entry, now) {
+		entry = &throttleEntry{}
+		t.entries[key] = entry
+	}
+
+	entry.failures++
+	entry.lastFailure = now
+
+	switch {
+	case t.config.LockoutThreshold > 0 && entry.failures >= t.config.LockoutThreshold:
+		entry.locked = true
+		entry.blockedUntil = now.Add(t.config.LockoutDuration)
+	case entry.failures > t.config.FreeAttempts:
+		entry.blockedUntil = now.Add(t.delay(entry.failures - t.config.FreeAttempts))
+	}
+}
+
+// Reset forgets all failures of the key, e.g. after a successful login or
+// when an admin unlocks an account
+func (t *Throttle) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.entries, key)
+}
+
+// delay returns the wait after the n-th failure past the free attempts
+func (t *Throttle) delay(n int) time.Duration {
+	d := t.config.BaseDelay
+	for i := 1; i < n && d < t.config.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > t.config.MaxDelay {
+		d = t.config.MaxDelay
+	}
+	return d
+}
+
+// expired reports whether an entry can be forgotten: its failures are older
+// than the window and it is not blocked anymore
+func (t *Throttle) expired(entry *throttleEntry, now time.Time) bool {
+	return now.Sub(entry.lastFailure) > t.config.Window && !now.Before(entry.blockedUntil)
+}
+
+func (t *Throttle) prune(now time.Time) {
+	for key, entry := range t.entries {
+		if t.expired(entry, now) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// AccountKey is the throttle key for login attempts on an email address
+func AccountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// TwoFactorKey is the throttle key for two-factor codes entered for a user
+func TwoFactorKey(userID uint) string {
+	return fmt.Sprintf("2fa:%d", userID)
+}
+
+// IPKey is the throttle key for login attempts from a client IP
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+)
+
+func TestThrottleProgressiveDelayAndLockout(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	throttle := NewThrottle(ThrottleConfig{
+		FreeAttempts:     2,
+		BaseDelay:        time.Second,
+		MaxDelay:         4 * time.Second,
+		LockoutThreshold: 6,
+		LockoutDuration:  time.Minute,
+		Window:           10 * time.Minute,
+	})
+	throttle.now = func() time.Time { return now }
+
+	// The free attempts do not cause any delay
+	for i := 0; i < 2; i++ {
+		throttle.Fail("account:a@b.c")
+		if wait, _ := throttle.Check("account:a@b.c"); wait != 0 {
+			t.Fatalf("Expected no delay after %d failures, got %s", i+1, wait)
+		}
+	}
+
+	// After that the delay doubles up to the maximum
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		throttle.Fail("account:a@b.c")
+		wait, locked := throttle.Check("account:a@b.c")
+		if wait != expected || locked {
+			t.Fatalf("Expected a %s delay without lockout, got %s (locked: %v)", expected, wait, locked)
+		}
+	}
+
+	// Reaching the threshold locks the key out
+	throttle.Fail("account:a@b.c")
+	if wait, locked := throttle.Check("account:a@b.c"); wait != time.Minute || !locked {
+		t.Fatalf("Expected a one minute lockout, got %s (locked: %v)", wait, locked)
+	}
+
+	// Other keys are unaffected
+	if wait, _ := throttle.Check("account:other@b.c"); wait != 0 {
+		t.Fatalf("Expected no delay for an unrelated key, got %s", wait)
+	}
+
+	// The lockout ends on its own
+	now = now.Add(time.Minute)
+	if wait, locked := throttle.Check("account:a@b.c"); wait != 0 || locked {
+		t.Fatalf("Expected the lockout to be over, got %s (locked: %v)", wait, locked)
+	}
+}
+
+func TestThrottleReset(t *testing.T) {
+	throttle := NewThrottle(ThrottleConfig{
+		FreeAttempts:     0,
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Second,
+		LockoutThreshold: 1,
+		LockoutDuration:  time.Hour,
+		Window:           time.Hour,
+	})
+
+	throttle.Fail("ip:127.0.0.1")
+	if _, locked := throttle.Check("ip:127.0.0.1"); !locked {
+		t.Fatal("Expected the key to be locked out")
+	}
+
+	throttle.Reset("ip:127.0.0.1")
+	if wait, locked := throttle.Check("ip:127.0.0.1"); wait != 0 || locked {
+		t.Fatalf("Expected the key to be unlocked, got %s (locked: %v)", wait, locked)
+	}
+}
+
+func TestInitThrottles(t *testing.T) {
+	c := config.Default()
+	c.Throttle.AccountFreeAttempts = 1
+	config.Set(c)
+	t.Cleanup(func() {
+		config.Set(config.Default())
+		InitThrottles()
+	})
+
+	InitThrottles()
+	AccountThrottle.Fail("account:a@b.c")
+	if wait, _ := AccountThrottle.Check("account:a@b.c"); wait != 0 {
+		t.Errorf("Expected the configured free attempt, got a wait of %v", wait)
+	}
+	AccountThrottle.Fail("account:a@b.c")
+	if wait, _ := AccountThrottle.Check("account:a@b.c"); wait == 0 {
+		t.Error("Expected a delay once the free attempt was used")
+	}
+}
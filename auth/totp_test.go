@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Secret "12345678901234567890" from the RFC 6238 test vectors
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	// The RFC lists 8-digit codes; we use their last 6 digits
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, expected := range vectors {
+		code, err := TOTPCode(rfcSecret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatalf("Failed to compute code: %v", err)
+		}
+		if code != expected {
+			t.Errorf("Expected code %s at %d, got %s", expected, unix, code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	code, _ := TOTPCode(rfcSecret, now)
+
+	step, ok := ValidateTOTP(rfcSecret, code, now, 0)
+	if !ok {
+		t.Fatal("Expected the current code to be accepted")
+	}
+
+	// A code from the previous period is still accepted for clock drift
+	if _, ok := ValidateTOTP(rfcSecret, code, now.Add(30*time.Second), 0); !ok {
+		t.Error("Expected a code from the previous period to be accepted")
+	}
+
+	// But not one from long ago
+	if _, ok := ValidateTOTP(rfcSecret, code, now.Add(5*time.Minute), 0); ok {
+		t.Error("Expected an old code to be rejected")
+	}
+
+	// A code cannot be used twice
+	if _, ok := ValidateTOTP(rfcSecret, code, now, step); ok {
+		t.Error("Expected a replayed code to be rejected")
+	}
+
+	if _, ok := ValidateTOTP(rfcSecret, "000000", now, 0); ok {
+		t.Error("Expected a wrong code to be rejected")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := TOTPProvisioningURI("ABC", "Book Store", "anam@user.com")
+
+	if !strings.HasPrefix(uri, "otpauth://totp/Book%20Store:anam@user.com?") {
+		t.Errorf("Unexpected provisioning URI: %s", uri)
+	}
+	if !strings.Contains(uri, "secret=ABC") || !strings.Contains(uri, "issuer=Book+Store") {
+		t.Errorf("Provisioning URI is missing parameters: %s", uri)
+	}
+}
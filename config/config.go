@@ -0,0 +1,531 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Config holds every setting of the application. Settings are taken from,
+// in increasing priority: the defaults below, the JSON file named by
+// CONFIG_FILE, the .env file and the process environment.
+type Config struct {
+	Server    ServerConfig
+	API       APIConfig
+	Database  DatabaseConfig
+	Auth      AuthConfig
+	RateLimit RateLimitConfig
+	Throttle  ThrottleConfig
+	Storage   StorageConfig
+	Mail      MailConfig
+	OIDC      OIDCConfig
+	Privacy   PrivacyConfig
+	Log       LogConfig
+	Tracing   TracingConfig
+	Metrics   MetricsConfig
+}
+
+type ServerConfig struct {
+	Port        int      `env:"APP_PORT"`
+	CORSOrigins []string `env:"CORS_ORIGINS"`
+	// TLS is served when both files are set
+	TLSCertFile string `env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"TLS_KEY_FILE"`
+	// AppURL is the frontend URL used in links sent by email
+	AppURL string `env:"APP_URL"`
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// once the server is asked to stop
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	// ProxyHeader names the header carrying the client IP, e.g.
+	// X-Forwarded-For. It is only believed for requests from
+	// TrustedProxies (IPs or CIDR ranges).
+	ProxyHeader    string   `env:"PROXY_HEADER"`
+	TrustedProxies []string `env:"TRUSTED_PROXIES"`
+}
+
+type APIConfig struct {
+	// LegacyRoutes keeps serving the unversioned paths (/login, /user/books,
+	// ...) as deprecated aliases of /api/v1
+	LegacyRoutes bool `env:"API_LEGACY_ROUTES"`
+	// LegacySunset is when the aliases are going away, announced in their
+	// Sunset header. No Sunset header is sent when it is not set.
+	LegacySunset time.Time `env:"API_LEGACY_SUNSET"`
+}
+
+type DatabaseConfig struct {
+	Host     string `env:"DB_HOST"`
+	Port     int    `env:"DB_PORT"`
+	User     string `env:"DB_USER"`
+	Password string `env:"DB_PASSWORD"`
+	Name     string `env:"DB_NAME"`
+	SSLMode  string `env:"DB_SSLMODE"`
+	TimeZone string `env:"DB_TIMEZONE"`
+
+	MaxOpenConns    int           `env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `env:"DB_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime time.Duration `env:"DB_CONN_MAX_IDLE_TIME"`
+
+	// ConnectAttempts is how often connecting is tried at startup, waiting
+	// ConnectRetryDelay (doubling each time) in between
+	ConnectAttempts   int           `env:"DB_CONNECT_ATTEMPTS"`
+	ConnectRetryDelay time.Duration `env:"DB_CONNECT_RETRY_DELAY"`
+}
+
+type AuthConfig struct {
+	// SigningKeys are PEM files; the first one signs new tokens
+	SigningKeys     []string      `env:"JWT_SIGNING_KEYS"`
+	AccessTokenTTL  time.Duration `env:"JWT_ACCESS_TTL"`
+	RefreshTokenTTL time.Duration `env:"JWT_REFRESH_TTL"`
+	RequireAdmin2FA bool          `env:"REQUIRE_ADMIN_2FA"`
+}
+
+// RateLimitConfig holds the rate limit policies, each a token bucket per
+// client
+type RateLimitConfig struct {
+	// Client limits every API request per IP before its credentials are
+	// checked; API then limits per user or API key
+	Client Rate `env:"RATE_LIMIT_CLIENT"`
+	API    Rate `env:"RATE_LIMIT_API"`
+	Public Rate `env:"RATE_LIMIT_PUBLIC"`
+
+	// Per IP on the routes that check credentials or send email
+	Login         Rate `env:"RATE_LIMIT_LOGIN"`
+	TwoFactor     Rate `env:"RATE_LIMIT_LOGIN_2FA"`
+	TokenRefresh  Rate `env:"RATE_LIMIT_TOKEN_REFRESH"`
+	ResetPassword Rate `env:"RATE_LIMIT_RESET_PASSWORD"`
+	OIDC          Rate `env:"RATE_LIMIT_OIDC"`
+	Register      Rate `env:"RATE_LIMIT_REGISTER"`
+	AccountEmail  Rate `env:"RATE_LIMIT_ACCOUNT_EMAIL"`
+}
+
+// ThrottleConfig controls the delays after failed logins, per account and
+// per IP. Past the free attempts every failure doubles the wait, up to the
+// maximum delay; at the lockout threshold the account or IP is locked out
+// for the lockout duration. Failures are forgotten after the same duration.
+type ThrottleConfig struct {
+	AccountFreeAttempts     int           `env:"LOGIN_ACCOUNT_FREE_ATTEMPTS"`
+	AccountMaxDelay         time.Duration `env:"LOGIN_ACCOUNT_MAX_DELAY"`
+	AccountLockoutThreshold int           `env:"LOGIN_ACCOUNT_LOCKOUT_THRESHOLD"`
+	AccountLockout          time.Duration `env:"LOGIN_ACCOUNT_LOCKOUT"`
+
+	// Higher by default because many users can share one address
+	IPFreeAttempts     int           `env:"LOGIN_IP_FREE_ATTEMPTS"`
+	IPMaxDelay         time.Duration `env:"LOGIN_IP_MAX_DELAY"`
+	IPLockoutThreshold int           `env:"LOGIN_IP_LOCKOUT_THRESHOLD"`
+	IPLockout          time.Duration `env:"LOGIN_IP_LOCKOUT"`
+}
+
+// Rate is a number of requests per period, written like "10/1m". A bucket
+// size other than the number of requests is added as ";burst=60".
+type Rate struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+}
+
+// ParseRate reads a rate written like "300/1m;burst=60"
+func ParseRate(value string) (Rate, error) {
+	spec, burst, hasBurst := strings.Cut(value, ";")
+	requests, per, ok := strings.Cut(spec, "/")
+	if !ok {
+		return Rate{}, errors.New("expected requests/period, e.g. 10/1m")
+	}
+
+	var r Rate
+	var err error
+	if r.Requests, err = strconv.Atoi(strings.TrimSpace(requests)); err != nil {
+		return Rate{}, err
+	}
+	if r.Per, err = time.ParseDuration(strings.TrimSpace(per)); err != nil {
+		return Rate{}, err
+	}
+	if hasBurst {
+		size, ok := strings.CutPrefix(strings.TrimSpace(burst), "burst=")
+		if !ok {
+			return Rate{}, errors.New("expected ;burst=N after the rate")
+		}
+		if r.Burst, err = strconv.Atoi(size); err != nil {
+			return Rate{}, err
+		}
+	}
+	return r, nil
+}
+
+func (r Rate) valid() bool {
+	return r.Requests > 0 && r.Per > 0 && r.Burst >= 0
+}
+
+type StorageConfig struct {
+	// BooksDir holds the book files the books' paths point to
+	BooksDir string `env:"BOOKS_DIR"`
+}
+
+type MailConfig struct {
+	// Dir receives .eml files when no SMTP server is configured; without
+	// either the server does not start
+	Dir          string `env:"MAIL_DIR"`
+	SMTPHost     string `env:"SMTP_HOST"`
+	SMTPPort     int    `env:"SMTP_PORT"`
+	SMTPUsername string `env:"SMTP_USERNAME"`
+	SMTPPassword string `env:"SMTP_PASSWORD"`
+	From         string `env:"SMTP_FROM"`
+}
+
+type OIDCConfig struct {
+	// OIDC login is disabled without an issuer
+	Issuer       string `env:"OIDC_ISSUER"`
+	ClientID     string `env:"OIDC_CLIENT_ID"`
+	ClientSecret string `env:"OIDC_CLIENT_SECRET"`
+	RedirectURL  string `env:"OIDC_REDIRECT_URL"`
+}
+
+type PrivacyConfig struct {
+	// ErasureGracePeriod is how long a deleted account can be restored
+	ErasureGracePeriod time.Duration `env:"ERASURE_GRACE_PERIOD"`
+}
+
+type LogConfig struct {
+	// Level is debug, info, warn or error
+	Level string `env:"LOG_LEVEL"`
+	// SlowQueryThreshold is how long a SQL query may take before it is
+	// logged as slow
+	SlowQueryThreshold time.Duration `env:"LOG_SLOW_QUERY_THRESHOLD"`
+}
+
+type TracingConfig struct {
+	// Exporter is none, otlp (OTLP over HTTP to Endpoint) or stdout
+	Exporter    string  `env:"OTEL_TRACES_EXPORTER"`
+	Endpoint    string  `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	ServiceName string  `env:"OTEL_SERVICE_NAME"`
+	SampleRatio float64 `env:"OTEL_TRACES_SAMPLE_RATIO"`
+}
+
+type MetricsConfig struct {
+	// Token is the bearer token scrapers send to /metrics, which is
+	// disabled without one
+	Token string `env:"METRICS_TOKEN"`
+}
+
+// Default returns the configuration used for everything that is not set
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:            8080,
+			CORSOrigins:     []string{"http://localhost:5173"},
+			AppURL:          "http://localhost:5173",
+			ShutdownTimeout: 20 * time.Second,
+		},
+		API: APIConfig{
+			LegacyRoutes: true,
+		},
+		Database: DatabaseConfig{
+			Host:            "localhost",
+			Port:            5432,
+			SSLMode:         "disable",
+			TimeZone:        "UTC",
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+
+			ConnectAttempts:   5,
+			ConnectRetryDelay: 2 * time.Second,
+		},
+		Auth: AuthConfig{
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 24 * time.Hour,
+		},
+		RateLimit: RateLimitConfig{
+			Client:        Rate{Requests: 600, Per: time.Minute, Burst: 120},
+			API:           Rate{Requests: 300, Per: time.Minute, Burst: 60},
+			Public:        Rate{Requests: 120, Per: time.Minute},
+			Login:         Rate{Requests: 10, Per: time.Minute},
+			TwoFactor:     Rate{Requests: 10, Per: time.Minute},
+			TokenRefresh:  Rate{Requests: 30, Per: time.Minute},
+			ResetPassword: Rate{Requests: 10, Per: time.Minute},
+			OIDC:          Rate{Requests: 20, Per: time.Minute},
+			Register:      Rate{Requests: 5, Per: time.Hour},
+			AccountEmail:  Rate{Requests: 5, Per: time.Hour},
+		},
+		Throttle: ThrottleConfig{
+			AccountFreeAttempts:     3,
+			AccountMaxDelay:         30 * time.Second,
+			AccountLockoutThreshold: 10,
+			AccountLockout:          15 * time.Minute,
+			IPFreeAttempts:          10,
+			IPMaxDelay:              time.Minute,
+			IPLockoutThreshold:      50,
+			IPLockout:               time.Hour,
+		},
+		Storage: StorageConfig{
+			BooksDir: "books",
+		},
+		Mail: MailConfig{
+			SMTPPort: 25,
+			From:     "bookstore@localhost",
+		},
+		Privacy: PrivacyConfig{
+			ErasureGracePeriod: 30 * 24 * time.Hour,
+		},
+		Log: LogConfig{
+			Level:              "info",
+			SlowQueryThreshold: 200 * time.Millisecond,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			Endpoint:    "http://localhost:4318",
+			ServiceName: "bookstore",
+			SampleRatio: 1,
+		},
+	}
+}
+
+var current = Default()
+
+// Get returns the application-wide configuration. Until Load has run it
+// holds the defaults.
+func Get() *Config {
+	return current
+}
+
+// Set replaces the application-wide configuration, e.g. in tests
+func Set(c *Config) {
+	current = c
+}
+
+// Load reads the configuration, validates it and makes it the
+// application-wide configuration
+func Load() (*Config, error) {
+	// The .env file is optional; it never overrides variables that are set
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("reading .env: %w", err)
+	}
+
+	c := Default()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.apply(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	current = c
+	return c, nil
+}
+
+// loadFile reads a JSON file of settings keyed like the environment
+// variables, e.g. {"APP_PORT": 8080, "CORS_ORIGINS": ["https://shop.example"]}
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	return c.apply(func(key string) (string, bool) {
+		value, ok := values[key]
+		if !ok || value == nil {
+			return "", false
+		}
+		switch v := value.(type) {
+		case string:
+			return v, true
+		case []interface{}:
+			parts := make([]string, len(v))
+			for i, part := range v {
+				parts[i] = fmt.Sprint(part)
+			}
+			return strings.Join(parts, ","), true
+		default:
+			return fmt.Sprint(v), true
+		}
+	})
+}
+
+// apply sets every field whose variable lookup finds a value
+func (c *Config) apply(lookup func(string) (string, bool)) error {
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			key := section.Type().Field(j).Tag.Get("env")
+			if key == "" {
+				continue
+			}
+			// Empty values count as unset, like the blanks in .env.example
+			value, ok := lookup(key)
+			if !ok || strings.TrimSpace(value) == "" {
+				continue
+			}
+			if err := setField(section.Field(j), strings.TrimSpace(value)); err != nil {
+				return fmt.Errorf("invalid %s %q: %w", key, value, err)
+			}
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case time.Time:
+		// A plain date means midnight UTC
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, value); err != nil {
+				return err
+			}
+		}
+		field.Set(reflect.ValueOf(t))
+	case Rate:
+		r, err := ParseRate(value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(r))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once, so a broken deployment
+// fails at startup rather than on the first request that needs it
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "APP_PORT must be between 1 and 65535")
+	check(len(c.Server.CORSOrigins) > 0, "CORS_ORIGINS must list at least one origin")
+	check((c.Server.TLSCertFile == "") == (c.Server.TLSKeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	check(c.Server.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT must be positive")
+	check(c.Server.ProxyHeader == "" || len(c.Server.TrustedProxies) > 0, "TRUSTED_PROXIES is required with PROXY_HEADER, or anyone can choose their IP")
+
+	check(c.Database.Host != "", "DB_HOST is required")
+	check(c.Database.User != "", "DB_USER is required")
+	check(c.Database.Name != "", "DB_NAME is required")
+	check(c.Database.Port > 0 && c.Database.Port < 65536, "DB_PORT must be between 1 and 65535")
+	switch c.Database.SSLMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		check(false, "DB_SSLMODE %q is not a PostgreSQL sslmode", c.Database.SSLMode)
+	}
+	_, err := time.LoadLocation(c.Database.TimeZone)
+	check(err == nil, "DB_TIMEZONE %q is not a known time zone", c.Database.TimeZone)
+	check(c.Database.MaxOpenConns > 0, "DB_MAX_OPEN_CONNS must be positive")
+	check(c.Database.MaxIdleConns >= 0 && c.Database.MaxIdleConns <= c.Database.MaxOpenConns, "DB_MAX_IDLE_CONNS must be between 0 and DB_MAX_OPEN_CONNS")
+	check(c.Database.ConnectAttempts > 0, "DB_CONNECT_ATTEMPTS must be positive")
+	check(c.Database.ConnectRetryDelay >= 0, "DB_CONNECT_RETRY_DELAY must not be negative")
+
+	check(c.Auth.AccessTokenTTL > 0, "JWT_ACCESS_TTL must be positive")
+	check(c.Auth.RefreshTokenTTL >= c.Auth.AccessTokenTTL, "JWT_REFRESH_TTL must not be shorter than JWT_ACCESS_TTL")
+
+	limits := reflect.ValueOf(c.RateLimit)
+	for i := 0; i < limits.NumField(); i++ {
+		rate := limits.Field(i).Interface().(Rate)
+		check(rate.valid(), "%s must allow at least one request per positive period", limits.Type().Field(i).Tag.Get("env"))
+	}
+
+	for _, throttle := range []struct {
+		name                    string
+		freeAttempts, threshold int
+		maxDelay, lockout       time.Duration
+	}{
+		{"LOGIN_ACCOUNT", c.Throttle.AccountFreeAttempts, c.Throttle.AccountLockoutThreshold, c.Throttle.AccountMaxDelay, c.Throttle.AccountLockout},
+		{"LOGIN_IP", c.Throttle.IPFreeAttempts, c.Throttle.IPLockoutThreshold, c.Throttle.IPMaxDelay, c.Throttle.IPLockout},
+	} {
+		check(throttle.freeAttempts >= 0, "%s_FREE_ATTEMPTS must not be negative", throttle.name)
+		check(throttle.threshold > throttle.freeAttempts, "%s_LOCKOUT_THRESHOLD must be above %s_FREE_ATTEMPTS", throttle.name, throttle.name)
+		check(throttle.maxDelay >= time.Second, "%s_MAX_DELAY must be at least 1s", throttle.name)
+		check(throttle.lockout > 0, "%s_LOCKOUT must be positive", throttle.name)
+	}
+
+	check(c.Mail.SMTPPort > 0 && c.Mail.SMTPPort < 65536, "SMTP_PORT must be between 1 and 65535")
+
+	if c.OIDC.Issuer != "" {
+		check(c.OIDC.ClientID != "", "OIDC_CLIENT_ID is required with OIDC_ISSUER")
+		check(c.OIDC.RedirectURL != "", "OIDC_REDIRECT_URL is required with OIDC_ISSUER")
+	}
+
+	check(c.Privacy.ErasureGracePeriod >= 0, "ERASURE_GRACE_PERIOD must not be negative")
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		check(false, "LOG_LEVEL %q must be debug, info, warn or error", c.Log.Level)
+	}
+	check(c.Log.SlowQueryThreshold >= 0, "LOG_SLOW_QUERY_THRESHOLD must not be negative")
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		check(c.Tracing.Endpoint != "", "OTEL_EXPORTER_OTLP_ENDPOINT is required with the otlp exporter")
+	default:
+		check(false, "OTEL_TRACES_EXPORTER %q must be none, otlp or stdout", c.Tracing.Exporter)
+	}
+	check(c.Tracing.ServiceName != "", "OTEL_SERVICE_NAME is required")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "OTEL_TRACES_SAMPLE_RATIO must be between 0 and 1")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	// Run in an empty directory so no .env file is picked up
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd failed: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Chdir failed: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Errorf("Changing back to %s failed: %v", wd, err)
+		}
+	})
+
+	file := filepath.Join(dir, "config.json")
+	err = os.WriteFile(file, []byte(`{
+		"DB_USER": "bookstore",
+		"DB_NAME": "bookstore",
+		"APP_PORT": 9000,
+		"CORS_ORIGINS": ["https://shop.example", "https://admin.example"],
+		"JWT_ACCESS_TTL": "5m"
+	}`), 0o644)
+	if err != nil {
+		t.Fatalf("Writing the config file failed: %v", err)
+	}
+
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("APP_PORT", "9443")
+	t.Setenv("DB_SSLMODE", "require")
+	t.Setenv("DB_HOST", "")
+	t.Setenv("API_LEGACY_SUNSET", "2027-04-30")
+	t.Setenv("RATE_LIMIT_API", "100/1m;burst=20")
+	t.Setenv("LOGIN_IP_LOCKOUT", "2h")
+
+	c, err := Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	t.Cleanup(func() { Set(Default()) })
+
+	// The environment wins over the file...
+	if c.Server.Port != 9443 {
+		t.Errorf("Expected the port from the environment, got %d", c.Server.Port)
+	}
+	// ...the file wins over the defaults...
+	if got := strings.Join(c.Server.CORSOrigins, ","); got != "https://shop.example,https://admin.example" {
+		t.Errorf("Unexpected CORS origins %q", got)
+	}
+	if c.Auth.AccessTokenTTL != 5*time.Minute || c.Database.SSLMode != "require" {
+		t.Errorf("Unexpected settings: %+v %+v", c.Auth, c.Database)
+	}
+	if want := time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC); !c.API.LegacySunset.Equal(want) {
+		t.Errorf("Expected the sunset date %v, got %v", want, c.API.LegacySunset)
+	}
+	if want := (Rate{Requests: 100, Per: time.Minute, Burst: 20}); c.RateLimit.API != want {
+		t.Errorf("Expected the API rate %+v, got %+v", want, c.RateLimit.API)
+	}
+	if c.Throttle.IPLockout != 2*time.Hour {
+		t.Errorf("Expected the IP lockout from the environment, got %v", c.Throttle.IPLockout)
+	}
+	// ...and blank variables keep the default
+	if c.Database.Host != "localhost" || c.Auth.RefreshTokenTTL != 24*time.Hour {
+		t.Errorf("Expected defaults, got %+v %+v", c.Database, c.Auth)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.Database.User = "bookstore"
+	c.Database.Name = "bookstore"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Expected the defaults to be valid: %v", err)
+	}
+
+	c.Server.TLSCertFile = "cert.pem"
+	c.Server.ProxyHeader = "X-Forwarded-For"
+	c.Database.SSLMode = "sometimes"
+	c.RateLimit.Login = Rate{Per: time.Minute}
+	c.Throttle.AccountLockoutThreshold = c.Throttle.AccountFreeAttempts
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("Expected an invalid configuration")
+	}
+	for _, want := range []string{"TLS_KEY_FILE", "TRUSTED_PROXIES", "DB_SSLMODE", "RATE_LIMIT_LOGIN", "LOGIN_ACCOUNT_LOCKOUT_THRESHOLD"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected the error to mention %s: %v", want, err)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for value, want := range map[string]Rate{
+		"10/1m":              {Requests: 10, Per: time.Minute},
+		"300/1m;burst=60":    {Requests: 300, Per: time.Minute, Burst: 60},
+		" 5 / 1h ; burst=2 ": {Requests: 5, Per: time.Hour, Burst: 2},
+	} {
+		got, err := ParseRate(value)
+		if err != nil || got != want {
+			t.Errorf("ParseRate(%q) = %+v, %v; want %+v", value, got, err, want)
+		}
+	}
+
+	for _, value := range []string{"", "10", "ten/1m", "10/minute", "10/1m;60"} {
+		if _, err := ParseRate(value); err == nil {
+			t.Errorf("ParseRate(%q) succeeded", value)
+		}
+	}
+}
@@ -1,52 +1,200 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"log/slog"
+	"time"
 
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/logging"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 var db *gorm.DB
 
+// models are the tables AutoMigrateModels creates. Users come first because
+// their migration backfills data.
+var models = []interface{}{
+	&User{},
+	&Book{},
+	&CartItem{},
+	&Review{},
+	&Wishlist{},
+	&WishlistItem{},
+	&Notification{},
+	&UserToken{},
+	&RecoveryCode{},
+	&APIKey{},
+	&Session{},
+}
+
 func InitDatabase() (*gorm.DB, error) {
-	// Define the database connection string using environment variables
-	dbHost := os.Getenv("DB_HOST")
-	dbPort := os.Getenv("DB_PORT")
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
+	cfg := config.Get().Database
 
 	// Define the database connection string
 	ConnStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable TimeZone=Asia/Shanghai",
-		dbHost, dbPort, dbUser, dbPassword, dbName,
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s TimeZone=%s",
+		cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.Name, cfg.SSLMode, cfg.TimeZone,
 	)
 
-	// Open the database connection
+	// Open the database connection. The database often starts at the same
+	// time as the app, so retry a few times with a growing delay.
 	var err error
-	db, err = gorm.Open(postgres.Open(ConnStr), &gorm.Config{})
+	db, err = connect(func() (*gorm.DB, error) {
+		return gorm.Open(postgres.Open(ConnStr), &gorm.Config{
+			Logger: logging.NewGormLogger(config.Get().Log.SlowQueryThreshold),
+		})
+	}, cfg.ConnectAttempts, cfg.ConnectRetryDelay, time.Sleep)
 	if err != nil {
 		return nil, err
 	}
 
+	// Size the connection pool
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
 	return db, nil
 }
 
+// connect calls open until it succeeds or the attempts are used up, sleeping
+// between attempts for the delay, which doubles every time
+func connect(open func() (*gorm.DB, error), attempts int, delay time.Duration, sleep func(time.Duration)) (*gorm.DB, error) {
+	for attempt := 1; ; attempt++ {
+		conn, err := open()
+		if err == nil {
+			return conn, nil
+		}
+		if attempt >= attempts {
+			return nil, fmt.Errorf("connecting to the database after %d attempts: %w", attempt, err)
+		}
+
+		slog.Warn("Database not reachable, retrying",
+			"attempt", attempt, "attempts", attempts, "retry_in", delay.String(), "error", err)
+		sleep(delay)
+		delay *= 2
+	}
+}
+
+// RegisterHooks adds callbacks named after prefix around every kind of
+// query: before runs ahead of gorm's own callback and after once it is done.
+// Both are built for the operation, e.g. "query" or "create".
+func RegisterHooks(db *gorm.DB, prefix string, before, after func(operation string) func(*gorm.DB)) error {
+	callbacks := db.Callback()
+	type hook struct {
+		operation string
+		before    func(string, func(*gorm.DB)) error
+		after     func(string, func(*gorm.DB)) error
+	}
+	hooks := []hook{
+		{"create", callbacks.Create().Before("gorm:create").Register, callbacks.Create().After("gorm:create").Register},
+		{"query", callbacks.Query().Before("gorm:query").Register, callbacks.Query().After("gorm:query").Register},
+		{"update", callbacks.Update().Before("gorm:update").Register, callbacks.Update().After("gorm:update").Register},
+		{"delete", callbacks.Delete().Before("gorm:delete").Register, callbacks.Delete().After("gorm:delete").Register},
+		{"row", callbacks.Row().Before("gorm:row").Register, callbacks.Row().After("gorm:row").Register},
+		{"raw", callbacks.Raw().Before("gorm:raw").Register, callbacks.Raw().After("gorm:raw").Register},
+	}
+	for _, h := range hooks {
+		if err := h.before(prefix+":before_"+h.operation, before(h.operation)); err != nil {
+			return err
+		}
+		if err := h.after(prefix+":after_"+h.operation, after(h.operation)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func GetDB() *gorm.DB {
 	return db
 }
 
+// SetDB replaces the application-wide connection, e.g. with an in-memory
+// database in tests
+func SetDB(conn *gorm.DB) {
+	db = conn
+}
+
+// WithContext returns the database session for a request, so its queries are
+// cancelled with it and logged with its request ID
+func WithContext(ctx context.Context) *gorm.DB {
+	return db.WithContext(ctx)
+}
+
 func CloseDB() {
+	if db == nil {
+		return
+	}
 	db, _ := db.DB()
 	db.Close()
 }
 
-func AutoMigrateModels(db *gorm.DB) {
+func AutoMigrateModels(db *gorm.DB) error {
+	// Users that existed before email verification was introduced are
+	// treated as verified
+	backfillVerified := db.Migrator().HasTable(&User{}) && !db.Migrator().HasColumn(&User{}, "EmailVerifiedAt")
+	// Existing users become active, except those still waiting to verify
+	// their email
+	backfillStatus := db.Migrator().HasTable(&User{}) && !db.Migrator().HasColumn(&User{}, "Status")
+
+	if err := db.AutoMigrate(&User{}); err != nil {
+		return err
+	}
+	if backfillVerified {
+		if err := db.Model(&User{}).Where("email_verified_at IS NULL").Update("email_verified_at", gorm.Expr("created_at")).Error; err != nil {
+			return err
+		}
+	}
+	if backfillStatus {
+		if err := db.Model(&User{}).Where("email_verified_at IS NULL").Update("status", AccountStatusPendingVerification).Error; err != nil {
+			return err
+		}
+	}
+
+	return db.AutoMigrate(models[1:]...)
+}
+
+// PendingMigrations lists the tables and columns the models need that are
+// missing from the database, i.e. AutoMigrateModels has not run since the
+// models changed
+func PendingMigrations(db *gorm.DB) ([]string, error) {
+	var missing []string
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return nil, err
+		}
+
+		table := stmt.Schema.Table
+		if !db.Migrator().HasTable(table) {
+			missing = append(missing, table)
+			continue
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !db.Migrator().HasColumn(model, field.DBName) {
+				missing = append(missing, table+"."+field.DBName)
+			}
+		}
+	}
+	return missing, nil
+}
 
-	db.AutoMigrate(&User{})
-	db.AutoMigrate(&Book{})
-	db.AutoMigrate(&CartItem{})
-	db.AutoMigrate(&Review{})
+// Ping checks that the database answers
+func Ping(ctx context.Context) error {
+	if db == nil {
+		return errors.New("database is not connected")
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
 }
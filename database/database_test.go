@@ -0,0 +1,81 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestConnectRetries(t *testing.T) {
+	unreachable := errors.New("connection refused")
+	conn := &gorm.DB{}
+
+	for _, tc := range []struct {
+		name       string
+		failures   int
+		wantErr    bool
+		wantSleeps []time.Duration
+	}{
+		{"first attempt", 0, false, nil},
+		{"after retries", 2, false, []time.Duration{time.Second, 2 * time.Second}},
+		{"never reachable", 5, true, []time.Duration{time.Second, 2 * time.Second}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			var sleeps []time.Duration
+			got, err := connect(func() (*gorm.DB, error) {
+				calls++
+				if calls <= tc.failures {
+					return nil, unreachable
+				}
+				return conn, nil
+			}, 3, time.Second, func(d time.Duration) { sleeps = append(sleeps, d) })
+
+			if tc.wantErr {
+				if !errors.Is(err, unreachable) || got != nil {
+					t.Errorf("Expected the last error, got %v", err)
+				}
+				if calls != 3 {
+					t.Errorf("Expected 3 attempts, got %d", calls)
+				}
+			} else if err != nil || got != conn {
+				t.Errorf("Expected the connection, got %v", err)
+			}
+			if !reflect.DeepEqual(sleeps, tc.wantSleeps) {
+				t.Errorf("Expected sleeps %v, got %v", tc.wantSleeps, sleeps)
+			}
+		})
+	}
+}
+
+func TestRegisterHooks(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("Opening the database failed: %v", err)
+	}
+	if err := db.AutoMigrate(&Book{}); err != nil {
+		t.Fatalf("Migrating failed: %v", err)
+	}
+
+	var calls []string
+	hook := func(when string) func(string) func(*gorm.DB) {
+		return func(operation string) func(*gorm.DB) {
+			return func(*gorm.DB) { calls = append(calls, when+" "+operation) }
+		}
+	}
+	if err := RegisterHooks(db, "test", hook("before"), hook("after")); err != nil {
+		t.Fatalf("RegisterHooks failed: %v", err)
+	}
+
+	db.Create(&Book{Title: "Dune"})
+	db.First(&Book{})
+	want := []string{"before create", "after create", "before query", "after query"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("Expected %v, got %v", want, calls)
+	}
+}
@@ -0,0 +1,45 @@
+// Package databasetest provides an in-memory database for tests, so code
+// using the application-wide connection can run without Postgres
+package databasetest
+
+import (
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Open creates an empty, migrated in-memory database and makes it the
+// application-wide connection until the test ends
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("Opening the test database failed: %v", err)
+	}
+
+	// Every connection to :memory: is a database of its own
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("Opening the test database failed: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	if err := database.AutoMigrateModels(db); err != nil {
+		t.Fatalf("Migrating the test database failed: %v", err)
+	}
+
+	previous := database.GetDB()
+	database.SetDB(db)
+	t.Cleanup(func() {
+		database.SetDB(previous)
+		sqlDB.Close()
+	})
+
+	return db
+}
@@ -1,6 +1,11 @@
 package database
 
 import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -12,6 +17,16 @@ const (
 	UserRoleStandard UserRole = "user"
 )
 
+// AccountStatus tells whether a user may use their account
+type AccountStatus string
+
+const (
+	AccountStatusActive              AccountStatus = "active"
+	AccountStatusDeactivated         AccountStatus = "deactivated"
+	AccountStatusSuspended           AccountStatus = "suspended"
+	AccountStatusPendingVerification AccountStatus = "pending_verification"
+)
+
 type User struct {
 	gorm.Model
 	UserID    uint     `json:"id"`
@@ -20,6 +35,110 @@ type User struct {
 	Email     string   `json:"email"`
 	Password  []byte   `json:"-"`
 	Role      UserRole `json:"role"`
+
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+
+	// Only active accounts can log in or use their tokens. Suspensions are
+	// set by an admin and carry a reason.
+	Status          AccountStatus `json:"status" gorm:"default:active"`
+	SuspendedReason string        `json:"suspended_reason,omitempty"`
+	SuspendedAt     *time.Time    `json:"suspended_at,omitempty"`
+
+	// Set when the user asked for their data to be erased; the account is
+	// purged once the grace period has passed
+	ErasureRequestedAt *time.Time `json:"erasure_requested_at,omitempty"`
+
+	// Identity at the company OIDC provider, set once the user signed in
+	// through it
+	OIDCIssuer  string `json:"-" gorm:"column:oidc_issuer;index:idx_users_oidc"`
+	OIDCSubject string `json:"-" gorm:"column:oidc_subject;index:idx_users_oidc"`
+
+	// Two-factor authentication. The secret is set on enrollment and only
+	// used for login once the user confirmed it with a valid code.
+	TOTPSecret   string `json:"-"`
+	TOTPEnabled  bool   `json:"two_factor_enabled"`
+	TOTPLastStep int64  `json:"-"`
+}
+
+// RecoveryCode is a single-use code that replaces a TOTP code when the
+// user has lost their authenticator. Only a hash of the code is stored.
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint       `json:"user_id"`
+	CodeHash string     `json:"-"`
+	UsedAt   *time.Time `json:"used_at"`
+}
+
+// TokenPurpose tells what a single-use user token may be used for
+type TokenPurpose string
+
+const (
+	TokenPurposeVerifyEmail   TokenPurpose = "verify_email"
+	TokenPurposeResetPassword TokenPurpose = "reset_password"
+)
+
+// UserToken is a single-use, expiring token sent to a user by email. Only a
+// hash of the token is stored.
+type UserToken struct {
+	gorm.Model
+	UserID    uint         `json:"user_id"`
+	Purpose   TokenPurpose `json:"purpose"`
+	TokenHash string       `json:"-" gorm:"uniqueIndex"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	UsedAt    *time.Time   `json:"used_at"`
+}
+
+// Session is a login. Its ID is the sid claim of the tokens issued for it,
+// and RefreshTokenID the jti of the only refresh token that may renew it.
+// Revoking the session ends its access and refresh tokens.
+type Session struct {
+	ID             string     `json:"id" gorm:"primaryKey"`
+	UserID         uint       `json:"user_id" gorm:"index"`
+	RefreshTokenID string     `json:"-"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	RevokedAt      *time.Time `json:"revoked_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// APIKey lets a script call the admin API without a user login. Only a hash
+// of the key is stored; Prefix is kept so admins can tell keys apart.
+type APIKey struct {
+	gorm.Model
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	KeyHash     string     `json:"-" gorm:"uniqueIndex"`
+	Permissions StringList `json:"permissions" gorm:"type:text"`
+	CreatedByID uint       `json:"created_by_id"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+}
+
+// StringList is a list of strings stored as a comma separated text column
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l *StringList) Scan(value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into StringList", value)
+	}
+
+	*l = nil
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
 }
 
 type Book struct {
@@ -38,17 +157,55 @@ type Book struct {
 
 // Define a struct to represent a cart item
 type CartItem struct {
-    gorm.Model
-    UserID   uint    `json:"user_id"`
-    BookID   uint    `json:"book_id"`
-    Subtotal float64 `json:"subtotal"` // Change the data type to float64
-    Quantity uint    `json:"quantity"`
+	gorm.Model
+	UserID   uint    `json:"user_id"`
+	BookID   uint    `json:"book_id"`
+	Subtotal float64 `json:"subtotal"` // Change the data type to float64
+	Quantity uint    `json:"quantity"`
 }
 
 type Review struct {
 	gorm.Model
-	BookID    uint   `json:"book_id"`
-	UserID    uint   `json:"user_id"`
-	Rating    int    `json:"rating"`
-	Comment   string `json:"comment"`
+	BookID  uint   `json:"book_id"`
+	UserID  uint   `json:"user_id"`
+	Rating  int    `json:"rating"`
+	Comment string `json:"comment"`
+}
+
+// Wishlist is a named list of books a user wants to keep track of
+type Wishlist struct {
+	gorm.Model
+	UserID     uint           `json:"user_id"`
+	Name       string         `json:"name"`
+	Public     bool           `json:"public"`
+	ShareToken string         `json:"share_token,omitempty" gorm:"uniqueIndex"`
+	Items      []WishlistItem `json:"items,omitempty"`
+}
+
+// WishlistItem is a single book saved on a wishlist
+type WishlistItem struct {
+	gorm.Model
+	WishlistID uint `json:"wishlist_id"`
+	BookID     uint `json:"book_id"`
+	Book       Book `json:"book"`
+}
+
+// NotificationType identifies what a notification is about
+type NotificationType string
+
+const (
+	NotificationPriceDrop     NotificationType = "price_drop"
+	NotificationBackInStock   NotificationType = "back_in_stock"
+	NotificationReviewRemoved NotificationType = "review_removed"
+)
+
+// Notification is a message queued for a single user
+type Notification struct {
+	gorm.Model
+	UserID  uint             `json:"user_id"`
+	Type    NotificationType `json:"type"`
+	Title   string           `json:"title"`
+	Message string           `json:"message"`
+	BookID  uint             `json:"book_id,omitempty"`
+	ReadAt  *time.Time       `json:"read_at"`
 }
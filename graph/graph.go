@@ -0,0 +1,121 @@
+package graph
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/graph-gophers/graphql-go"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/logging"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+)
+
+//go:embed schema.graphql
+var schemaSource string
+
+const (
+	// maxDepth keeps queries from nesting books and reviews without end
+	maxDepth = 10
+
+	// maxParallelism is how many resolvers of a query run at once. Resolvers
+	// waiting for a loader hold on to their slot, so it also caps how many
+	// keys end up in one batch.
+	maxParallelism = 100
+)
+
+var schema = graphql.MustParseSchema(schemaSource, &Resolver{},
+	graphql.MaxDepth(maxDepth),
+	graphql.MaxParallelism(maxParallelism),
+)
+
+// request is a GraphQL query as posted to /graphql
+type request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Handler answers a GraphQL query posted as JSON. It runs after the same
+// authentication middleware as the REST API; the resolvers check the claims
+// the way the REST routes do. Errors in the response carry the same codes
+// as problems:
+//
+//	{
+//	  "errors": [{
+//	    "message": "Permission denied",
+//	    "path": ["cart"],
+//	    "extensions": {"code": "permission_denied", "status": 403}
+//	  }],
+//	  "data": null
+//	}
+func Handler(c *fiber.Ctx) error {
+	var req request
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.InvalidBody()
+	}
+	if req.Query == "" {
+		return apierror.BadRequest("Query is required")
+	}
+
+	claims, ok := middleware.Claims(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	ctx := newContext(c.UserContext(), claims)
+	response := schema.Exec(ctx, req.Query, req.OperationName, req.Variables)
+	presentErrors(ctx, response)
+	return c.JSON(response)
+}
+
+type requestKey struct{}
+
+// requestState is what the resolvers of one query share
+type requestState struct {
+	claims  *auth.Claims
+	loaders *loaders
+}
+
+// newContext returns a copy of ctx carrying the claims and a fresh set of
+// loaders, so batches and caches never outlive the query
+func newContext(ctx context.Context, claims *auth.Claims) context.Context {
+	return context.WithValue(ctx, requestKey{}, &requestState{
+		claims:  claims,
+		loaders: newLoaders(),
+	})
+}
+
+func stateFrom(ctx context.Context) *requestState {
+	state, _ := ctx.Value(requestKey{}).(*requestState)
+	return state
+}
+
+// presentErrors replaces the messages of resolver errors with their detail
+// and code, like the central error handler does for problems. The causes of
+// internal errors are logged instead of shown.
+func presentErrors(ctx context.Context, response *graphql.Response) {
+	for _, queryErr := range response.Errors {
+		if queryErr.ResolverError == nil {
+			continue
+		}
+
+		var known *apierror.Error
+		if !errors.As(queryErr.ResolverError, &known) {
+			logging.FromContext(ctx).Error("GraphQL resolver failed", "path", queryErr.Path, "error", queryErr.ResolverError)
+		}
+
+		e := apierror.From(queryErr.ResolverError)
+		extensions := map[string]interface{}{}
+		for key, value := range e.Extensions {
+			extensions[key] = value
+		}
+		extensions["code"] = e.Code
+		extensions["status"] = e.Status
+
+		queryErr.Message = e.Detail
+		queryErr.Extensions = extensions
+	}
+}
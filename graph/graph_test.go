@@ -0,0 +1,156 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/database/databasetest"
+	"gorm.io/gorm"
+)
+
+// countQueries counts the SELECTs run on db from now on
+func countQueries(t *testing.T, db *gorm.DB) *atomic.Int64 {
+	t.Helper()
+
+	var n atomic.Int64
+	err := db.Callback().Query().After("gorm:query").Register("count_queries", func(*gorm.DB) {
+		n.Add(1)
+	})
+	if err != nil {
+		t.Fatalf("Registering the callback failed: %v", err)
+	}
+	return &n
+}
+
+// exec runs a query with the claims and fails the test on any error
+func exec(t *testing.T, claims *auth.Claims, query string) string {
+	t.Helper()
+
+	ctx := newContext(context.Background(), claims)
+	response := schema.Exec(ctx, query, "", nil)
+	if len(response.Errors) != 0 {
+		t.Fatalf("Query failed: %v", response.Errors)
+	}
+	return string(response.Data)
+}
+
+func TestResolversCheckAccess(t *testing.T) {
+	user := &auth.Claims{Role: "user", Scopes: []string{auth.ScopeAPI}}
+	user.Subject = "7"
+	apiKey := &auth.Claims{Permissions: []string{auth.PermissionManageBooks}, Scopes: []string{auth.ScopeAPIKey}}
+	cartsKey := &auth.Claims{Permissions: []string{auth.PermissionManageCarts}, Scopes: []string{auth.ScopeAPIKey}}
+
+	tests := []struct {
+		name     string
+		claims   *auth.Claims
+		query    string
+		wantCode string
+	}{
+		{"someone else's cart", user, `{ cart(userId: "8") { id } }`, apierror.CodePermissionDenied},
+		{"someone else's account", user, `{ user(id: "8") { email } }`, apierror.CodePermissionDenied},
+		{"invalid ID", user, `{ book(id: "first") { title } }`, apierror.CodeBadRequest},
+		{"API key without users:manage", apiKey, `{ user(id: "8") { email } }`, apierror.CodePermissionDenied},
+		{"API key as the logged in user", apiKey, `{ me { email } }`, apierror.CodeUnauthorized},
+		{"API key without books:manage reading a book", cartsKey, `{ book(id: "1") { title } }`, apierror.CodePermissionDenied},
+		{"API key without books:manage listing books", cartsKey, `{ books { title } }`, apierror.CodePermissionDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newContext(context.Background(), tt.claims)
+			response := schema.Exec(ctx, tt.query, "", nil)
+			presentErrors(ctx, response)
+
+			if len(response.Errors) != 1 {
+				t.Fatalf("Expected one error, got %v", response.Errors)
+			}
+			if code := response.Errors[0].Extensions["code"]; code != tt.wantCode {
+				t.Errorf("Expected code %s, got %v (%s)", tt.wantCode, code, response.Errors[0].Message)
+			}
+		})
+	}
+}
+
+func TestBooksBatchReviewsAndReviewers(t *testing.T) {
+	db := databasetest.Open(t)
+	for i := 1; i <= 3; i++ {
+		user := database.User{Email: fmt.Sprintf("reader%d@example.com", i), FirstName: fmt.Sprintf("Reader%d", i)}
+		book := database.Book{Title: fmt.Sprintf("Book %d", i)}
+		for _, row := range []interface{}{&user, &book} {
+			if err := db.Create(row).Error; err != nil {
+				t.Fatalf("Creating %T failed: %v", row, err)
+			}
+		}
+		for _, rating := range []int{3, 5} {
+			if err := db.Create(&database.Review{BookID: book.ID, UserID: user.ID, Rating: rating}).Error; err != nil {
+				t.Fatalf("Creating a review failed: %v", err)
+			}
+		}
+	}
+	queries := countQueries(t, db)
+
+	claims := &auth.Claims{Role: "user", Scopes: []string{auth.ScopeAPI}}
+	data := exec(t, claims, `{ books { reviews { firstName } } }`)
+
+	// One query for the books, one for their reviews, one for the reviewers
+	if n := queries.Load(); n != 3 {
+		t.Errorf("Expected 3 queries, got %d", n)
+	}
+	if n := strings.Count(data, `"firstName":"Reader`); n != 6 {
+		t.Errorf("Expected 6 reviewers, got %d in %s", n, data)
+	}
+}
+
+func TestBooksPages(t *testing.T) {
+	db := databasetest.Open(t)
+	for i := 1; i <= 5; i++ {
+		if err := db.Create(&database.Book{Title: fmt.Sprintf("Book %d", i)}).Error; err != nil {
+			t.Fatalf("Creating a book failed: %v", err)
+		}
+	}
+
+	claims := &auth.Claims{Role: "user", Scopes: []string{auth.ScopeAPI}}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`{ books(first: 2, offset: 1) { title } }`, `{"books":[{"title":"Book 2"},{"title":"Book 3"}]}`},
+		{`{ books(first: 0) { title } }`, `{"books":[{"title":"Book 1"}]}`},
+		{`{ books(offset: 4) { title } }`, `{"books":[{"title":"Book 5"}]}`},
+	}
+	for _, tt := range tests {
+		if data := exec(t, claims, tt.query); data != tt.want {
+			t.Errorf("%s = %s, want %s", tt.query, data, tt.want)
+		}
+	}
+}
+
+func TestCartsAreBatched(t *testing.T) {
+	db := databasetest.Open(t)
+	for i := 1; i <= 2; i++ {
+		user := database.User{Email: fmt.Sprintf("reader%d@example.com", i)}
+		if err := db.Create(&user).Error; err != nil {
+			t.Fatalf("Creating a user failed: %v", err)
+		}
+		if err := db.Create(&database.CartItem{UserID: user.ID, BookID: 1, Quantity: uint(i)}).Error; err != nil {
+			t.Fatalf("Creating a cart item failed: %v", err)
+		}
+	}
+	queries := countQueries(t, db)
+
+	admin := &auth.Claims{Permissions: []string{auth.PermissionManageCarts}, Scopes: []string{auth.ScopeAPIKey}}
+	data := exec(t, admin, `{ a: cart(userId: "1") { quantity } b: cart(userId: "2") { quantity } }`)
+
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Expected 1 query, got %d", n)
+	}
+	if want := `{"a":[{"quantity":1}],"b":[{"quantity":2}]}`; data != want {
+		t.Errorf("Expected %s, got %s", want, data)
+	}
+}
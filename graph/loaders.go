@@ -0,0 +1,94 @@
+package graph
+
+import (
+	"context"
+	"time"
+
+	"github.com/graph-gophers/dataloader/v7"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+)
+
+// batchWait is how long a loader collects keys before it queries them all
+// at once. The resolvers of a list run concurrently, so the keys of every
+// item arrive well within it.
+const batchWait = 2 * time.Millisecond
+
+// loaders fetch the books, reviews, users and carts a query refers to with one
+// query per batch instead of one per item
+type loaders struct {
+	books         *dataloader.Loader[uint, *database.Book]
+	reviewsByBook *dataloader.Loader[uint, []database.Review]
+	users         *dataloader.Loader[uint, *database.User]
+	cartsByUser   *dataloader.Loader[uint, []database.CartItem]
+}
+
+func newLoaders() *loaders {
+	return &loaders{
+		books:         newLoader(loadBooks),
+		reviewsByBook: newLoader(loadReviewsByBook),
+		users:         newLoader(loadUsers),
+		cartsByUser:   newLoader(loadCartsByUser),
+	}
+}
+
+func newLoader[K comparable, V any](batch dataloader.BatchFunc[K, V]) *dataloader.Loader[K, V] {
+	return dataloader.NewBatchedLoader(batch, dataloader.WithWait[K, V](batchWait))
+}
+
+// loadBooks fetches books by ID; books that do not exist load as nil
+func loadBooks(ctx context.Context, ids []uint) []*dataloader.Result[*database.Book] {
+	var books []database.Book
+	err := database.WithContext(ctx).Where("id IN ?", ids).Find(&books).Error
+
+	found := make(map[uint]*database.Book, len(books))
+	for i := range books {
+		found[books[i].ID] = &books[i]
+	}
+	return results(ids, found, err)
+}
+
+// loadReviewsByBook fetches the reviews of each book, oldest first
+func loadReviewsByBook(ctx context.Context, bookIDs []uint) []*dataloader.Result[[]database.Review] {
+	var reviews []database.Review
+	err := database.WithContext(ctx).Where("book_id IN ?", bookIDs).Order("id").Find(&reviews).Error
+
+	found := make(map[uint][]database.Review, len(bookIDs))
+	for _, review := range reviews {
+		found[review.BookID] = append(found[review.BookID], review)
+	}
+	return results(bookIDs, found, err)
+}
+
+// loadUsers fetches users by ID; users that do not exist load as nil
+func loadUsers(ctx context.Context, ids []uint) []*dataloader.Result[*database.User] {
+	var users []database.User
+	err := database.WithContext(ctx).Where("id IN ?", ids).Find(&users).Error
+
+	found := make(map[uint]*database.User, len(users))
+	for i := range users {
+		found[users[i].ID] = &users[i]
+	}
+	return results(ids, found, err)
+}
+
+// loadCartsByUser fetches the cart items of each user, oldest first
+func loadCartsByUser(ctx context.Context, userIDs []uint) []*dataloader.Result[[]database.CartItem] {
+	var items []database.CartItem
+	err := database.WithContext(ctx).Where("user_id IN ?", userIDs).Order("id").Find(&items).Error
+
+	found := make(map[uint][]database.CartItem, len(userIDs))
+	for _, item := range items {
+		found[item.UserID] = append(found[item.UserID], item)
+	}
+	return results(userIDs, found, err)
+}
+
+// results lines up what a batch found with the keys it was asked for; a
+// failed batch fails every key
+func results[K comparable, V any](keys []K, found map[K]V, err error) []*dataloader.Result[V] {
+	out := make([]*dataloader.Result[V], len(keys))
+	for i, key := range keys {
+		out[i] = &dataloader.Result[V]{Data: found[key], Error: err}
+	}
+	return out
+}
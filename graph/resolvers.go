@@ -0,0 +1,287 @@
+package graph
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/graph-gophers/graphql-go"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+)
+
+// maxBooksPage is the most books one page of the catalog holds
+const maxBooksPage = 100
+
+// Resolver resolves the fields of the Query type
+type Resolver struct{}
+
+func (r *Resolver) Book(ctx context.Context, args struct{ ID graphql.ID }) (*bookResolver, error) {
+	if err := middleware.KeyPermissionError(stateFrom(ctx).claims, auth.PermissionManageBooks); err != nil {
+		return nil, err
+	}
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	return loadBook(ctx, id)
+}
+
+func (r *Resolver) Books(ctx context.Context, args struct{ First, Offset int32 }) ([]*bookResolver, error) {
+	if err := middleware.KeyPermissionError(stateFrom(ctx).claims, auth.PermissionManageBooks); err != nil {
+		return nil, err
+	}
+
+	// Keep the page bounded, as the REST notifications list does
+	limit := int(args.First)
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > maxBooksPage {
+		limit = maxBooksPage
+	}
+	offset := int(args.Offset)
+	if offset < 0 {
+		offset = 0
+	}
+
+	var books []database.Book
+	if err := database.WithContext(ctx).Order("id").Limit(limit).Offset(offset).Find(&books).Error; err != nil {
+		return nil, apierror.Internal("Failed to fetch books")
+	}
+
+	// Reviews and cart items of the same query find these books cached
+	resolvers := make([]*bookResolver, len(books))
+	for i := range books {
+		stateFrom(ctx).loaders.books.Prime(ctx, books[i].ID, &books[i])
+		resolvers[i] = &bookResolver{book: &books[i]}
+	}
+	return resolvers, nil
+}
+
+func (r *Resolver) Me(ctx context.Context) (*userResolver, error) {
+	userID, err := currentUserID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := loadUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, apierror.NotFound("User not found")
+	}
+	return user, nil
+}
+
+func (r *Resolver) User(ctx context.Context, args struct{ ID graphql.ID }) (*userResolver, error) {
+	id, err := parseID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := selfOrAdmin(ctx, id, auth.PermissionManageUsers); err != nil {
+		return nil, err
+	}
+	return loadUser(ctx, id)
+}
+
+func (r *Resolver) Cart(ctx context.Context, args struct{ UserID *graphql.ID }) ([]*cartItemResolver, error) {
+	var userID uint
+	var err error
+	if args.UserID != nil {
+		userID, err = parseID(*args.UserID)
+	} else {
+		userID, err = currentUserID(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cart(ctx, userID)
+}
+
+type bookResolver struct {
+	book *database.Book
+}
+
+func (r *bookResolver) ID() graphql.ID      { return toID(r.book.ID) }
+func (r *bookResolver) Title() string       { return r.book.Title }
+func (r *bookResolver) Author() string      { return r.book.Author }
+func (r *bookResolver) ISBN() string        { return r.book.ISBN }
+func (r *bookResolver) Genre() string       { return r.book.Genre }
+func (r *bookResolver) Price() float64      { return r.book.Price }
+func (r *bookResolver) Quantity() int32     { return int32(r.book.Quantity) }
+func (r *bookResolver) Description() string { return r.book.Description }
+func (r *bookResolver) Image() string       { return r.book.Image }
+
+func (r *bookResolver) Reviews(ctx context.Context) ([]*reviewResolver, error) {
+	reviews, err := stateFrom(ctx).loaders.reviewsByBook.Load(ctx, r.book.ID)()
+	if err != nil {
+		return nil, apierror.Internal("Failed to fetch reviews")
+	}
+
+	resolvers := make([]*reviewResolver, len(reviews))
+	for i := range reviews {
+		resolvers[i] = &reviewResolver{review: &reviews[i]}
+	}
+	return resolvers, nil
+}
+
+func (r *bookResolver) ReviewSummary(ctx context.Context) (*reviewSummaryResolver, error) {
+	reviews, err := stateFrom(ctx).loaders.reviewsByBook.Load(ctx, r.book.ID)()
+	if err != nil {
+		return nil, apierror.Internal("Failed to fetch reviews")
+	}
+	return &reviewSummaryResolver{reviews: reviews}, nil
+}
+
+type reviewSummaryResolver struct {
+	reviews []database.Review
+}
+
+func (r *reviewSummaryResolver) Count() int32 {
+	return int32(len(r.reviews))
+}
+
+func (r *reviewSummaryResolver) AverageRating() *float64 {
+	if len(r.reviews) == 0 {
+		return nil
+	}
+
+	total := 0
+	for _, review := range r.reviews {
+		total += review.Rating
+	}
+	average := float64(total) / float64(len(r.reviews))
+	return &average
+}
+
+type reviewResolver struct {
+	review *database.Review
+}
+
+func (r *reviewResolver) ID() graphql.ID          { return toID(r.review.ID) }
+func (r *reviewResolver) Rating() int32           { return int32(r.review.Rating) }
+func (r *reviewResolver) Comment() string         { return r.review.Comment }
+func (r *reviewResolver) CreatedAt() graphql.Time { return graphql.Time{Time: r.review.CreatedAt} }
+
+func (r *reviewResolver) Book(ctx context.Context) (*bookResolver, error) {
+	return loadBook(ctx, r.review.BookID)
+}
+
+func (r *reviewResolver) FirstName(ctx context.Context) (*string, error) {
+	// Only the first name of other reviewers is shown, as on the REST API
+	user, err := stateFrom(ctx).loaders.users.Load(ctx, r.review.UserID)()
+	if err != nil {
+		return nil, apierror.Internal("Failed to fetch reviews")
+	}
+	if user == nil {
+		return nil, nil
+	}
+	return &user.FirstName, nil
+}
+
+type userResolver struct {
+	user *database.User
+}
+
+func (r *userResolver) ID() graphql.ID         { return toID(r.user.ID) }
+func (r *userResolver) FirstName() string      { return r.user.FirstName }
+func (r *userResolver) LastName() string       { return r.user.LastName }
+func (r *userResolver) Email() string          { return r.user.Email }
+func (r *userResolver) Role() string           { return string(r.user.Role) }
+func (r *userResolver) Status() string         { return string(r.user.Status) }
+func (r *userResolver) TwoFactorEnabled() bool { return r.user.TOTPEnabled }
+
+func (r *userResolver) Cart(ctx context.Context) ([]*cartItemResolver, error) {
+	return cart(ctx, r.user.ID)
+}
+
+type cartItemResolver struct {
+	item *database.CartItem
+}
+
+func (r *cartItemResolver) ID() graphql.ID    { return toID(r.item.ID) }
+func (r *cartItemResolver) Quantity() int32   { return int32(r.item.Quantity) }
+func (r *cartItemResolver) Subtotal() float64 { return r.item.Subtotal }
+
+func (r *cartItemResolver) Book(ctx context.Context) (*bookResolver, error) {
+	return loadBook(ctx, r.item.BookID)
+}
+
+// cart returns the items of a user's cart, which only the user and admins
+// holding carts:manage may see
+func cart(ctx context.Context, userID uint) ([]*cartItemResolver, error) {
+	if err := selfOrAdmin(ctx, userID, auth.PermissionManageCarts); err != nil {
+		return nil, err
+	}
+
+	items, err := stateFrom(ctx).loaders.cartsByUser.Load(ctx, userID)()
+	if err != nil {
+		return nil, apierror.Internal("Failed to fetch cart items")
+	}
+
+	resolvers := make([]*cartItemResolver, len(items))
+	for i := range items {
+		resolvers[i] = &cartItemResolver{item: &items[i]}
+	}
+	return resolvers, nil
+}
+
+// loadBook returns the book with the ID, or nil if there is none
+func loadBook(ctx context.Context, id uint) (*bookResolver, error) {
+	book, err := stateFrom(ctx).loaders.books.Load(ctx, id)()
+	if err != nil {
+		return nil, apierror.Internal("Failed to fetch book details")
+	}
+	if book == nil {
+		return nil, nil
+	}
+	return &bookResolver{book: book}, nil
+}
+
+// loadUser returns the user with the ID, or nil if there is none
+func loadUser(ctx context.Context, id uint) (*userResolver, error) {
+	user, err := stateFrom(ctx).loaders.users.Load(ctx, id)()
+	if err != nil {
+		return nil, apierror.Internal("Failed to fetch user")
+	}
+	if user == nil {
+		return nil, nil
+	}
+	return &userResolver{user: user}, nil
+}
+
+// currentUserID returns the ID of the logged in user; API keys do not belong
+// to one
+func currentUserID(ctx context.Context) (uint, error) {
+	userID, err := stateFrom(ctx).claims.UserID()
+	if err != nil {
+		return 0, middleware.Unauthorized()
+	}
+	return userID, nil
+}
+
+// selfOrAdmin lets users reach their own data and admins holding the
+// permission anyone's, like middleware.RequireSelfOrAdmin
+func selfOrAdmin(ctx context.Context, userID uint, permission string) error {
+	claims := stateFrom(ctx).claims
+	if current, err := claims.UserID(); err == nil && current == userID {
+		return nil
+	}
+	return middleware.AdminPermissionError(claims, permission)
+}
+
+func parseID(id graphql.ID) (uint, error) {
+	value, err := strconv.ParseUint(string(id), 10, 32)
+	if err != nil || value == 0 {
+		return 0, apierror.BadRequest("Invalid ID format")
+	}
+	return uint(value), nil
+}
+
+func toID(id uint) graphql.ID {
+	return graphql.ID(strconv.FormatUint(uint64(id), 10))
+}
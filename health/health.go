@@ -0,0 +1,95 @@
+package health
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// Check is a single dependency the application needs to serve traffic
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Result is the outcome of one check. The report is served publicly, so the
+// error, which can name hosts and paths, is left out of it for the caller to
+// log.
+type Result struct {
+	Status     string `json:"status"`
+	Error      string `json:"-"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Report is the outcome of all checks
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Ready reports whether every check passed
+func (r Report) Ready() bool {
+	return r.Status == "ready"
+}
+
+// Run runs the checks concurrently, giving each until the context ends
+func Run(ctx context.Context, checks []Check) Report {
+	report := Report{Status: "ready", Checks: make(map[string]Result, len(checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := runCheck(ctx, check)
+			result := Result{Status: "ok", DurationMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Status = "failed"
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.Name] = result
+			if err != nil {
+				report.Status = "not_ready"
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	return report
+}
+
+// runCheck runs a check but stops waiting for it once the context ends, so a
+// hanging dependency cannot hang the probe
+func runCheck(ctx context.Context, check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check.Run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Writable makes sure files can be created in dir, creating it if needed
+func Writable(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,60 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	ok := Check{Name: "ok", Run: func(ctx context.Context) error { return nil }}
+	failing := Check{Name: "failing", Run: func(ctx context.Context) error { return errors.New("down") }}
+	hanging := Check{Name: "hanging", Run: func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}}
+
+	report := Run(context.Background(), []Check{ok})
+	if !report.Ready() || report.Checks["ok"].Status != "ok" {
+		t.Fatalf("Expected a ready report, got %+v", report)
+	}
+
+	// A hanging check is given up on once the context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report = Run(ctx, []Check{ok, failing, hanging})
+	if report.Ready() {
+		t.Fatal("Expected the report not to be ready")
+	}
+	if got := report.Checks["failing"]; got.Status != "failed" || got.Error != "down" {
+		t.Errorf("Unexpected result for the failing check: %+v", got)
+	}
+	if got := report.Checks["hanging"]; got.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("Expected the hanging check to time out, got %+v", got)
+	}
+	if report.Checks["ok"].Status != "ok" {
+		t.Errorf("Expected the healthy check to pass, got %+v", report.Checks["ok"])
+	}
+}
+
+func TestWritable(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "books")
+	if err := Writable(dir); err != nil {
+		t.Fatalf("Expected a new directory to be writable: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected the check to clean up, found %d files", len(entries))
+	}
+
+	// A file where the directory should be
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatalf("Creating the file failed: %v", err)
+	}
+	if err := Writable(file); err == nil {
+		t.Error("Expected a file not to be a writable directory")
+	}
+}
@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/utils"
+)
+
+// GormLogger writes gorm's logs through slog, tagged with the request ID of
+// the query's context. Failed queries are logged as errors and queries
+// slower than SlowThreshold as warnings; the rest only at debug level.
+// Queries are logged with placeholders instead of their values, which
+// include password hashes, tokens and personal data.
+type GormLogger struct {
+	SlowThreshold time.Duration
+	Level         logger.LogLevel
+}
+
+// NewGormLogger returns a gorm logger that reports slow queries and errors
+func NewGormLogger(slowThreshold time.Duration) *GormLogger {
+	return &GormLogger{SlowThreshold: slowThreshold, Level: logger.Info}
+}
+
+func (l *GormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	clone := *l
+	clone.Level = level
+	return &clone
+}
+
+func (l *GormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if l.Level >= logger.Info {
+		FromContext(ctx).InfoContext(ctx, fmt.Sprintf(msg, args...), "source", utils.FileWithLineNum())
+	}
+}
+
+func (l *GormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if l.Level >= logger.Warn {
+		FromContext(ctx).WarnContext(ctx, fmt.Sprintf(msg, args...), "source", utils.FileWithLineNum())
+	}
+}
+
+func (l *GormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if l.Level >= logger.Error {
+		FromContext(ctx).ErrorContext(ctx, fmt.Sprintf(msg, args...), "source", utils.FileWithLineNum())
+	}
+}
+
+// ParamsFilter drops the values of a query before it is logged
+func (l *GormLogger) ParamsFilter(ctx context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	return sql, nil
+}
+
+func (l *GormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.Level <= logger.Silent {
+		return
+	}
+
+	elapsed := time.Since(begin)
+	attrs := func() []any {
+		sql, rows := fc()
+		return []any{
+			"sql", sql,
+			"rows", rows,
+			"duration_ms", float64(elapsed.Microseconds()) / 1000,
+			"source", utils.FileWithLineNum(),
+		}
+	}
+
+	log := FromContext(ctx)
+	switch {
+	// Not finding a record is an expected outcome, not a failure
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.Level >= logger.Error:
+		log.ErrorContext(ctx, "SQL query failed", append(attrs(), "error", err)...)
+	case l.SlowThreshold > 0 && elapsed > l.SlowThreshold && l.Level >= logger.Warn:
+		log.WarnContext(ctx, "Slow SQL query", append(attrs(), "threshold_ms", l.SlowThreshold.Milliseconds())...)
+	case l.Level >= logger.Info && log.Enabled(ctx, slog.LevelDebug):
+		log.DebugContext(ctx, "SQL query", attrs()...)
+	}
+}
@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestGormLoggerLeavesOutValues(t *testing.T) {
+	var out bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: NewGormLogger(0)})
+	if err != nil {
+		t.Fatalf("Opening the database failed: %v", err)
+	}
+	type secret struct {
+		ID    uint
+		Token string
+	}
+	if err := db.AutoMigrate(&secret{}); err != nil {
+		t.Fatalf("Migrating failed: %v", err)
+	}
+	if err := db.Create(&secret{Token: "s3cr3t-token"}).Error; err != nil {
+		t.Fatalf("Inserting failed: %v", err)
+	}
+
+	if !strings.Contains(out.String(), "INSERT INTO") {
+		t.Fatalf("Expected the query to be logged, got %s", out.String())
+	}
+	if strings.Contains(out.String(), "s3cr3t-token") {
+		t.Errorf("Expected the value to be left out, got %s", out.String())
+	}
+}
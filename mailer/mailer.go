@@ -0,0 +1,161 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/health"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails. The SMTP implementation is used in production; the
+// file implementation stands in for it in development and tests.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var mailer Mailer
+
+// Init sets up the application-wide mailer: SMTP when SMTP_HOST is set,
+// otherwise a file mailer writing into MAIL_DIR. The file mailer only stands
+// in for SMTP in development, so it has to be asked for by setting MAIL_DIR;
+// the emails it writes hold verification and password reset links.
+func Init() error {
+	cfg := config.Get().Mail
+	if smtpMailer, ok := NewSMTPMailer(cfg); ok {
+		mailer = smtpMailer
+		return nil
+	}
+
+	if cfg.Dir == "" {
+		return errors.New("SMTP_HOST is not set; set MAIL_DIR to write emails to files instead")
+	}
+	slog.Warn("SMTP_HOST is not set, writing emails to files instead of sending them", "dir", cfg.Dir)
+	mailer = &FileMailer{Dir: cfg.Dir}
+	return nil
+}
+
+// SetMailer replaces the application-wide mailer, e.g. with a file mailer in
+// tests
+func SetMailer(m Mailer) {
+	mailer = m
+}
+
+// Default returns the application-wide mailer
+func Default() Mailer {
+	return mailer
+}
+
+// Send sends a message through the application-wide mailer
+func Send(msg Message) error {
+	if mailer == nil {
+		return fmt.Errorf("mailer is not initialized")
+	}
+	return mailer.Send(msg)
+}
+
+// CheckStorage makes sure the application-wide mailer can store emails. Only
+// the file mailer keeps anything on disk; other mailers always pass.
+func CheckStorage() error {
+	fm, ok := mailer.(*FileMailer)
+	if !ok {
+		return nil
+	}
+
+	return health.Writable(fm.Dir)
+}
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// NewSMTPMailer builds an SMTP mailer from the mail settings. It reports
+// false when no SMTP host is configured.
+func NewSMTPMailer(cfg config.MailConfig) (*SMTPMailer, bool) {
+	if cfg.SMTPHost == "" {
+		return nil, false
+	}
+
+	m := &SMTPMailer{
+		Addr: cfg.SMTPHost + ":" + strconv.Itoa(cfg.SMTPPort),
+		From: cfg.From,
+	}
+
+	// Local relays usually accept mail without authentication
+	if cfg.SMTPUsername != "" {
+		m.Auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+
+	return m, true
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	if err := smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To}, format(m.From, msg)); err != nil {
+		return fmt.Errorf("sending mail to %s: %w", msg.To, err)
+	}
+	return nil
+}
+
+// FileMailer writes every email as an .eml file into a directory instead of
+// sending it. Only the user running the server can read them.
+type FileMailer struct {
+	Dir string
+
+	mu    sync.Mutex
+	count int
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+		return err
+	}
+
+	m.count++
+	name := fmt.Sprintf("%d-%04d.eml", time.Now().UnixNano(), m.count)
+
+	return os.WriteFile(filepath.Join(m.Dir, name), format(config.Get().Mail.From, msg), 0o600)
+}
+
+// format renders a message with the headers needed by mail clients
+func format(from string, msg Message) []byte {
+	return []byte(strings.Join([]string{
+		"From: " + headerValue(from),
+		"To: " + headerValue(msg.To),
+		"Subject: " + headerValue(msg.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		msg.Body,
+	}, "\r\n"))
+}
+
+// headerValue keeps a value on its header line. Subjects are built from
+// titles admins and users typed in, so a line break in them must not start
+// a header of its own.
+func headerValue(value string) string {
+	return strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == '\r' || r == '\n'
+	}), " ")
+}
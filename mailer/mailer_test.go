@@ -0,0 +1,74 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+)
+
+func TestFormatKeepsHeadersOnOneLine(t *testing.T) {
+	raw := string(format("shop@example.com", Message{
+		To:      "reader@example.com",
+		Subject: "Price drop: Dune\r\nBcc: everyone@example.com",
+		Body:    "Dune is now 5.00.",
+	}))
+
+	headers, body, ok := strings.Cut(raw, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("Expected headers and body, got %q", raw)
+	}
+	if body != "Dune is now 5.00." {
+		t.Errorf("Expected the body unchanged, got %q", body)
+	}
+
+	for _, line := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Errorf("Expected the subject not to add a header, got %q", headers)
+		}
+	}
+	if !strings.Contains(headers, "Subject: Price drop: Dune Bcc: everyone@example.com\r\n") {
+		t.Errorf("Expected the subject on one line, got %q", headers)
+	}
+}
+
+func TestInitNeedsSMTPOrMailDir(t *testing.T) {
+	config.Set(config.Default())
+	t.Cleanup(func() { config.Set(config.Default()) })
+	previous := Default()
+	t.Cleanup(func() { SetMailer(previous) })
+
+	// Without SMTP the file mailer has to be asked for
+	if err := Init(); err == nil {
+		t.Error("Expected Init to fail without SMTP_HOST and MAIL_DIR")
+	}
+
+	config.Get().Mail.Dir = t.TempDir()
+	if err := Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if _, ok := Default().(*FileMailer); !ok {
+		t.Fatalf("Expected a file mailer, got %T", Default())
+	}
+}
+
+func TestFileMailerKeepsEmailsPrivate(t *testing.T) {
+	m := &FileMailer{Dir: filepath.Join(t.TempDir(), "mail")}
+	if err := m.Send(Message{To: "reader@example.com", Subject: "Reset your password", Body: "token"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	files, err := os.ReadDir(m.Dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one email, got %v (%v)", files, err)
+	}
+	info, err := files[0].Info()
+	if err != nil {
+		t.Fatalf("Reading the email failed: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("Expected mode 0600, got %o", mode)
+	}
+}
@@ -1,47 +1,144 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/joho/godotenv"
 
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
 	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/logging"
+	"github.com/mohammadshaad/golang-book-store-backend/mailer"
+	"github.com/mohammadshaad/golang-book-store-backend/metrics"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+	"github.com/mohammadshaad/golang-book-store-backend/notifications"
+	"github.com/mohammadshaad/golang-book-store-backend/oidc"
+	"github.com/mohammadshaad/golang-book-store-backend/privacy"
 	"github.com/mohammadshaad/golang-book-store-backend/routes"
+	"github.com/mohammadshaad/golang-book-store-backend/tracing"
 )
 
 func main() {
-	fmt.Println("Welcome to the book store")
+	slog.Info("Welcome to the book store")
 
-	// Load environment variables from the .env file
-	if err := godotenv.Load(); err != nil {
-		panic("Error loading .env file")
+	if err := run(); err != nil {
+		slog.Error("Book store failed", "error", err)
+		os.Exit(1)
 	}
 
-	// Define the database connection string using environment variables
-	database.InitDatabase()
+	slog.Info("Server stopped")
+}
+
+// run starts the application and blocks until it is shut down. Cleanup is
+// deferred here rather than in main, so it also runs when startup fails.
+func run() error {
+	// Load the configuration from the environment, .env and CONFIG_FILE
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+
+	// Log as JSON from here on
+	logging.Init(cfg.Log)
+
+	// Export traces, if configured, and flush them on the way out
+	stopTracing, err := tracing.Init(cfg.Tracing)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := stopTracing(ctx); err != nil {
+			slog.Error("Failed to flush traces", "error", err)
+		}
+	}()
 
-	// Open the database connection
-	db := database.GetDB()
+	// Load the keys tokens are signed with
+	if err := auth.InitKeys(); err != nil {
+		return fmt.Errorf("loading JWT signing keys: %w", err)
+	}
+
+	// Slow down and lock out repeated failed logins as configured
+	auth.InitThrottles()
+
+	// Connect to the database
+	db, err := database.InitDatabase()
+	if err != nil {
+		return err
+	}
 	defer database.CloseDB()
 
+	// Time queries and expose the connection pool on /metrics
+	if err := metrics.InstrumentDB(db, cfg.Database.Name); err != nil {
+		return fmt.Errorf("instrumenting the database: %w", err)
+	}
+	if err := tracing.InstrumentDB(db); err != nil {
+		return fmt.Errorf("instrumenting the database: %w", err)
+	}
+
 	// Auto-migrate the models to create the necessary tables
-	database.AutoMigrateModels(db)
+	if err := database.AutoMigrateModels(db); err != nil {
+		return fmt.Errorf("migrating the database: %w", err)
+	}
+
+	// Set up outgoing email (SMTP, or .eml files in MAIL_DIR for development)
+	if err := mailer.Init(); err != nil {
+		return fmt.Errorf("setting up email: %w", err)
+	}
+
+	// Enable sign in with the company identity provider, if configured
+	oidc.Init()
+
+	// Start delivering notifications in the background. They are only
+	// emailed through an SMTP server; without one they stay in the inbox
+	// instead of piling up in MAIL_DIR.
+	var notificationMailer mailer.Mailer
+	if smtpMailer, ok := mailer.Default().(*mailer.SMTPMailer); ok {
+		notificationMailer = smtpMailer
+	}
+	notifications.Init(notificationMailer)
+	defer notifications.Close()
+
+	// Erase accounts whose deletion grace period has passed
+	stopPurge := privacy.StartPurgeWorker(time.Hour)
+	defer stopPurge()
 
 	// Create a Fiber app
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		// Answer every error as an RFC 7807 problem
+		ErrorHandler: apierror.Handler,
+		// Behind a load balancer the client IP, which rate limits are keyed
+		// on, comes from a header that only the proxies may set
+		ProxyHeader:             cfg.Server.ProxyHeader,
+		EnableTrustedProxyCheck: len(cfg.Server.TrustedProxies) > 0,
+		TrustedProxies:          cfg.Server.TrustedProxies,
+	})
+
+	// Tag every request with an ID, trace it, log it, and count and time it
+	app.Use(middleware.RequestID())
+	app.Use(middleware.Tracing())
+	app.Use(middleware.Logger())
+	app.Use(middleware.Metrics())
 
 	// Enable CORS
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: "http://localhost:5173",                       // Update with the actual URL of your React app
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization", // Include "Authorization" here
+		AllowOrigins:  strings.Join(cfg.Server.CORSOrigins, ","),
+		AllowHeaders:  "Origin, Content-Type, Accept, Authorization, X-Request-ID, traceparent, tracestate",
+		ExposeHeaders: "RateLimit-Policy, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, X-Request-ID, Deprecation, Sunset, Link",
 	}))
 
 	// Define routes
 	routes.DefineRoutes(app)
 
-	// Start the Fiber app
-	port := 8080 // You can change this to your desired port
-	routes.StartApp(app, port)
+	// Serve until the process is asked to stop
+	return routes.StartApp(app, cfg.Server)
 }
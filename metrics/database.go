@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"gorm.io/gorm"
+)
+
+const queryStartKey = "metrics:query_start"
+
+// InstrumentDB times every query the connection runs and exposes the
+// connection pool statistics. Call it once, after connecting.
+func InstrumentDB(db *gorm.DB, name string) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	if err := Registry.Register(collectors.NewDBStatsCollector(sqlDB, name)); err != nil {
+		return err
+	}
+
+	return database.RegisterHooks(db, "metrics", startQuery, observeQuery)
+}
+
+func startQuery(string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		db.InstanceSet(queryStartKey, time.Now())
+	}
+}
+
+func observeQuery(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		value, ok := db.InstanceGet(queryStartKey)
+		if !ok {
+			return
+		}
+		start, ok := value.(time.Time)
+		if !ok {
+			return
+		}
+
+		table := db.Statement.Table
+		if table == "" {
+			table = "unknown"
+		}
+		DBQueryDuration.WithLabelValues(operation, table).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"crypto/subtle"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "bookstore"
+
+// Registry holds every metric the application exposes
+var Registry = prometheus.NewRegistry()
+
+// HTTP metrics, recorded by middleware.Metrics
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	HTTPRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "http_requests_in_flight",
+		Help:      "HTTP requests currently being served.",
+	})
+)
+
+// Database metrics, recorded by InstrumentDB
+var DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "db_query_duration_seconds",
+	Help:      "Database query latency by operation and table.",
+	Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+}, []string{"operation", "table"})
+
+// Business events
+var (
+	Registrations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registrations_total",
+		Help:      "Accounts registered.",
+	})
+
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Login attempts by method (password, 2fa, oidc) and result (success, failure).",
+	}, []string{"method", "result"})
+
+	CartAdds = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cart_adds_total",
+		Help:      "Books added to a cart, directly or from a wishlist.",
+	})
+
+	Downloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloads_total",
+		Help:      "Book downloads.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		HTTPRequestsInFlight,
+		DBQueryDuration,
+		Registrations,
+		Logins,
+		CartAdds,
+		Downloads,
+	)
+}
+
+// Login results
+const (
+	LoginSuccess = "success"
+	LoginFailure = "failure"
+)
+
+// RecordLogin counts a login attempt
+func RecordLogin(method string, success bool) {
+	result := LoginFailure
+	if success {
+		result = LoginSuccess
+	}
+	Logins.WithLabelValues(method, result).Inc()
+}
+
+// Handler serves the registry in the Prometheus text format to scrapers
+// sending the token as a bearer token. Without a token there is nothing to
+// serve, since the metrics tell a lot about the users and the deployment.
+func Handler(token string) fiber.Handler {
+	serve := adaptor.HTTPHandler(promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	want := []byte("Bearer " + token)
+
+	return func(c *fiber.Ctx) error {
+		if token == "" {
+			return apierror.NotFound("Metrics are disabled; set METRICS_TOKEN")
+		}
+		if subtle.ConstantTimeCompare(c.Request().Header.Peek(fiber.HeaderAuthorization), want) != 1 {
+			return apierror.Unauthorized("Invalid metrics token")
+		}
+		return serve(c)
+	}
+}
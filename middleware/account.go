@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+)
+
+// InactiveAccountError returns the error for an account that may not log in
+// or use its tokens, or nil if the account is active
+func InactiveAccountError(user database.User) *apierror.Error {
+	switch user.Status {
+	case database.AccountStatusActive:
+		return nil
+	case database.AccountStatusPendingVerification:
+		return apierror.New(fiber.StatusForbidden, apierror.CodeEmailNotVerified, "Email not verified")
+	case database.AccountStatusDeactivated:
+		return apierror.New(fiber.StatusForbidden, apierror.CodeAccountDeactivated, "Account deactivated")
+	case database.AccountStatusSuspended:
+		return apierror.New(fiber.StatusForbidden, apierror.CodeAccountSuspended, "Account suspended").
+			With("reason", user.SuspendedReason)
+	default:
+		return apierror.New(fiber.StatusForbidden, apierror.CodeAccountInactive, "Account inactive")
+	}
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+)
+
+func TestInactiveAccountError(t *testing.T) {
+	if err := InactiveAccountError(database.User{Status: database.AccountStatusActive}); err != nil {
+		t.Errorf("Expected active accounts to pass, got %v", err)
+	}
+
+	for _, tt := range []struct {
+		status database.AccountStatus
+		code   string
+	}{
+		{database.AccountStatusPendingVerification, apierror.CodeEmailNotVerified},
+		{database.AccountStatusDeactivated, apierror.CodeAccountDeactivated},
+		{database.AccountStatusSuspended, apierror.CodeAccountSuspended},
+		{"", apierror.CodeAccountInactive},
+	} {
+		err := InactiveAccountError(database.User{Status: tt.status, SuspendedReason: "Spam"})
+		if err == nil {
+			t.Errorf("Expected status %q to be rejected", tt.status)
+			continue
+		}
+		if err.Status != fiber.StatusForbidden || err.Code != tt.code {
+			t.Errorf("Expected status %q to answer 403 %s, got %d %s", tt.status, tt.code, err.Status, err.Code)
+		}
+	}
+
+	// Suspended users learn why
+	err := InactiveAccountError(database.User{Status: database.AccountStatusSuspended, SuspendedReason: "Spam"})
+	if err.Extensions["reason"] != "Spam" {
+		t.Errorf("Expected the suspension reason, got %v", err.Extensions)
+	}
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	HeaderDeprecation = "Deprecation"
+	HeaderSunset      = "Sunset"
+)
+
+// DeprecationConfig describes routes that are going away
+type DeprecationConfig struct {
+	// Since is when the routes were deprecated
+	Since time.Time
+	// Sunset is when they stop being served; no Sunset header is sent when
+	// it is zero
+	Sunset time.Time
+	// Successor returns the path replacing a deprecated one, linked from the
+	// response when set
+	Successor func(path string) string
+}
+
+// Deprecated marks the responses of the routes registered after it in its
+// group as deprecated (RFC 9745), announces their sunset (RFC 8594) and links
+// their successor. Requests that match no route are left alone.
+func Deprecated(config DeprecationConfig) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		own := c.Route()
+
+		err := c.Next()
+
+		// The headers are set last, so they are sent even when the handler
+		// failed; they only belong on requests that reached a deprecated route
+		if c.Route() == own {
+			return err
+		}
+
+		c.Set(HeaderDeprecation, fmt.Sprintf("@%d", config.Since.Unix()))
+		if !config.Sunset.IsZero() {
+			c.Set(HeaderSunset, config.Sunset.UTC().Format(http.TimeFormat))
+		}
+		if config.Successor != nil {
+			c.Set(fiber.HeaderLink, fmt.Sprintf(`<%s>; rel="successor-version"`, config.Successor(c.Path())))
+		}
+
+		return err
+	}
+}
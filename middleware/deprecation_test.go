@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestDeprecated(t *testing.T) {
+	app := fiber.New()
+	app.Get("/api/v1/books", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+	legacy := app.Group("", Deprecated(DeprecationConfig{
+		Since:     time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC),
+		Sunset:    time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC),
+		Successor: func(path string) string { return "/api/v1" + path },
+	}))
+	legacy.Get("/books", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/books", nil))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if got := resp.Header.Get(HeaderDeprecation); got != "@1792281600" {
+		t.Errorf("Unexpected Deprecation header %q", got)
+	}
+	if got := resp.Header.Get(HeaderSunset); got != "Fri, 30 Apr 2027 00:00:00 GMT" {
+		t.Errorf("Unexpected Sunset header %q", got)
+	}
+	if got := resp.Header.Get(fiber.HeaderLink); got != `</api/v1/books>; rel="successor-version"` {
+		t.Errorf("Unexpected Link header %q", got)
+	}
+
+	// Neither the current version nor unknown paths are deprecated
+	for _, path := range []string{"/api/v1/books", "/missing"} {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", path, err)
+		}
+		if got := resp.Header.Get(HeaderDeprecation); got != "" {
+			t.Errorf("Expected %s not to be deprecated, got %q", path, got)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/logging"
+)
+
+// Logger writes one structured log line per request. It should run after
+// RequestID so the line carries the request's ID.
+func Logger() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		err := c.Next()
+		status := responseStatus(c, err)
+
+		attrs := []any{
+			"method", c.Method(),
+			"path", c.Path(),
+			"route", c.Route().Path,
+			"status", status,
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"ip", c.IP(),
+		}
+		if userID, ok := CurrentUserID(c); ok {
+			attrs = append(attrs, "user_id", userID)
+		}
+		if err != nil {
+			attrs = append(attrs, "error", err.Error())
+		}
+
+		level := slog.LevelInfo
+		if status >= fiber.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		ctx := c.UserContext()
+		logging.FromContext(ctx).Log(ctx, level, "Request", attrs...)
+
+		return err
+	}
+}
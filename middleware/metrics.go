@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/metrics"
+)
+
+// Metrics records the count and latency of every request. Requests are
+// labelled with the route pattern rather than the path, so IDs in the URL do
+// not create a series each. It should be registered before the routes.
+func Metrics() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		own := c.Route()
+
+		metrics.HTTPRequestsInFlight.Inc()
+		defer metrics.HTTPRequestsInFlight.Dec()
+
+		err := c.Next()
+		status := responseStatus(c, err)
+
+		// No route matched when the request never left this middleware
+		route := c.Route().Path
+		if c.Route() == own {
+			route = "unmatched"
+		}
+
+		// The method points into the request buffer, which is reused once
+		// the request is done, while the metrics keep their labels
+		method := utils.CopyString(c.Method())
+		metrics.HTTPRequests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// responseStatus returns the status code the request is answered with. When a
+// handler returned an error, the error handler has not run yet, so the status
+// is the one it will send.
+func responseStatus(c *fiber.Ctx, err error) int {
+	if err == nil {
+		return c.Response().StatusCode()
+	}
+	return apierror.Status(err)
+}
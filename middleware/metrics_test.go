@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsLabelsRoutePattern(t *testing.T) {
+	app := fiber.New()
+	app.Use(Metrics())
+	app.Get("/book/:id", func(c *fiber.Ctx) error {
+		return c.SendString(c.Params("id"))
+	})
+
+	for _, path := range []string{"/book/1", "/book/2", "/missing"} {
+		if _, err := app.Test(httptest.NewRequest("GET", path, nil)); err != nil {
+			t.Fatalf("Request to %s failed: %v", path, err)
+		}
+	}
+
+	// Both books share the route's series, so IDs do not create new ones
+	if got := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("/book/:id", "GET", "200")); got != 2 {
+		t.Errorf("Expected 2 requests to /book/:id, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("unmatched", "GET", "404")); got != 1 {
+		t.Errorf("Expected 1 unmatched request, got %v", got)
+	}
+}
@@ -1,41 +1,298 @@
 package middleware
 
 import (
+	"context"
+	"strconv"
+	"strings"
+
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v4"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
 	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/sessions"
 )
 
-// checkJWTValidity middleware checks if the JWT is valid
+// claimsKey is where Authenticate stores the parsed token claims
+const claimsKey = "claims"
+
+// AuthConfig selects which credentials Authenticate accepts besides a bearer
+// token in the Authorization header
+type AuthConfig struct {
+	// AllowQueryToken also accepts the token as the access_token query
+	// parameter, for clients such as EventSource that cannot set headers
+	AllowQueryToken bool
+
+	// AllowAPIKeys also accepts an API key in the X-API-Key header
+	AllowAPIKeys bool
+}
+
+// Authenticate parses and verifies the request's credentials once per
+// request and stores their claims for the handlers
+func Authenticate(config AuthConfig) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if key := c.Get("X-API-Key"); key != "" && config.AllowAPIKeys {
+			claims, err := apiKeyClaims(c.UserContext(), key)
+			if err != nil {
+				return apierror.Unauthorized("Invalid or expired API key")
+			}
+
+			c.Locals(claimsKey, claims)
+			return c.Next()
+		}
+
+		raw := ""
+		if header := c.Get(fiber.HeaderAuthorization); len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+			raw = strings.TrimSpace(header[7:])
+		} else if config.AllowQueryToken {
+			raw = c.Query("access_token")
+		}
+
+		if raw == "" {
+			return apierror.Unauthorized("Missing or malformed JWT")
+		}
+
+		claims, err := auth.ParseToken(raw)
+		if err != nil {
+			return apierror.Unauthorized("Invalid or expired JWT")
+		}
+
+		c.Locals(claimsKey, claims)
+		return c.Next()
+	}
+}
+
+// Claims returns the claims of the request's token, if Authenticate accepted
+// one
+func Claims(c *fiber.Ctx) (*auth.Claims, bool) {
+	claims, ok := c.Locals(claimsKey).(*auth.Claims)
+	return claims, ok && claims != nil
+}
+
+// CurrentUserID returns the ID of the user the request's token was issued to
+func CurrentUserID(c *fiber.Ctx) (uint, bool) {
+	claims, ok := Claims(c)
+	if !ok {
+		return 0, false
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		return 0, false
+	}
+	return userID, true
+}
+
+// Unauthorized is the error for a request that has no usable token
+func Unauthorized() error {
+	return apierror.Unauthorized("Login first")
+}
+
+// checkJWTValidity middleware checks if the JWT grants API access and its
+// account is still active
 func CheckJWTValidity(c *fiber.Ctx) error {
-	token := c.Locals("user").(*jwt.Token)
-	if token == nil || !token.Valid {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Login first",
-		})
+	return checkJWT(c, false)
+}
+
+// CheckJWTValidityForReactivation is CheckJWTValidity for the route that
+// activates a deactivated account again, which also lets deactivated
+// accounts through
+func CheckJWTValidityForReactivation(c *fiber.Ctx) error {
+	return checkJWT(c, true)
+}
+
+func checkJWT(c *fiber.Ctx, allowDeactivated bool) error {
+	claims, ok := Claims(c)
+	if !ok {
+		return Unauthorized()
+	}
+	if err := validityError(c.UserContext(), claims, allowDeactivated); err != nil {
+		return err
 	}
 	return c.Next()
 }
 
-// checkAdminRole middleware checks if the user has the "admin" role
+// TokenValidityError returns why the claims no longer grant API access, or
+// nil, for requests that outlive the check of CheckJWTValidity
+func TokenValidityError(ctx context.Context, claims *auth.Claims) error {
+	return validityError(ctx, claims, false)
+}
+
+func validityError(ctx context.Context, claims *auth.Claims, allowDeactivated bool) error {
+	// API keys do not belong to a user; Authenticate checked the key and
+	// that its creator is still an active admin
+	if claims.HasScope(auth.ScopeAPIKey) {
+		return nil
+	}
+
+	if !claims.HasScope(auth.ScopeAPI) {
+		return Unauthorized()
+	}
+
+	// Tokens stay valid until they expire, so check that their session has
+	// not ended and the account has not been deactivated or suspended
+	// since the token was issued
+	userID, _ := claims.UserID()
+	active, err := sessions.Active(ctx, claims.SessionID, userID)
+	if err != nil {
+		return apierror.Internal("Cannot check session")
+	}
+	if !active {
+		return apierror.Unauthorized("Session ended, log in again")
+	}
+	user, err := lookupUser(ctx, userID)
+	if err != nil {
+		return Unauthorized()
+	}
+	if err := InactiveAccountError(user); err != nil {
+		if !allowDeactivated || user.Status != database.AccountStatusDeactivated {
+			return err
+		}
+	}
+
+	// The role in the token is a snapshot; once it changes the token has to
+	// be refreshed to pick up the new role and permissions
+	if string(user.Role) != claims.Role {
+		return apierror.New(fiber.StatusUnauthorized, apierror.CodeRoleChanged, "Role changed, refresh your token")
+	}
+
+	return nil
+}
+
+// checkAdminRole middleware checks if the user has the "admin" role. It runs
+// after CheckJWTValidity, which already made sure the role in the token is
+// current.
 func CheckAdminRole(c *fiber.Ctx) error {
-	// Get the user ID from the JWT payload
-	userID := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)["user_id"].(float64)
+	claims, ok := Claims(c)
+	if !ok {
+		return Unauthorized()
+	}
+	if err := adminRoleError(claims); err != nil {
+		return err
+	}
+	return c.Next()
+}
 
-	// Find the user in the database
-	var user database.User
-	if err := database.GetDB().First(&user, uint(userID)).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+// adminRoleError returns why the claims do not grant admin access, or nil
+func adminRoleError(claims *auth.Claims) error {
+	// API keys only get through Authenticate while their creator is an
+	// active admin; what they may do is limited by the permissions each
+	// route requires
+	if claims.HasScope(auth.ScopeAPIKey) {
+		return nil
 	}
 
 	// Check if the user is an admin
-	if user.Role != database.UserRoleAdmin {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Unauthorized",
-		})
+	if claims.Role != string(database.UserRoleAdmin) {
+		return apierror.New(fiber.StatusForbidden, apierror.CodePermissionDenied, "Admin access required")
 	}
 
-	return c.Next()
+	// When the policy requires it, admins must have logged in with a second
+	// factor
+	if auth.AdminTwoFactorRequired() && !claims.MFA {
+		return apierror.New(fiber.StatusForbidden, apierror.CodeTwoFactorRequired, "Two-factor authentication is required for admin accounts")
+	}
+
+	return nil
+}
+
+// RequirePermission only lets requests through whose token carries the
+// permission
+func RequirePermission(permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, ok := Claims(c)
+		if !ok {
+			return Unauthorized()
+		}
+		if !claims.HasPermission(permission) {
+			return apierror.New(fiber.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+		}
+		return c.Next()
+	}
+}
+
+// AdminAccessError returns why the request may not act as an admin holding
+// the permission, or nil if it may. It combines CheckAdminRole and
+// RequirePermission for handlers that let admins do more than users.
+func AdminAccessError(c *fiber.Ctx, permission string) error {
+	claims, ok := Claims(c)
+	if !ok {
+		return Unauthorized()
+	}
+	return AdminPermissionError(claims, permission)
+}
+
+// AdminPermissionError is AdminAccessError for code that holds the claims
+// rather than the request, such as GraphQL resolvers
+func AdminPermissionError(claims *auth.Claims, permission string) error {
+	if err := adminRoleError(claims); err != nil {
+		return err
+	}
+	if !claims.HasPermission(permission) {
+		return apierror.New(fiber.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+	}
+	return nil
+}
+
+// RequireKeyPermission lets users through but API keys only if they carry
+// the permission, for routes every user may use
+func RequireKeyPermission(permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, ok := Claims(c)
+		if !ok {
+			return Unauthorized()
+		}
+		if err := KeyPermissionError(claims, permission); err != nil {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+// KeyPermissionError is RequireKeyPermission for code that holds the claims
+// rather than the request, such as GraphQL resolvers
+func KeyPermissionError(claims *auth.Claims, permission string) error {
+	if claims.HasScope(auth.ScopeAPIKey) && !claims.HasPermission(permission) {
+		return apierror.New(fiber.StatusForbidden, apierror.CodePermissionDenied, "Permission denied")
+	}
+	return nil
+}
+
+// RequireAdmin only lets admins holding the permission through, for routes
+// outside the /admin group
+func RequireAdmin(permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := AdminAccessError(c, permission); err != nil {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+// RequireSelfOrAdmin lets users through to their own resources, identified by
+// the user ID in the param, and admins holding the permission to anyone's
+func RequireSelfOrAdmin(param, permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if id, ok := UserIDParam(c, param); ok {
+			if userID, ok := CurrentUserID(c); ok && userID == id {
+				return c.Next()
+			}
+		}
+		if err := AdminAccessError(c, permission); err != nil {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+// UserIDParam returns the user ID in the param, where "me" stands for the
+// logged in user
+func UserIDParam(c *fiber.Ctx, param string) (uint, bool) {
+	value := c.Params(param)
+	if value == "me" {
+		return CurrentUserID(c)
+	}
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+	return uint(id), true
 }
@@ -0,0 +1,316 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/database/databasetest"
+	"github.com/mohammadshaad/golang-book-store-backend/sessions"
+)
+
+// useTestKeys signs tokens with a fresh key for the test and returns a
+// token for the claims
+func useTestKeys(t *testing.T) func(claims *auth.Claims) string {
+	t.Helper()
+
+	key, err := auth.GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("Generating a signing key failed: %v", err)
+	}
+	keys := auth.NewKeySet(key)
+	previous := auth.Keys()
+	auth.SetKeys(keys)
+	t.Cleanup(func() { auth.SetKeys(previous) })
+
+	return func(claims *auth.Claims) string {
+		token, err := keys.Sign(claims)
+		if err != nil {
+			t.Fatalf("Signing a token failed: %v", err)
+		}
+		return token
+	}
+}
+
+// send requests the path with the headers and returns the status and the
+// error code, if any
+func send(t *testing.T, app *fiber.App, path string, headers map[string]string) (int, string) {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", path, nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Request to %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body.Code
+}
+
+func TestAuthenticate(t *testing.T) {
+	config.Set(config.Default())
+	sign := useTestKeys(t)
+
+	claims, err := auth.NewClaims(7, "user", time.Minute, auth.ScopeAPI)
+	if err != nil {
+		t.Fatalf("Creating claims failed: %v", err)
+	}
+	token := sign(claims)
+
+	expired, _ := auth.NewClaims(7, "user", -time.Minute, auth.ScopeAPI)
+	noSubject, _ := auth.NewClaims(7, "user", time.Minute, auth.ScopeAPI)
+	noSubject.Subject = "reader"
+
+	otherKey, err := auth.GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("Generating a signing key failed: %v", err)
+	}
+	foreign, err := auth.NewKeySet(otherKey).Sign(claims)
+	if err != nil {
+		t.Fatalf("Signing a token failed: %v", err)
+	}
+
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+	handler := func(c *fiber.Ctx) error {
+		userID, ok := CurrentUserID(c)
+		if !ok {
+			return Unauthorized()
+		}
+		return c.JSON(userID)
+	}
+	app.Get("/header", Authenticate(AuthConfig{}), handler)
+	app.Get("/query", Authenticate(AuthConfig{AllowQueryToken: true}), handler)
+
+	for _, tt := range []struct {
+		name, path, authorization string
+		want                      int
+	}{
+		{"valid token", "/header", "Bearer " + token, fiber.StatusOK},
+		{"lowercase scheme", "/header", "bearer " + token, fiber.StatusOK},
+		{"missing token", "/header", "", fiber.StatusUnauthorized},
+		{"empty bearer", "/header", "Bearer ", fiber.StatusUnauthorized},
+		{"other scheme", "/header", "Basic " + token, fiber.StatusUnauthorized},
+		{"garbage", "/header", "Bearer not-a-jwt", fiber.StatusUnauthorized},
+		{"expired", "/header", "Bearer " + sign(expired), fiber.StatusUnauthorized},
+		{"no user subject", "/header", "Bearer " + sign(noSubject), fiber.StatusUnauthorized},
+		{"unknown key", "/header", "Bearer " + foreign, fiber.StatusUnauthorized},
+		{"query token not allowed", "/header?access_token=" + token, "", fiber.StatusUnauthorized},
+		{"query token allowed", "/query?access_token=" + token, "", fiber.StatusOK},
+	} {
+		headers := map[string]string{}
+		if tt.authorization != "" {
+			headers[fiber.HeaderAuthorization] = tt.authorization
+		}
+		status, code := send(t, app, tt.path, headers)
+		if status != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, status)
+		}
+		if status == fiber.StatusUnauthorized && code != apierror.CodeUnauthorized {
+			t.Errorf("%s: expected code %q, got %q", tt.name, apierror.CodeUnauthorized, code)
+		}
+	}
+}
+
+func TestClaimsAndCurrentUserID(t *testing.T) {
+	claims := &auth.Claims{Role: "user"}
+	claims.Subject = "7"
+	malformed := &auth.Claims{Role: "user"}
+	malformed.Subject = "reader"
+
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		switch c.Get("X-Token") {
+		case "valid":
+			c.Locals(claimsKey, claims)
+		case "malformed":
+			c.Locals(claimsKey, malformed)
+		case "nil":
+			c.Locals(claimsKey, (*auth.Claims)(nil))
+		case "wrong type":
+			c.Locals(claimsKey, "7")
+		}
+
+		_, hasClaims := Claims(c)
+		userID, hasUser := CurrentUserID(c)
+		return c.JSON(fiber.Map{"claims": hasClaims, "user": hasUser, "id": userID})
+	})
+
+	for _, tt := range []struct {
+		token              string
+		hasClaims, hasUser bool
+		id                 uint
+	}{
+		{"valid", true, true, 7},
+		{"malformed", true, false, 0},
+		{"nil", false, false, 0},
+		{"wrong type", false, false, 0},
+		{"", false, false, 0},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Token", tt.token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		var got struct {
+			Claims bool `json:"claims"`
+			User   bool `json:"user"`
+			ID     uint `json:"id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("Decoding the response failed: %v", err)
+		}
+		if got.Claims != tt.hasClaims || got.User != tt.hasUser || got.ID != tt.id {
+			t.Errorf("%q: expected claims=%v user=%v id=%d, got %+v", tt.token, tt.hasClaims, tt.hasUser, tt.id, got)
+		}
+	}
+}
+
+func TestCheckJWTValidityChecksSession(t *testing.T) {
+	config.Set(config.Default())
+	sign := useTestKeys(t)
+	db := databasetest.Open(t)
+
+	user := database.User{Email: "reader@example.com", Role: database.UserRoleStandard, Status: database.AccountStatusActive}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("Creating the user failed: %v", err)
+	}
+	InvalidateUser(user.ID)
+
+	claims, err := auth.NewClaims(user.ID, string(user.Role), time.Minute, auth.ScopeAPI)
+	if err != nil {
+		t.Fatalf("Creating claims failed: %v", err)
+	}
+	if err := sessions.Create(context.Background(), claims.SessionID, user.ID, "refresh", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Creating the session failed: %v", err)
+	}
+	token := sign(claims)
+
+	unknown := *claims
+	unknown.SessionID = "unknown"
+	noSession := *claims
+	noSession.SessionID = ""
+
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+	app.Get("/", Authenticate(AuthConfig{}), CheckJWTValidity, func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	bearer := func(token string) map[string]string {
+		return map[string]string{fiber.HeaderAuthorization: "Bearer " + token}
+	}
+
+	if status, _ := send(t, app, "/", bearer(token)); status != fiber.StatusOK {
+		t.Fatalf("Expected a token with an active session to pass, got %d", status)
+	}
+	for name, claims := range map[string]*auth.Claims{"unknown session": &unknown, "no session": &noSession} {
+		if status, _ := send(t, app, "/", bearer(sign(claims))); status != fiber.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, status)
+		}
+	}
+
+	if err := sessions.Revoke(context.Background(), claims.SessionID); err != nil {
+		t.Fatalf("Revoking the session failed: %v", err)
+	}
+	if status, _ := send(t, app, "/", bearer(token)); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected a token of a revoked session to be refused with 401, got %d", status)
+	}
+}
+
+func TestRequireSelfOrAdmin(t *testing.T) {
+	config.Set(config.Default())
+
+	tokens := map[string]*auth.Claims{
+		"user":         {Role: "user"},
+		"admin":        {Role: "admin", Permissions: []string{auth.PermissionManageUsers}},
+		"limitedAdmin": {Role: "admin", Permissions: []string{auth.PermissionManageBooks}},
+	}
+	tokens["user"].Subject = "7"
+	tokens["admin"].Subject = "1"
+	tokens["limitedAdmin"].Subject = "2"
+
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(claimsKey, tokens[c.Get("X-Token")])
+		return c.Next()
+	})
+	app.Get("/users/:id", RequireSelfOrAdmin("id", auth.PermissionManageUsers), func(c *fiber.Ctx) error {
+		id, _ := UserIDParam(c, "id")
+		return c.JSON(id)
+	})
+
+	for _, tt := range []struct {
+		token, path string
+		want        int
+	}{
+		{"user", "/users/7", fiber.StatusOK},
+		{"user", "/users/me", fiber.StatusOK},
+		{"user", "/users/8", fiber.StatusForbidden},
+		{"admin", "/users/8", fiber.StatusOK},
+		{"limitedAdmin", "/users/8", fiber.StatusForbidden},
+		{"limitedAdmin", "/users/me", fiber.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("X-Token", tt.token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", tt.path, err)
+		}
+		if resp.StatusCode != tt.want {
+			t.Errorf("Expected %s to answer %d for %s, got %d", tt.path, tt.want, tt.token, resp.StatusCode)
+		}
+	}
+}
+
+func TestCheckJWTValidityRejectsOldRole(t *testing.T) {
+	config.Set(config.Default())
+	sign := useTestKeys(t)
+	db := databasetest.Open(t)
+
+	user := database.User{Email: "admin@example.com", Role: database.UserRoleAdmin, Status: database.AccountStatusActive}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("Creating the user failed: %v", err)
+	}
+	InvalidateUser(user.ID)
+
+	claims, err := auth.NewClaims(user.ID, string(user.Role), time.Minute, auth.ScopeAPI)
+	if err != nil {
+		t.Fatalf("Creating claims failed: %v", err)
+	}
+	if err := sessions.Create(context.Background(), claims.SessionID, user.ID, "refresh", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Creating the session failed: %v", err)
+	}
+	headers := map[string]string{fiber.HeaderAuthorization: "Bearer " + sign(claims)}
+
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+	app.Get("/", Authenticate(AuthConfig{}), CheckJWTValidity, func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	if status, _ := send(t, app, "/", headers); status != fiber.StatusOK {
+		t.Fatalf("Expected a token with the current role to pass, got %d", status)
+	}
+
+	if err := db.Model(&user).Update("role", database.UserRoleStandard).Error; err != nil {
+		t.Fatalf("Updating the role failed: %v", err)
+	}
+	InvalidateUser(user.ID)
+
+	status, code := send(t, app, "/", headers)
+	if status != fiber.StatusUnauthorized || code != apierror.CodeRoleChanged {
+		t.Errorf("Expected a token with the old role to be refused with 401 %s, got %d %s", apierror.CodeRoleChanged, status, code)
+	}
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/logging"
+	"github.com/mohammadshaad/golang-book-store-backend/ratelimit"
+)
+
+// RateLimitConfig configures a RateLimit middleware
+type RateLimitConfig struct {
+	Policy ratelimit.Policy
+	// Store defaults to the application-wide store
+	Store ratelimit.Store
+}
+
+// RateLimit limits how often a client may call the routes behind it. Clients
+// are told apart by user, then API key, then IP address, so it should run
+// after Authenticate on protected routes.
+func RateLimit(config RateLimitConfig) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		store := config.Store
+		if store == nil {
+			store = ratelimit.Default()
+		}
+
+		result, err := store.Take(c.UserContext(), config.Policy.Name+":"+rateLimitKey(c), config.Policy)
+		if err != nil {
+			// Rather serve the request than fail when the store is down
+			logging.FromContext(c.UserContext()).Error("Rate limit store failed", "error", err)
+			return c.Next()
+		}
+
+		c.Set("RateLimit-Policy", config.Policy.String())
+		c.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+		if !result.Allowed {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			return apierror.New(fiber.StatusTooManyRequests, apierror.CodeRateLimited, "Too many requests, please try again later")
+		}
+
+		return c.Next()
+	}
+}
+
+// rateLimitKey identifies the client making the request
+func rateLimitKey(c *fiber.Ctx) string {
+	if claims, ok := Claims(c); ok {
+		if claims.HasScope(auth.ScopeAPIKey) {
+			return "key:" + claims.ID
+		}
+		if userID, err := claims.UserID(); err == nil {
+			return "user:" + strconv.FormatUint(uint64(userID), 10)
+		}
+	}
+	return "ip:" + c.IP()
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/logging"
+)
+
+// requestIDKey is where RequestID stores the request's ID
+const requestIDKey = "request_id"
+
+// HeaderRequestID carries the request ID in requests and responses
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestIDLength bounds client-supplied IDs so they cannot bloat the logs
+const maxRequestIDLength = 128
+
+// RequestID gives every request an ID, reusing the X-Request-ID header sent by
+// a proxy or client when it is sensible. The ID is echoed in the response and
+// carried by the request's user context, so logs written with
+// logging.FromContext(c.UserContext()) can be traced back to the request.
+func RequestID() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		requestID := c.Get(HeaderRequestID)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+
+		c.Locals(requestIDKey, requestID)
+		c.SetUserContext(logging.WithRequestID(c.UserContext(), requestID))
+		c.Set(HeaderRequestID, requestID)
+
+		return c.Next()
+	}
+}
+
+// GetRequestID returns the ID RequestID gave the request
+func GetRequestID(c *fiber.Ctx) string {
+	requestID, _ := c.Locals(requestIDKey).(string)
+	return requestID
+}
+
+// validRequestID accepts short IDs of printable ASCII without spaces
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] <= ' ' || requestID[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
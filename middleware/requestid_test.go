@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/logging"
+)
+
+func TestRequestID(t *testing.T) {
+	app := fiber.New()
+	app.Use(RequestID())
+	app.Get("/", func(c *fiber.Ctx) error {
+		// Handlers see the same ID in the locals and the user context
+		if logging.RequestID(c.UserContext()) != GetRequestID(c) {
+			t.Error("Expected the user context to carry the request ID")
+		}
+		return c.SendString(GetRequestID(c))
+	})
+
+	get := func(requestID string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		if requestID != "" {
+			req.Header.Set(HeaderRequestID, requestID)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp.Header.Get(HeaderRequestID)
+	}
+
+	// An ID from a proxy is kept...
+	if got := get("edge-1234"); got != "edge-1234" {
+		t.Errorf("Expected the incoming ID to be kept, got %q", got)
+	}
+
+	// ...and a missing or unusable one is replaced with a fresh ID
+	for _, requestID := range []string{"", "has spaces", string(make([]byte, maxRequestIDLength+1))} {
+		got := get(requestID)
+		if got == "" || got == requestID {
+			t.Errorf("Expected a generated ID for %q, got %q", requestID, got)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+)
+
+// userCacheTTL is how long an account's status and role are trusted without
+// looking at the database again. Handlers that change either invalidate the
+// entry right away, so this only bounds changes made elsewhere.
+const userCacheTTL = time.Minute
+
+// maxCachedUsers bounds the memory the cache can take
+const maxCachedUsers = 10000
+
+type cachedUser struct {
+	user    database.User
+	expires time.Time
+}
+
+// userCache keeps the accounts seen by the auth middleware in memory, so
+// authenticated requests do not each need a query on the users table
+type userCache struct {
+	mu      sync.Mutex
+	entries map[uint]cachedUser
+	// version changes on every invalidation, so a load that raced with one
+	// is not stored
+	version uint64
+}
+
+var users = &userCache{entries: map[uint]cachedUser{}}
+
+// lookupUser returns the account from the cache, loading it from the
+// database when missing or stale
+func lookupUser(ctx context.Context, userID uint) (database.User, error) {
+	now := time.Now()
+
+	users.mu.Lock()
+	entry, ok := users.entries[userID]
+	version := users.version
+	users.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.user, nil
+	}
+
+	var user database.User
+	if err := database.WithContext(ctx).First(&user, userID).Error; err != nil {
+		return database.User{}, err
+	}
+
+	users.mu.Lock()
+	if users.version == version {
+		if len(users.entries) >= maxCachedUsers {
+			users.prune(now)
+		}
+		users.entries[userID] = cachedUser{user: user, expires: now.Add(userCacheTTL)}
+	}
+	users.mu.Unlock()
+
+	return user, nil
+}
+
+// prune drops the stale entries, or everything if all are still fresh. The
+// caller holds the lock.
+func (c *userCache) prune(now time.Time) {
+	for id, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, id)
+		}
+	}
+	if len(c.entries) >= maxCachedUsers {
+		c.entries = map[uint]cachedUser{}
+	}
+}
+
+// InvalidateUser drops the cached account, so the next request sees its
+// current status and role. Call it after changing either.
+func InvalidateUser(userID uint) {
+	users.mu.Lock()
+	delete(users.entries, userID)
+	users.version++
+	users.mu.Unlock()
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/database/databasetest"
+)
+
+func TestLookupUserCache(t *testing.T) {
+	db := databasetest.Open(t)
+
+	user := database.User{Email: "reader@example.com", Role: database.UserRoleStandard, Status: database.AccountStatusActive}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("Creating the user failed: %v", err)
+	}
+	InvalidateUser(user.ID)
+
+	if cached, err := lookupUser(context.Background(), user.ID); err != nil || cached.Role != database.UserRoleStandard {
+		t.Fatalf("lookupUser = %v, %v", cached.Role, err)
+	}
+
+	// Changes made behind the cache's back are not seen...
+	if err := db.Model(&user).Update("role", database.UserRoleAdmin).Error; err != nil {
+		t.Fatalf("Updating the role failed: %v", err)
+	}
+	if cached, _ := lookupUser(context.Background(), user.ID); cached.Role != database.UserRoleStandard {
+		t.Errorf("Expected the cached role, got %q", cached.Role)
+	}
+
+	// ...until the entry is invalidated
+	InvalidateUser(user.ID)
+	if cached, _ := lookupUser(context.Background(), user.ID); cached.Role != database.UserRoleAdmin {
+		t.Errorf("Expected the new role after invalidating, got %q", cached.Role)
+	}
+}
+
+func TestUserCacheIsBounded(t *testing.T) {
+	cache := &userCache{entries: map[uint]cachedUser{}}
+	now := time.Now()
+
+	for id := uint(1); id <= maxCachedUsers; id++ {
+		expires := now.Add(time.Minute)
+		if id%2 == 0 {
+			expires = now.Add(-time.Second)
+		}
+		cache.entries[id] = cachedUser{expires: expires}
+	}
+
+	cache.prune(now)
+	if len(cache.entries) != maxCachedUsers/2 {
+		t.Errorf("Expected the stale half to be dropped, %d entries left", len(cache.entries))
+	}
+
+	for id := uint(maxCachedUsers + 1); len(cache.entries) < maxCachedUsers; id++ {
+		cache.entries[id] = cachedUser{expires: now.Add(time.Minute)}
+	}
+	cache.prune(now)
+	if len(cache.entries) != 0 {
+		t.Errorf("Expected a cache full of fresh entries to be emptied, %d entries left", len(cache.entries))
+	}
+}
@@ -0,0 +1,84 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+)
+
+// BookUpdated compares a book before and after an update and notifies every
+// user who has it in their cart or on a wishlist when its price dropped or it
+// came back in stock
+func BookUpdated(ctx context.Context, before, after database.Book) error {
+	var pending []database.Notification
+
+	if after.Price < before.Price {
+		pending = append(pending, database.Notification{
+			Type:    database.NotificationPriceDrop,
+			Title:   fmt.Sprintf("Price drop: %s", after.Title),
+			Message: fmt.Sprintf("%s is now %.2f (was %.2f).", after.Title, after.Price, before.Price),
+			BookID:  after.ID,
+		})
+	}
+
+	if before.Quantity <= 0 && after.Quantity > 0 {
+		pending = append(pending, database.Notification{
+			Type:    database.NotificationBackInStock,
+			Title:   fmt.Sprintf("Back in stock: %s", after.Title),
+			Message: fmt.Sprintf("%s is available again.", after.Title),
+			BookID:  after.ID,
+		})
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	userIDs, err := interestedUsers(ctx, after.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		for _, n := range pending {
+			n.UserID = userID
+			Enqueue(n)
+		}
+	}
+
+	return nil
+}
+
+// interestedUsers returns the IDs of the users that have the book in their
+// cart or on one of their wishlists
+func interestedUsers(ctx context.Context, bookID uint) ([]uint, error) {
+	db := database.WithContext(ctx)
+
+	var cartUsers []uint
+	if err := db.Model(&database.CartItem{}).
+		Where("book_id = ?", bookID).
+		Distinct().Pluck("user_id", &cartUsers).Error; err != nil {
+		return nil, err
+	}
+
+	var wishlistUsers []uint
+	if err := db.Model(&database.Wishlist{}).
+		Joins("JOIN wishlist_items ON wishlist_items.wishlist_id = wishlists.id AND wishlist_items.deleted_at IS NULL").
+		Where("wishlist_items.book_id = ?", bookID).
+		Distinct().Pluck("wishlists.user_id", &wishlistUsers).Error; err != nil {
+		return nil, err
+	}
+
+	// Notify every user once, even if the book is in both places
+	seen := make(map[uint]bool)
+	var userIDs []uint
+	for _, id := range append(cartUsers, wishlistUsers...) {
+		if !seen[id] {
+			seen[id] = true
+			userIDs = append(userIDs, id)
+		}
+	}
+
+	return userIDs, nil
+}
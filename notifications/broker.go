@@ -0,0 +1,97 @@
+package notifications
+
+import (
+	"sync"
+
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+)
+
+// Broker fans out freshly stored notifications to the live streams opened
+// by their users
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[uint]map[chan database.Notification]struct{}
+	closed      bool
+}
+
+// subscriberBuffer is how many notifications a slow stream can fall behind
+// before further ones are skipped for it
+const subscriberBuffer = 16
+
+var broker = NewBroker()
+
+// NewBroker creates an empty broker
+func NewBroker() *Broker {
+	return &Broker{
+		subscribers: make(map[uint]map[chan database.Notification]struct{}),
+	}
+}
+
+// Subscribe returns a channel receiving the user's new notifications and a
+// function to call once the stream is gone. The channel is closed when the
+// broker shuts down.
+func (b *Broker) Subscribe(userID uint) (<-chan database.Notification, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan database.Notification, subscriberBuffer)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan database.Notification]struct{})
+	}
+	b.subscribers[userID][ch] = struct{}{}
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[userID][ch]; !ok {
+			return
+		}
+		delete(b.subscribers[userID], ch)
+		if len(b.subscribers[userID]) == 0 {
+			delete(b.subscribers, userID)
+		}
+		close(ch)
+	}
+
+	return ch, unsubscribe
+}
+
+// Publish sends a notification to every open stream of its user
+func (b *Broker) Publish(n database.Notification) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers[n.UserID] {
+		select {
+		case ch <- n:
+		default:
+			// The stream is not keeping up; it can catch up from the inbox
+		}
+	}
+}
+
+// Close ends every open stream
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for userID, channels := range b.subscribers {
+		for ch := range channels {
+			close(ch)
+		}
+		delete(b.subscribers, userID)
+	}
+}
+
+// Subscribe opens a live stream of the user's notifications on the
+// application-wide broker
+func Subscribe(userID uint) (<-chan database.Notification, func()) {
+	return broker.Subscribe(userID)
+}
@@ -0,0 +1,49 @@
+package notifications
+
+import (
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/mailer"
+)
+
+// InAppChannel stores notifications in the database so they show up in the
+// user's inbox, and pushes them to the user's open notification streams
+type InAppChannel struct{}
+
+func (InAppChannel) Name() string {
+	return "in-app"
+}
+
+func (InAppChannel) Deliver(n database.Notification) error {
+	if err := database.GetDB().Create(&n).Error; err != nil {
+		return err
+	}
+
+	broker.Publish(n)
+	return nil
+}
+
+// EmailChannel sends notifications by email through a mailer
+type EmailChannel struct {
+	Mailer mailer.Mailer
+}
+
+func (e EmailChannel) Name() string {
+	return "email"
+}
+
+func (e EmailChannel) Deliver(n database.Notification) error {
+	// Look up where to send the notification
+	var user database.User
+	if err := database.GetDB().First(&user, n.UserID).Error; err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return nil
+	}
+
+	return e.Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: n.Title,
+		Body:    n.Message,
+	})
+}
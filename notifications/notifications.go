@@ -0,0 +1,128 @@
+package notifications
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/mailer"
+)
+
+// Channel delivers a notification to its user, e.g. through the in-app inbox
+// or by email
+type Channel interface {
+	Name() string
+	Deliver(n database.Notification) error
+}
+
+// Notifier queues notifications and hands them to every configured channel
+// from a background worker, so request handlers never wait on delivery
+type Notifier struct {
+	queue    chan database.Notification
+	channels []Channel
+	wg       sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// queueSize is how many notifications can be waiting for delivery before new
+// ones are dropped
+const queueSize = 1000
+
+var notifier *Notifier
+
+// NewNotifier creates a notifier delivering through the given channels and
+// starts its worker
+func NewNotifier(channels ...Channel) *Notifier {
+	n := &Notifier{
+		queue:    make(chan database.Notification, queueSize),
+		channels: channels,
+	}
+
+	n.wg.Add(1)
+	go n.run()
+
+	return n
+}
+
+func (n *Notifier) run() {
+	defer n.wg.Done()
+
+	for notification := range n.queue {
+		for _, channel := range n.channels {
+			if err := channel.Deliver(notification); err != nil {
+				slog.Error("Failed to deliver notification",
+					"type", notification.Type, "user_id", notification.UserID, "channel", channel.Name(), "error", err)
+			}
+		}
+	}
+}
+
+// Enqueue queues a notification for delivery. It reports false if the queue
+// is full or closed and the notification was dropped.
+func (n *Notifier) Enqueue(notification database.Notification) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if n.closed {
+		return false
+	}
+
+	select {
+	case n.queue <- notification:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting notifications and waits until the queued ones have
+// been delivered
+func (n *Notifier) Close() {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+
+	n.wg.Wait()
+}
+
+// Init sets up the application-wide notifier with the in-app inbox and email
+// delivery through the given mailer
+func Init(m mailer.Mailer) {
+	channels := []Channel{InAppChannel{}}
+	if m != nil {
+		channels = append(channels, EmailChannel{Mailer: m})
+	}
+
+	notifier = NewNotifier(channels...)
+}
+
+// Close shuts down the application-wide notifier and ends all open
+// notification streams
+func Close() {
+	if notifier != nil {
+		notifier.Close()
+	}
+	broker.Close()
+}
+
+// CloseStreams ends all open notification streams, so a shutting down server
+// does not wait for them. Notifications are still delivered to the inbox.
+func CloseStreams() {
+	broker.Close()
+}
+
+// Enqueue queues a notification on the application-wide notifier
+func Enqueue(notification database.Notification) {
+	if notifier == nil {
+		return
+	}
+	if !notifier.Enqueue(notification) {
+		slog.Warn("Notification queue is unavailable, dropping notification",
+			"type", notification.Type, "user_id", notification.UserID)
+	}
+}
@@ -0,0 +1,184 @@
+package notifications
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/database/databasetest"
+	"github.com/mohammadshaad/golang-book-store-backend/mailer"
+)
+
+// recorder is a channel that keeps what it was asked to deliver
+type recorder struct {
+	mu        sync.Mutex
+	delivered []database.Notification
+}
+
+func (r *recorder) Name() string {
+	return "recorder"
+}
+
+func (r *recorder) Deliver(n database.Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delivered = append(r.delivered, n)
+	return nil
+}
+
+// useRecorder replaces the application-wide notifier with one delivering to
+// a recorder; closing the notifier waits for the queued notifications
+func useRecorder(t *testing.T) (*recorder, *Notifier) {
+	rec := &recorder{}
+	n := NewNotifier(rec)
+	previous := notifier
+	notifier = n
+	t.Cleanup(func() {
+		n.Close()
+		notifier = previous
+	})
+	return rec, n
+}
+
+func TestBookUpdated(t *testing.T) {
+	db := databasetest.Open(t)
+
+	// User 1 has the book in the cart, user 2 on a wishlist and user 3 both
+	db.Create(&database.CartItem{UserID: 1, BookID: 10, Quantity: 1})
+	db.Create(&database.CartItem{UserID: 3, BookID: 10, Quantity: 1})
+	db.Create(&database.CartItem{UserID: 4, BookID: 11, Quantity: 1})
+	for _, userID := range []uint{2, 3} {
+		wishlist := database.Wishlist{UserID: userID, Name: "Later", ShareToken: time.Now().String()}
+		db.Create(&wishlist)
+		db.Create(&database.WishlistItem{WishlistID: wishlist.ID, BookID: 10})
+	}
+
+	before := database.Book{ID: 10, Title: "Dune", Price: 10, Quantity: 0}
+
+	tests := []struct {
+		name  string
+		after database.Book
+		want  []database.NotificationType
+	}{
+		{"nothing changed", before, nil},
+		{"price went up", database.Book{ID: 10, Title: "Dune", Price: 12}, nil},
+		{"price dropped", database.Book{ID: 10, Title: "Dune", Price: 8}, []database.NotificationType{database.NotificationPriceDrop}},
+		{"back in stock", database.Book{ID: 10, Title: "Dune", Price: 10, Quantity: 3}, []database.NotificationType{database.NotificationBackInStock}},
+		{"both", database.Book{ID: 10, Title: "Dune", Price: 8, Quantity: 3}, []database.NotificationType{database.NotificationPriceDrop, database.NotificationBackInStock}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, n := useRecorder(t)
+			if err := BookUpdated(context.Background(), before, tt.after); err != nil {
+				t.Fatalf("BookUpdated failed: %v", err)
+			}
+			n.Close()
+
+			// Every interested user gets each notification once
+			got := map[uint][]database.NotificationType{}
+			for _, notification := range rec.delivered {
+				if notification.BookID != 10 {
+					t.Errorf("Expected a notification about book 10, got %d", notification.BookID)
+				}
+				got[notification.UserID] = append(got[notification.UserID], notification.Type)
+			}
+
+			if len(tt.want) == 0 {
+				if len(got) != 0 {
+					t.Errorf("Expected no notifications, got %v", got)
+				}
+				return
+			}
+
+			var users []int
+			for userID, types := range got {
+				users = append(users, int(userID))
+				if len(types) != len(tt.want) {
+					t.Errorf("Expected user %d to get %v, got %v", userID, tt.want, types)
+				}
+			}
+			sort.Ints(users)
+			if len(users) != 3 || users[0] != 1 || users[1] != 2 || users[2] != 3 {
+				t.Errorf("Expected users 1, 2 and 3 to be notified, got %v", users)
+			}
+		})
+	}
+}
+
+func TestInAppChannel(t *testing.T) {
+	db := databasetest.Open(t)
+
+	b := NewBroker()
+	previous := broker
+	broker = b
+	t.Cleanup(func() { broker = previous })
+
+	events, unsubscribe := b.Subscribe(7)
+	defer unsubscribe()
+
+	n := database.Notification{UserID: 7, Type: database.NotificationPriceDrop, Title: "Price drop: Dune"}
+	if err := (InAppChannel{}).Deliver(n); err != nil {
+		t.Fatalf("Delivering failed: %v", err)
+	}
+
+	var stored []database.Notification
+	db.Where("user_id = ?", 7).Find(&stored)
+	if len(stored) != 1 || stored[0].Title != n.Title {
+		t.Errorf("Expected the notification in the inbox, got %v", stored)
+	}
+
+	select {
+	case got := <-events:
+		if got.ID == 0 || got.Title != n.Title {
+			t.Errorf("Expected the stored notification on the stream, got %+v", got)
+		}
+	default:
+		t.Error("Expected the notification on the user's stream")
+	}
+}
+
+// outbox is a mailer that keeps the messages it was asked to send
+type outbox struct {
+	sent []mailer.Message
+}
+
+func (o *outbox) Send(msg mailer.Message) error {
+	o.sent = append(o.sent, msg)
+	return nil
+}
+
+func TestEmailChannel(t *testing.T) {
+	db := databasetest.Open(t)
+
+	user := database.User{Email: "reader@example.com"}
+	db.Create(&user)
+	noEmail := database.User{}
+	db.Create(&noEmail)
+
+	box := &outbox{}
+	channel := EmailChannel{Mailer: box}
+
+	if err := channel.Deliver(database.Notification{UserID: user.ID, Title: "Price drop: Dune", Message: "Dune is now 8.00."}); err != nil {
+		t.Fatalf("Delivering failed: %v", err)
+	}
+	if len(box.sent) != 1 || box.sent[0].To != user.Email || box.sent[0].Subject != "Price drop: Dune" {
+		t.Errorf("Expected one email to %s, got %+v", user.Email, box.sent)
+	}
+
+	// Users without an email address are skipped
+	if err := channel.Deliver(database.Notification{UserID: noEmail.ID, Title: "Price drop: Dune"}); err != nil {
+		t.Errorf("Expected users without an email to be skipped, got %v", err)
+	}
+	if len(box.sent) != 1 {
+		t.Errorf("Expected no email for a user without an address, got %+v", box.sent)
+	}
+
+	// Users that are gone fail the delivery
+	if err := channel.Deliver(database.Notification{UserID: 999, Title: "Price drop: Dune"}); err == nil {
+		t.Error("Expected delivering to a missing user to fail")
+	}
+}
@@ -0,0 +1,29 @@
+package notifications
+
+import (
+	"fmt"
+
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+)
+
+// ReviewRemoved tells the author of a review that a moderator removed it,
+// and why if the moderator gave a reason
+func ReviewRemoved(review database.Review, book database.Book, reason string) {
+	// Reviews of erased accounts no longer have an author
+	if review.UserID == 0 {
+		return
+	}
+
+	message := fmt.Sprintf("Your review of %s was removed by a moderator.", book.Title)
+	if reason != "" {
+		message = fmt.Sprintf("Your review of %s was removed by a moderator: %s", book.Title, reason)
+	}
+
+	Enqueue(database.Notification{
+		UserID:  review.UserID,
+		Type:    database.NotificationReviewRemoved,
+		Title:   fmt.Sprintf("Review removed: %s", book.Title),
+		Message: message,
+		BookID:  book.ID,
+	})
+}
@@ -0,0 +1,378 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// LoginTTL is how long a user has to finish signing in at the identity
+// provider
+const LoginTTL = 10 * time.Minute
+
+// maxPendingLogins bounds the memory taken by logins that never come back;
+// beyond it the oldest are forgotten
+const maxPendingLogins = 10000
+
+var (
+	// ErrNotConfigured is returned when no identity provider is set up
+	ErrNotConfigured = errors.New("OIDC login is not configured")
+
+	// ErrInvalidState is returned for a callback that does not belong to a
+	// login we started, or one that took too long
+	ErrInvalidState = errors.New("unknown or expired login state")
+)
+
+// Config describes the identity provider and how this app is registered
+// with it
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Claims are the ID token claims used to find or create the user
+type Claims struct {
+	jwt.RegisteredClaims
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	GivenName     string   `json:"given_name"`
+	FamilyName    string   `json:"family_name"`
+	AMR           []string `json:"amr"`
+}
+
+// MultiFactor reports whether the provider says the user signed in with more
+// than one factor
+func (c *Claims) MultiFactor() bool {
+	for _, method := range c.AMR {
+		if method == "mfa" || method == "otp" || method == "hwk" {
+			return true
+		}
+	}
+	return false
+}
+
+// metadata is the part of the discovery document we need
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// pendingLogin is a login that was sent to the identity provider and has
+// not come back yet
+type pendingLogin struct {
+	nonce        string
+	codeVerifier string
+	expires      time.Time
+}
+
+// Provider runs the authorization code flow with PKCE against an OpenID
+// Connect identity provider
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu      sync.Mutex
+	meta    *metadata
+	keys    *keyCache
+	pending map[string]pendingLogin
+	nowFunc func() time.Time
+}
+
+var provider *Provider
+
+// NewProvider creates a provider. Discovery happens on first use, so the
+// app starts even when the identity provider is down.
+func NewProvider(config Config) *Provider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+
+	// The client's transport passes the request's trace on to the provider
+	return &Provider{
+		config:  config,
+		client:  &http.Client{Timeout: 10 * time.Second, Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		pending: map[string]pendingLogin{},
+		nowFunc: time.Now,
+	}
+}
+
+// Init sets up the application-wide provider from the OIDC settings. Without
+// an issuer OIDC login stays disabled.
+func Init() {
+	cfg := config.Get().OIDC
+	if cfg.Issuer == "" {
+		return
+	}
+
+	provider = NewProvider(Config{
+		Issuer:       cfg.Issuer,
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  cfg.RedirectURL,
+	})
+}
+
+// Default returns the application-wide provider, or nil when OIDC login is
+// disabled
+func Default() *Provider {
+	return provider
+}
+
+// SetDefault replaces the application-wide provider, e.g. in tests
+func SetDefault(p *Provider) {
+	provider = p
+}
+
+// StartLogin returns the URL to send the user to and the login's state. The
+// state, nonce and PKCE verifier are remembered until the user comes back;
+// callers should also tie the state to the user's browser, so a callback
+// started elsewhere is refused.
+func (p *Provider) StartLogin(ctx context.Context) (loginURL, state string, err error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err = randomString()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := p.nowFunc()
+	p.mu.Lock()
+	p.prunePending(now)
+	p.pending[state] = pendingLogin{nonce: nonce, codeVerifier: verifier, expires: now.Add(LoginTTL)}
+	p.mu.Unlock()
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return meta.AuthorizationEndpoint + separator + query.Encode(), state, nil
+}
+
+// prunePending drops the expired logins and, if there are still too many,
+// the ones started first. The caller holds the lock.
+func (p *Provider) prunePending(now time.Time) {
+	for key, login := range p.pending {
+		if now.After(login.expires) {
+			delete(p.pending, key)
+		}
+	}
+	for len(p.pending) >= maxPendingLogins {
+		oldest := ""
+		for key, login := range p.pending {
+			if oldest == "" || login.expires.Before(p.pending[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(p.pending, oldest)
+	}
+}
+
+// FinishLogin handles the callback from the identity provider: it redeems
+// the code and returns the verified ID token claims
+func (p *Provider) FinishLogin(ctx context.Context, state, code string) (*Claims, error) {
+	// Each state can only be used once
+	p.mu.Lock()
+	login, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if !ok || p.nowFunc().After(login.expires) {
+		return nil, ErrInvalidState
+	}
+
+	rawIDToken, err := p.exchange(ctx, code, login.codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.verify(ctx, rawIDToken, login.nonce)
+}
+
+// exchange redeems an authorization code at the token endpoint and returns
+// the raw ID token
+func (p *Provider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("token request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request: %s: %s", resp.Status, body)
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("token response: %w", err)
+	}
+	if token.IDToken == "" {
+		return "", errors.New("token response has no ID token")
+	}
+
+	return token.IDToken, nil
+}
+
+// verify checks the ID token's signature, issuer, audience, expiry and nonce
+func (p *Provider) verify(ctx context.Context, raw, nonce string) (*Claims, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}))
+	if _, err := parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.keys.get(ctx, kid)
+	}); err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	if claims.Issuer != meta.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q", claims.Issuer)
+	}
+	if !claims.VerifyAudience(p.config.ClientID, true) {
+		return nil, errors.New("ID token is for another client")
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("ID token does not expire")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+
+	return claims, nil
+}
+
+// discover fetches the provider's discovery document once it is needed.
+// A failed attempt is retried on the next call.
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	var meta metadata
+	if err := getJSON(ctx, p.client, p.config.Issuer+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if meta.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("OIDC discovery: issuer %q does not match %q", meta.Issuer, p.config.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery: incomplete provider metadata")
+	}
+
+	p.meta = &meta
+	p.keys = newKeyCache(p.client, meta.JWKSURI)
+	return p.meta, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// codeChallenge derives the S256 PKCE challenge from a verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,183 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// mockProvider is a minimal OpenID provider: it hands out a code for every
+// authorization request and checks the PKCE verifier when it is redeemed
+type mockProvider struct {
+	t        *testing.T
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	audience string
+
+	challenge string
+	nonce     string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	m := &mockProvider{t: t, key: key, audience: "bookstore"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "good-code" || codeChallenge(r.Form.Get("code_verifier")) != m.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    m.server.URL,
+				Subject:   "staff-42",
+				Audience:  jwt.ClaimStrings{m.audience},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+			},
+			Nonce:         m.nonce,
+			Email:         "staff@example.com",
+			EmailVerified: true,
+			AMR:           []string{"pwd", "mfa"},
+		})
+		token.Header["kid"] = "test"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			t.Errorf("Failed to sign ID token: %v", err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+
+	return m
+}
+
+// authorize plays the user signing in: it records what the login URL asked
+// for and returns the state to call back with
+func (m *mockProvider) authorize(loginURL string) string {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		m.t.Fatalf("Invalid login URL: %v", err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		m.t.Fatalf("Expected a S256 PKCE challenge, got %q", query.Get("code_challenge_method"))
+	}
+	m.challenge = query.Get("code_challenge")
+	m.nonce = query.Get("nonce")
+	return query.Get("state")
+}
+
+func TestLoginFlow(t *testing.T) {
+	mock := newMockProvider(t)
+	provider := NewProvider(Config{Issuer: mock.server.URL, ClientID: "bookstore", RedirectURL: "http://localhost/callback"})
+	ctx := context.Background()
+
+	loginURL, state, err := provider.StartLogin(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start login: %v", err)
+	}
+	if got := mock.authorize(loginURL); got != state {
+		t.Fatalf("Expected the login URL to carry state %q, got %q", state, got)
+	}
+
+	claims, err := provider.FinishLogin(ctx, state, "good-code")
+	if err != nil {
+		t.Fatalf("Failed to finish login: %v", err)
+	}
+	if claims.Subject != "staff-42" || claims.Email != "staff@example.com" || !claims.MultiFactor() {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	// The state cannot be used a second time
+	if _, err := provider.FinishLogin(ctx, state, "good-code"); err != ErrInvalidState {
+		t.Errorf("Expected ErrInvalidState for a reused state, got %v", err)
+	}
+}
+
+func TestLoginRejectsTokenForAnotherClient(t *testing.T) {
+	mock := newMockProvider(t)
+	mock.audience = "someone-else"
+	provider := NewProvider(Config{Issuer: mock.server.URL, ClientID: "bookstore", RedirectURL: "http://localhost/callback"})
+	ctx := context.Background()
+
+	loginURL, state, err := provider.StartLogin(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start login: %v", err)
+	}
+	if got := mock.authorize(loginURL); got != state {
+		t.Fatalf("Expected the login URL to carry state %q, got %q", state, got)
+	}
+
+	if _, err := provider.FinishLogin(ctx, state, "good-code"); err == nil {
+		t.Error("Expected an ID token for another client to be rejected")
+	}
+}
+
+func TestPendingLoginsAreBounded(t *testing.T) {
+	mock := newMockProvider(t)
+	provider := NewProvider(Config{Issuer: mock.server.URL, ClientID: "bookstore", RedirectURL: "http://localhost/callback"})
+	ctx := context.Background()
+
+	now := time.Now()
+	provider.nowFunc = func() time.Time { return now }
+	for i := 0; i < maxPendingLogins; i++ {
+		provider.pending[fmt.Sprint(i)] = pendingLogin{expires: now.Add(time.Duration(i) * time.Millisecond)}
+	}
+
+	if _, _, err := provider.StartLogin(ctx); err != nil {
+		t.Fatalf("Failed to start login: %v", err)
+	}
+	if len(provider.pending) != maxPendingLogins {
+		t.Errorf("Expected %d pending logins, got %d", maxPendingLogins, len(provider.pending))
+	}
+	if _, ok := provider.pending["0"]; ok {
+		t.Error("Expected the oldest login to be forgotten")
+	}
+
+	// Expired logins go first
+	now = now.Add(LoginTTL + time.Minute)
+	if _, _, err := provider.StartLogin(ctx); err != nil {
+		t.Fatalf("Failed to start login: %v", err)
+	}
+	if len(provider.pending) != 1 {
+		t.Errorf("Expected only the new login to be left, got %d", len(provider.pending))
+	}
+}
@@ -0,0 +1,65 @@
+package openapi
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Spec is the OpenAPI 3.1 document describing every route of the API. Keep
+// it in sync with the routes package, whose tests fail when a route is
+// missing.
+//
+//go:embed openapi.json
+var Spec []byte
+
+//go:embed docs.html
+var docsPage []byte
+
+// swaggerUIAssets is where the docs page loads the pinned Swagger UI release
+// from
+const swaggerUIAssets = "https://unpkg.com/swagger-ui-dist@5.17.14/"
+
+// docsPolicy only lets the docs page run the pinned Swagger UI release and
+// its own inline script, and only talk to this API. Tokens typed into the
+// page are kept in memory, not in the browser's storage.
+var docsPolicy = strings.Join([]string{
+	"default-src 'none'",
+	"script-src " + swaggerUIAssets + " " + inlineScriptHashes(docsPage),
+	"style-src " + swaggerUIAssets + " 'unsafe-inline'",
+	"img-src 'self' data:",
+	"connect-src 'self'",
+	"base-uri 'none'",
+	"form-action 'none'",
+	"frame-ancestors 'none'",
+}, "; ")
+
+var inlineScript = regexp.MustCompile(`(?s)<script>(.*?)</script>`)
+
+// inlineScriptHashes lists the CSP hashes of the page's inline scripts, so the
+// policy follows edits to the page
+func inlineScriptHashes(page []byte) string {
+	var hashes []string
+	for _, match := range inlineScript.FindAllSubmatch(page, -1) {
+		sum := sha256.Sum256(match[1])
+		hashes = append(hashes, "'sha256-"+base64.StdEncoding.EncodeToString(sum[:])+"'")
+	}
+	return strings.Join(hashes, " ")
+}
+
+// SpecHandler serves the OpenAPI document
+func SpecHandler(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	return c.Send(Spec)
+}
+
+// DocsHandler serves Swagger UI for the document at /openapi.json
+func DocsHandler(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	c.Set(fiber.HeaderContentSecurityPolicy, docsPolicy)
+	return c.Send(docsPage)
+}
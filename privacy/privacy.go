@@ -0,0 +1,183 @@
+package privacy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"gorm.io/gorm"
+)
+
+// Export is everything stored about a user, as handed out by the data
+// export endpoint
+type Export struct {
+	ExportedAt    time.Time               `json:"exported_at"`
+	Profile       database.User           `json:"profile"`
+	Reviews       []database.Review       `json:"reviews"`
+	Cart          []database.CartItem     `json:"cart"`
+	Wishlists     []database.Wishlist     `json:"wishlists"`
+	Notifications []database.Notification `json:"notifications"`
+}
+
+// GracePeriod returns the time between an erasure request and the purge,
+// configured through ERASURE_GRACE_PERIOD (e.g. "720h")
+func GracePeriod() time.Duration {
+	return config.Get().Privacy.ErasureGracePeriod
+}
+
+// ExportUser collects all data stored about a user
+func ExportUser(ctx context.Context, userID uint) (*Export, error) {
+	db := database.WithContext(ctx)
+	export := &Export{ExportedAt: time.Now()}
+
+	if err := db.First(&export.Profile, userID).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userID).Find(&export.Reviews).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userID).Find(&export.Cart).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Preload("Items.Book").Where("user_id = ?", userID).Find(&export.Wishlists).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("user_id = ?", userID).Find(&export.Notifications).Error; err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// RequestErasure deactivates an active account right away and schedules its
+// data to be erased after the grace period. It returns when the purge is due.
+// Suspended and unverified accounts keep their status: a deactivated account
+// can log in to activate itself again, which must not lift a suspension or
+// skip the email verification.
+func RequestErasure(ctx context.Context, userID uint) (time.Time, error) {
+	now := time.Now()
+	result := database.WithContext(ctx).Model(&database.User{}).
+		Where("id = ?", userID).
+		Updates(map[string]interface{}{
+			"status": gorm.Expr("CASE WHEN status = ? THEN ? ELSE status END",
+				database.AccountStatusActive, database.AccountStatusDeactivated),
+			"erasure_requested_at": now,
+		})
+	if result.Error != nil {
+		return time.Time{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return time.Time{}, gorm.ErrRecordNotFound
+	}
+
+	return now.Add(GracePeriod()), nil
+}
+
+// CancelErasure drops a pending erasure request
+func CancelErasure(ctx context.Context, userID uint) error {
+	return database.WithContext(ctx).Model(&database.User{}).
+		Where("id = ?", userID).
+		Update("erasure_requested_at", nil).Error
+}
+
+// EraseUser removes a user's personal data for good. Reviews are kept for
+// other readers but no longer point to the user; everything else is deleted,
+// including the API keys the user created. It returns gorm.ErrRecordNotFound
+// if there is no such user.
+func EraseUser(ctx context.Context, userID uint) error {
+	return database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user database.User
+		if err := tx.Unscoped().Select("id").First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		// Keep the ratings and comments but detach them from the user
+		if err := tx.Unscoped().Model(&database.Review{}).
+			Where("user_id = ?", userID).
+			Update("user_id", 0).Error; err != nil {
+			return err
+		}
+
+		// Wishlist items go before the wishlists they belong to
+		if err := tx.Unscoped().
+			Where("wishlist_id IN (?)", tx.Unscoped().Model(&database.Wishlist{}).Select("id").Where("user_id = ?", userID)).
+			Delete(&database.WishlistItem{}).Error; err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{
+			&database.Wishlist{},
+			&database.CartItem{},
+			&database.Notification{},
+			&database.UserToken{},
+			&database.RecoveryCode{},
+			&database.Session{},
+		} {
+			if err := tx.Unscoped().Where("user_id = ?", userID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		// Keys outlive neither their creator's rights nor the account
+		if err := tx.Unscoped().Where("created_by_id = ?", userID).Delete(&database.APIKey{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Delete(&database.User{}, userID).Error
+	})
+}
+
+// PurgeDue erases every account whose grace period has passed and returns how
+// many were erased. An account that fails to erase does not stop the others;
+// the failures are returned together.
+func PurgeDue(ctx context.Context, now time.Time) (int, error) {
+	var userIDs []uint
+	if err := database.WithContext(ctx).Unscoped().Model(&database.User{}).
+		Where("erasure_requested_at IS NOT NULL AND erasure_requested_at <= ?", now.Add(-GracePeriod())).
+		Pluck("id", &userIDs).Error; err != nil {
+		return 0, err
+	}
+
+	erased := 0
+	var errs []error
+	for _, userID := range userIDs {
+		if err := EraseUser(ctx, userID); err != nil {
+			errs = append(errs, fmt.Errorf("erasing user %d: %w", userID, err))
+			continue
+		}
+		erased++
+	}
+
+	return erased, errors.Join(errs...)
+}
+
+// StartPurgeWorker runs PurgeDue every interval in the background until the
+// returned function is called
+func StartPurgeWorker(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				count, err := PurgeDue(context.Background(), now)
+				if err != nil {
+					slog.Error("Failed to purge erased accounts", "error", err)
+				}
+				if count > 0 {
+					slog.Info("Erased accounts after their grace period", "count", count)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,147 @@
+package privacy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/database/databasetest"
+	"gorm.io/gorm"
+)
+
+func createUser(t *testing.T, db *gorm.DB, email string) database.User {
+	t.Helper()
+
+	user := database.User{Email: email, Status: database.AccountStatusActive}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("Creating user %s failed: %v", email, err)
+	}
+	return user
+}
+
+func count(t *testing.T, db *gorm.DB, model interface{}, query string, args ...interface{}) int64 {
+	t.Helper()
+
+	var n int64
+	if err := db.Unscoped().Model(model).Where(query, args...).Count(&n).Error; err != nil {
+		t.Fatalf("Counting failed: %v", err)
+	}
+	return n
+}
+
+func TestEraseUser(t *testing.T) {
+	db := databasetest.Open(t)
+	user := createUser(t, db, "reader@example.com")
+	other := createUser(t, db, "other@example.com")
+
+	for _, row := range []interface{}{
+		&database.Review{BookID: 1, UserID: user.ID, Rating: 4, Comment: "Good"},
+		&database.CartItem{UserID: user.ID, BookID: 1, Quantity: 1},
+		&database.Notification{UserID: user.ID, Title: "Hello"},
+		&database.APIKey{Name: "mine", KeyHash: "mine", CreatedByID: user.ID},
+		&database.APIKey{Name: "theirs", KeyHash: "theirs", CreatedByID: other.ID},
+	} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatalf("Creating %T failed: %v", row, err)
+		}
+	}
+
+	if err := EraseUser(context.Background(), user.ID); err != nil {
+		t.Fatalf("EraseUser failed: %v", err)
+	}
+
+	if n := count(t, db, &database.User{}, "id = ?", user.ID); n != 0 {
+		t.Errorf("User still stored")
+	}
+	if n := count(t, db, &database.CartItem{}, "user_id = ?", user.ID); n != 0 {
+		t.Errorf("%d cart items left", n)
+	}
+	if n := count(t, db, &database.Notification{}, "user_id = ?", user.ID); n != 0 {
+		t.Errorf("%d notifications left", n)
+	}
+	if n := count(t, db, &database.APIKey{}, "created_by_id = ?", user.ID); n != 0 {
+		t.Errorf("%d API keys left", n)
+	}
+	if n := count(t, db, &database.APIKey{}, "created_by_id = ?", other.ID); n != 1 {
+		t.Errorf("Other user's API keys = %d, want 1", n)
+	}
+	if n := count(t, db, &database.Review{}, "user_id = 0"); n != 1 {
+		t.Errorf("Detached reviews = %d, want 1", n)
+	}
+}
+
+func TestEraseUnknownUser(t *testing.T) {
+	databasetest.Open(t)
+
+	if err := EraseUser(context.Background(), 42); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("EraseUser(context.Background(), 42) = %v, want gorm.ErrRecordNotFound", err)
+	}
+}
+
+func TestPurgeDueKeepsGoingAfterFailure(t *testing.T) {
+	config.Set(config.Default())
+	db := databasetest.Open(t)
+
+	requested := time.Now().Add(-GracePeriod() - time.Hour)
+	for _, email := range []string{"first@example.com", "second@example.com"} {
+		user := createUser(t, db, email)
+		if err := db.Model(&user).Update("erasure_requested_at", requested).Error; err != nil {
+			t.Fatalf("Requesting erasure failed: %v", err)
+		}
+	}
+	createUser(t, db, "kept@example.com")
+
+	// Fail the first account's deletion only
+	failed := false
+	err := db.Callback().Delete().Before("gorm:delete").Register("fail_once", func(tx *gorm.DB) {
+		if tx.Statement.Table == "users" && !failed {
+			failed = true
+			tx.AddError(errors.New("deletion failed"))
+		}
+	})
+	if err != nil {
+		t.Fatalf("Registering the callback failed: %v", err)
+	}
+
+	erased, err := PurgeDue(context.Background(), time.Now())
+	if err == nil {
+		t.Error("PurgeDue did not report the failure")
+	}
+	if erased != 1 {
+		t.Errorf("Erased %d accounts, want 1", erased)
+	}
+	if n := count(t, db, &database.User{}, "1 = 1"); n != 2 {
+		t.Errorf("%d users left, want 2", n)
+	}
+}
+
+func TestRequestErasureKeepsSuspensions(t *testing.T) {
+	config.Set(config.Default())
+	db := databasetest.Open(t)
+
+	// Only active accounts are deactivated; a deactivated account can
+	// activate itself again
+	for status, want := range map[database.AccountStatus]database.AccountStatus{
+		database.AccountStatusActive:              database.AccountStatusDeactivated,
+		database.AccountStatusSuspended:           database.AccountStatusSuspended,
+		database.AccountStatusPendingVerification: database.AccountStatusPendingVerification,
+	} {
+		user := createUser(t, db, string(status)+"@example.com")
+		if err := db.Model(&user).Update("status", status).Error; err != nil {
+			t.Fatalf("Setting the status failed: %v", err)
+		}
+
+		if _, err := RequestErasure(context.Background(), user.ID); err != nil {
+			t.Fatalf("RequestErasure failed: %v", err)
+		}
+
+		var stored database.User
+		db.First(&stored, user.ID)
+		if stored.Status != want || stored.ErasureRequestedAt == nil {
+			t.Errorf("Erasing a %s account: got status %s, erasure requested at %v, want %s", status, stored.Status, stored.ErasureRequestedAt, want)
+		}
+	}
+}
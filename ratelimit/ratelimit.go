@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Policy is a token bucket: it holds up to Burst requests and refills at
+// Requests per Per, so clients can burst briefly but not exceed the average
+type Policy struct {
+	// Name separates the buckets of different policies for the same client
+	Name     string
+	Requests int
+	Per      time.Duration
+	// Burst is the bucket size; it defaults to Requests
+	Burst int
+}
+
+func (p Policy) capacity() float64 {
+	if p.Burst > 0 {
+		return float64(p.Burst)
+	}
+	return float64(p.Requests)
+}
+
+// rate is how many tokens are added per second
+func (p Policy) rate() float64 {
+	return float64(p.Requests) / p.Per.Seconds()
+}
+
+// String describes the policy in the format of the RateLimit-Policy header
+func (p Policy) String() string {
+	return fmt.Sprintf("%d;w=%d", p.Requests, int(p.Per.Seconds()))
+}
+
+// Result is the outcome of taking a token from a bucket
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is when the bucket will be full again
+	Reset time.Duration
+	// RetryAfter is how long a rejected client has to wait for a token
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets. The in-memory store works for a single instance;
+// several instances behind a load balancer need a shared implementation.
+type Store interface {
+	// Take removes a token from the bucket of key under the policy
+	Take(ctx context.Context, key string, policy Policy) (Result, error)
+}
+
+var store Store = NewMemoryStore()
+
+// Default returns the application-wide store
+func Default() Store {
+	return store
+}
+
+// SetDefault replaces the application-wide store, e.g. with a shared one
+func SetDefault(s Store) {
+	store = s
+}
+
+// sweepInterval is how often the memory store drops buckets that have
+// filled up again, since those behave the same as missing ones
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// MemoryStore keeps buckets in process memory
+type MemoryStore struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, policy Policy) (Result, error) {
+	now := s.now()
+	capacity := policy.capacity()
+	rate := policy.rate()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		for k, b := range s.buckets {
+			if !now.Before(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+
+	// Refill for the time since the last request
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	result := Result{Limit: policy.Requests}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+
+	result.Reset = seconds((capacity - b.tokens) / rate)
+	result.Remaining = int(b.tokens)
+	b.full = now.Add(result.Reset)
+
+	return result, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
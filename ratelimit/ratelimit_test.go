@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTokenBucket(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+
+	policy := Policy{Name: "test", Requests: 60, Per: time.Minute, Burst: 3}
+	ctx := context.Background()
+
+	// The full bucket allows a burst...
+	for i := 0; i < 3; i++ {
+		result, err := store.Take(ctx, "client", policy)
+		if err != nil {
+			t.Fatalf("Take failed: %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+		if result.Remaining != 2-i {
+			t.Errorf("Expected %d remaining, got %d", 2-i, result.Remaining)
+		}
+	}
+
+	// ...then rejects until a token has been added
+	result, _ := store.Take(ctx, "client", policy)
+	if result.Allowed {
+		t.Fatal("Expected the request after the burst to be rejected")
+	}
+	if result.RetryAfter != time.Second {
+		t.Errorf("Expected to retry after 1s, got %s", result.RetryAfter)
+	}
+
+	// Other clients have their own bucket
+	if result, _ := store.Take(ctx, "other", policy); !result.Allowed {
+		t.Error("Expected another client to be allowed")
+	}
+
+	now = now.Add(time.Second)
+	if result, _ := store.Take(ctx, "client", policy); !result.Allowed {
+		t.Error("Expected a request to be allowed once the bucket refilled")
+	}
+}
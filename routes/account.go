@@ -0,0 +1,271 @@
+package routes
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/logging"
+	"github.com/mohammadshaad/golang-book-store-backend/mailer"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// verifyEmailTTL is how long an email verification link stays valid
+	verifyEmailTTL = 48 * time.Hour
+
+	// resetPasswordTTL is how long a password reset link stays valid
+	resetPasswordTTL = time.Hour
+)
+
+var errInvalidUserToken = errors.New("invalid or expired token")
+
+// Verify the user's email address with the token from the verification email
+func VerifyEmailHandler(c *fiber.Ctx) error {
+	var input struct {
+		Token string `json:"token" validate:"required"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	token, err := consumeUserToken(c.UserContext(), input.Token, database.TokenPurposeVerifyEmail)
+	if err != nil {
+		return apierror.BadRequest("Invalid or expired verification link")
+	}
+
+	if err := database.WithContext(c.UserContext()).Model(&database.User{}).
+		Where("id = ? AND status = ?", token.UserID, database.AccountStatusPendingVerification).
+		Updates(map[string]interface{}{
+			"email_verified_at": time.Now(),
+			"status":            database.AccountStatusActive,
+		}).Error; err != nil {
+		return apierror.Internal("Cannot verify email")
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Email verified successfully, you can now log in",
+	})
+}
+
+// Send a new verification email to a user who has not verified yet
+func ResendVerificationHandler(c *fiber.Ctx) error {
+	var input struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	// Only send mail to unverified accounts, but answer the same way either
+	// way so the endpoint cannot be used to find out which emails exist
+	var user database.User
+	if err := database.WithContext(c.UserContext()).Where("email = ? AND status = ?", input.Email, database.AccountStatusPendingVerification).First(&user).Error; err == nil {
+		if err := sendVerificationEmail(c.UserContext(), user); err != nil {
+			logging.FromContext(c.UserContext()).Error("Failed to send verification email", "user_id", user.ID, "error", err)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "If the account exists and is not verified yet, a verification email has been sent",
+	})
+}
+
+// Send a password reset link to the given email address
+func ForgotPasswordHandler(c *fiber.Ctx) error {
+	var input struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	// Answer the same way whether or not the account exists
+	var user database.User
+	if err := database.WithContext(c.UserContext()).Where("email = ?", input.Email).First(&user).Error; err == nil {
+		if err := sendPasswordResetEmail(c.UserContext(), user); err != nil {
+			logging.FromContext(c.UserContext()).Error("Failed to send password reset email", "user_id", user.ID, "error", err)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "If an account with that email exists, a password reset link has been sent",
+	})
+}
+
+// Set a new password using the token from the password reset email
+func ResetPasswordHandler(c *fiber.Ctx) error {
+	var input struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password" validate:"required"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	token, err := consumeUserToken(c.UserContext(), input.Token, database.TokenPurposeResetPassword)
+	if err != nil {
+		return apierror.BadRequest("Invalid or expired reset link")
+	}
+
+	// Hash the new password
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), 10)
+	if err != nil {
+		return apierror.Internal("Cannot hash password")
+	}
+
+	// The user proved access to the mailbox, so the email counts as verified
+	updates := map[string]interface{}{"password": hashedPassword}
+	var user database.User
+	if err := database.WithContext(c.UserContext()).First(&user, token.UserID).Error; err != nil {
+		return apierror.NotFound("User not found")
+	}
+	if user.Status == database.AccountStatusPendingVerification {
+		updates["email_verified_at"] = time.Now()
+		updates["status"] = database.AccountStatusActive
+	}
+
+	if err := database.WithContext(c.UserContext()).Model(&user).Updates(updates).Error; err != nil {
+		return apierror.Internal("Cannot reset password")
+	}
+
+	// Whoever knew the old password may still be logged in
+	if err := endSessions(c.UserContext(), user.ID); err != nil {
+		return apierror.Internal("Cannot log out existing sessions")
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Password reset successfully, you can now log in",
+	})
+}
+
+func sendVerificationEmail(ctx context.Context, user database.User) error {
+	token, err := issueUserToken(ctx, user.ID, database.TokenPurposeVerifyEmail, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease verify your email address by opening the link below:\n\n%s\n\nThe link expires in %s.\n",
+			user.FirstName, appLink("/verify-email", token), verifyEmailTTL),
+	})
+}
+
+func sendPasswordResetEmail(ctx context.Context, user database.User) error {
+	token, err := issueUserToken(ctx, user.ID, database.TokenPurposeResetPassword, resetPasswordTTL)
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nYou can choose a new password by opening the link below:\n\n%s\n\nThe link expires in %s. If you did not ask for a password reset, you can ignore this email.\n",
+			user.FirstName, appLink("/reset-password", token), resetPasswordTTL),
+	})
+}
+
+// appLink builds a link into the frontend at APP_URL carrying a token
+func appLink(path, token string) string {
+	return config.Get().Server.AppURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// issueUserToken creates a new single-use token for the user and returns its
+// raw value. Earlier unused tokens with the same purpose stop working.
+func issueUserToken(ctx context.Context, userID uint, purpose database.TokenPurpose, ttl time.Duration) (string, error) {
+	db := database.WithContext(ctx)
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	raw := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	if err := db.Model(&database.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+		Update("used_at", now).Error; err != nil {
+		return "", err
+	}
+
+	token := database.UserToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: hashUserToken(raw),
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := db.Create(&token).Error; err != nil {
+		return "", err
+	}
+
+	return raw, nil
+}
+
+// consumeUserToken checks a raw token and marks it as used, so it can only
+// be redeemed once
+func consumeUserToken(ctx context.Context, raw string, purpose database.TokenPurpose) (database.UserToken, error) {
+	db := database.WithContext(ctx)
+	var token database.UserToken
+	if err := db.
+		Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", hashUserToken(raw), purpose, time.Now()).
+		First(&token).Error; err != nil {
+		return database.UserToken{}, errInvalidUserToken
+	}
+
+	// Guard against the same token being redeemed by two concurrent requests
+	result := db.Model(&database.UserToken{}).
+		Where("id = ? AND used_at IS NULL", token.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return database.UserToken{}, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return database.UserToken{}, errInvalidUserToken
+	}
+
+	return token, nil
+}
+
+func hashUserToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
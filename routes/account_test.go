@@ -0,0 +1,91 @@
+package routes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+)
+
+func TestUserTokens(t *testing.T) {
+	newTestApp(t)
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	ctx := context.Background()
+
+	raw, err := issueUserToken(ctx, user.ID, database.TokenPurposeResetPassword, time.Hour)
+	if err != nil {
+		t.Fatalf("Issuing a token failed: %v", err)
+	}
+
+	// Tokens only work for the purpose they were issued for
+	if _, err := consumeUserToken(ctx, raw, database.TokenPurposeVerifyEmail); err != errInvalidUserToken {
+		t.Errorf("Expected a token for another purpose to be rejected, got %v", err)
+	}
+
+	token, err := consumeUserToken(ctx, raw, database.TokenPurposeResetPassword)
+	if err != nil {
+		t.Fatalf("Consuming the token failed: %v", err)
+	}
+	if token.UserID != user.ID {
+		t.Errorf("Expected the token of user %d, got %d", user.ID, token.UserID)
+	}
+
+	// Tokens can only be used once
+	if _, err := consumeUserToken(ctx, raw, database.TokenPurposeResetPassword); err != errInvalidUserToken {
+		t.Errorf("Expected a used token to be rejected, got %v", err)
+	}
+
+	// Issuing a new token ends the earlier ones
+	first, _ := issueUserToken(ctx, user.ID, database.TokenPurposeVerifyEmail, time.Hour)
+	second, _ := issueUserToken(ctx, user.ID, database.TokenPurposeVerifyEmail, time.Hour)
+	if _, err := consumeUserToken(ctx, first, database.TokenPurposeVerifyEmail); err != errInvalidUserToken {
+		t.Errorf("Expected a replaced token to be rejected, got %v", err)
+	}
+	if _, err := consumeUserToken(ctx, second, database.TokenPurposeVerifyEmail); err != nil {
+		t.Errorf("Expected the latest token to work, got %v", err)
+	}
+
+	// Expired tokens are rejected
+	expired, _ := issueUserToken(ctx, user.ID, database.TokenPurposeResetPassword, -time.Minute)
+	if _, err := consumeUserToken(ctx, expired, database.TokenPurposeResetPassword); err != errInvalidUserToken {
+		t.Errorf("Expected an expired token to be rejected, got %v", err)
+	}
+
+	if _, err := consumeUserToken(ctx, "unknown", database.TokenPurposeResetPassword); err != errInvalidUserToken {
+		t.Errorf("Expected an unknown token to be rejected, got %v", err)
+	}
+}
+
+func TestResetPasswordEndsSessions(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+
+	session, err := createSession(context.Background(), user, false)
+	if err != nil {
+		t.Fatalf("Creating a session failed: %v", err)
+	}
+	token, refreshToken := session["token"].(string), session["refresh_token"].(string)
+
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", token, nil, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected the token to work before the reset, got %d", status)
+	}
+
+	raw, _ := issueUserToken(context.Background(), user.ID, database.TokenPurposeResetPassword, time.Hour)
+	if status := doRequest(t, app, "POST", "/api/v1/reset-password", "", map[string]string{"token": raw, "password": "new password"}, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected the reset to answer 200, got %d", status)
+	}
+
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", token, nil, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the access token to be revoked, got %d", status)
+	}
+	if status := doRequest(t, app, "POST", "/api/v1/token/refresh", "", map[string]string{"refresh_token": refreshToken}, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the refresh token to be revoked, got %d", status)
+	}
+
+	// The link cannot be used a second time
+	if status := doRequest(t, app, "POST", "/api/v1/reset-password", "", map[string]string{"token": raw, "password": "other password"}, nil); status != fiber.StatusBadRequest {
+		t.Errorf("Expected a used reset link to answer 400, got %d", status)
+	}
+}
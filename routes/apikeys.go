@@ -0,0 +1,143 @@
+package routes
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+)
+
+// Create an API key for a script. The key itself is only shown once.
+func CreateAPIKeyHandler(c *fiber.Ctx) error {
+	// API keys cannot create more API keys
+	adminID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+	claims, _ := middleware.Claims(c)
+
+	var input struct {
+		Name        string     `json:"name" validate:"required"`
+		Permissions []string   `json:"permissions" validate:"required,min=1"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	// A key can only get permissions the admin creating it has
+	for _, permission := range input.Permissions {
+		if !auth.IsPermission(permission) {
+			return apierror.BadRequest("Unknown permission " + permission)
+		}
+		if !claims.HasPermission(permission) {
+			return apierror.Forbidden("You do not have the permission " + permission)
+		}
+	}
+
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(time.Now()) {
+		return apierror.BadRequest("Expiry must be in the future")
+	}
+
+	raw, err := auth.NewAPIKey()
+	if err != nil {
+		return apierror.Internal("Failed to create API key")
+	}
+
+	key := database.APIKey{
+		Name:        input.Name,
+		Prefix:      auth.APIKeyPrefix(raw),
+		KeyHash:     auth.HashAPIKey(raw),
+		Permissions: input.Permissions,
+		CreatedByID: adminID,
+		ExpiresAt:   input.ExpiresAt,
+	}
+
+	if err := database.WithContext(c.UserContext()).Create(&key).Error; err != nil {
+		return apierror.Internal("Failed to create API key")
+	}
+
+	setLocation(c, key.ID)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"api_key": key,
+		"key":     raw,
+	})
+}
+
+// Get all API keys, including revoked and expired ones
+func GetAPIKeysHandler(c *fiber.Ctx) error {
+	if _, ok := middleware.CurrentUserID(c); !ok {
+		return middleware.Unauthorized()
+	}
+
+	var keys []database.APIKey
+	if err := database.WithContext(c.UserContext()).Order("created_at DESC").Find(&keys).Error; err != nil {
+		return apierror.Internal("Failed to fetch API keys")
+	}
+
+	return c.JSON(keys)
+}
+
+// Get a single API key
+func GetAPIKeyHandler(c *fiber.Ctx) error {
+	if _, ok := middleware.CurrentUserID(c); !ok {
+		return middleware.Unauthorized()
+	}
+
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	var key database.APIKey
+	if err := database.WithContext(c.UserContext()).First(&key, id).Error; err != nil {
+		return apierror.NotFound("API key not found")
+	}
+
+	return c.JSON(key)
+}
+
+// Revoke an API key so it stops working right away
+func RevokeAPIKeyHandler(c *fiber.Ctx) error {
+	if _, ok := middleware.CurrentUserID(c); !ok {
+		return middleware.Unauthorized()
+	}
+
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	var key database.APIKey
+	if err := database.WithContext(c.UserContext()).First(&key, id).Error; err != nil {
+		return apierror.NotFound("API key not found")
+	}
+
+	if key.RevokedAt == nil {
+		now := time.Now()
+		if err := database.WithContext(c.UserContext()).Model(&key).Update("revoked_at", now).Error; err != nil {
+			return apierror.Internal("Failed to revoke API key")
+		}
+		key.RevokedAt = &now
+	}
+
+	return c.JSON(key)
+}
+
+// revokeAPIKeys revokes the keys the user created, for when the user is no
+// longer an active admin
+func revokeAPIKeys(ctx context.Context, userID uint) error {
+	return database.WithContext(ctx).Model(&database.APIKey{}).
+		Where("created_by_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
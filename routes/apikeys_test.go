@@ -0,0 +1,120 @@
+package routes
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+)
+
+// createTestAPIKey creates an API key with the permissions as the admin and
+// returns the key
+func createTestAPIKey(t *testing.T, app *fiber.App, adminToken string, permissions ...string) string {
+	t.Helper()
+
+	var created struct {
+		Key string `json:"key"`
+	}
+	body := map[string]interface{}{"name": "script", "permissions": permissions}
+	if status := doRequest(t, app, "POST", "/api/v2/api-keys", adminToken, body, &created); status != fiber.StatusCreated {
+		t.Fatalf("Expected creating an API key to answer 201, got %d", status)
+	}
+	return created.Key
+}
+
+func withKey(key string) map[string]string {
+	return map[string]string{"X-API-Key": key}
+}
+
+func TestAPIKeyPermissions(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	book := createTestBook(t, database.Book{Title: "Dune", Path: "/books/dune.pdf"})
+
+	booksKey := createTestAPIKey(t, app, adminToken, auth.PermissionManageBooks)
+	cartsKey := createTestAPIKey(t, app, adminToken, auth.PermissionManageCarts)
+	usersKey := createTestAPIKey(t, app, adminToken, auth.PermissionManageUsers)
+
+	for _, path := range []string{
+		"/api/v1/admin/books",
+		fmt.Sprintf("/api/v1/admin/book/%d", book.ID),
+		fmt.Sprintf("/api/v1/admin/book/%d/download", book.ID),
+		fmt.Sprintf("/api/v1/admin/book/%d/reviews", book.ID),
+		"/api/v2/books",
+		fmt.Sprintf("/api/v2/books/%d/download", book.ID),
+	} {
+		if status := doRequestWithHeaders(t, app, "GET", path, withKey(booksKey), nil, nil); status != fiber.StatusOK {
+			t.Errorf("Expected a books key to read %s, got %d", path, status)
+		}
+		if status := doRequestWithHeaders(t, app, "GET", path, withKey(cartsKey), nil, nil); status != fiber.StatusForbidden {
+			t.Errorf("Expected a carts key to get 403 for %s, got %d", path, status)
+		}
+	}
+
+	// Roles are only changed by admins themselves
+	role := fmt.Sprintf("/api/v2/users/%d/role", user.ID)
+	if status := doRequestWithHeaders(t, app, "PUT", role, withKey(usersKey), map[string]string{"role": "admin"}, nil); status != fiber.StatusForbidden {
+		t.Errorf("Expected changing a role with an API key to answer 403, got %d", status)
+	}
+
+	if status := doRequest(t, app, "DELETE", "/api/v2/api-keys/1%20OR%201=1", adminToken, nil, nil); status != fiber.StatusBadRequest {
+		t.Errorf("Expected revoking a malformed ID to answer 400, got %d", status)
+	}
+}
+
+func TestAPIKeysFollowTheirCreator(t *testing.T) {
+	app := newTestApp(t)
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+
+	for _, tt := range []struct {
+		name   string
+		change func(creator database.User)
+	}{
+		{"demoted", func(creator database.User) {
+			if status := doRequest(t, app, "PUT", fmt.Sprintf("/api/v1/admin/user/%d/role", creator.ID), adminToken, map[string]string{"role": "user"}, nil); status != fiber.StatusOK {
+				t.Fatalf("Expected the demotion to answer 200, got %d", status)
+			}
+		}},
+		{"suspended", func(creator database.User) {
+			if status := doRequest(t, app, "PUT", fmt.Sprintf("/api/v1/admin/user/%d/suspend", creator.ID), adminToken, map[string]string{"reason": "Left"}, nil); status != fiber.StatusOK {
+				t.Fatalf("Expected the suspension to answer 200, got %d", status)
+			}
+		}},
+		{"erased", func(creator database.User) {
+			if status := doRequest(t, app, "POST", fmt.Sprintf("/api/v1/admin/user/%d/erase", creator.ID), adminToken, nil, nil); status != fiber.StatusOK {
+				t.Fatalf("Expected the erasure to answer 200, got %d", status)
+			}
+		}},
+	} {
+		creator, creatorToken := createTestUser(t, tt.name+"@example.com", database.UserRoleAdmin)
+		key := createTestAPIKey(t, app, creatorToken, auth.PermissionManageUsers)
+		if status := doRequestWithHeaders(t, app, "GET", "/api/v1/admin/users", withKey(key), nil, nil); status != fiber.StatusOK {
+			t.Fatalf("%s: expected the key to work at first, got %d", tt.name, status)
+		}
+
+		tt.change(creator)
+
+		if status := doRequestWithHeaders(t, app, "GET", "/api/v1/admin/users", withKey(key), nil, nil); status != fiber.StatusUnauthorized {
+			t.Errorf("%s: expected the key to stop working, got %d", tt.name, status)
+		}
+		var active int64
+		database.GetDB().Model(&database.APIKey{}).Where("created_by_id = ? AND revoked_at IS NULL", creator.ID).Count(&active)
+		if active != 0 {
+			t.Errorf("%s: expected the creator's keys to be revoked, %d still active", tt.name, active)
+		}
+	}
+
+	// Keys are checked against their creator on every use, even when the
+	// account changed behind the API's back
+	creator, creatorToken := createTestUser(t, "direct@example.com", database.UserRoleAdmin)
+	key := createTestAPIKey(t, app, creatorToken, auth.PermissionManageUsers)
+	database.GetDB().Model(&creator).Update("status", database.AccountStatusDeactivated)
+	middleware.InvalidateUser(creator.ID)
+	if status := doRequestWithHeaders(t, app, "GET", "/api/v1/admin/users", withKey(key), nil, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected a deactivated admin's key to stop working, got %d", status)
+	}
+}
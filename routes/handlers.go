@@ -1,25 +1,57 @@
 package routes
 
 import (
+	"context"
+	"errors"
+	"math"
 	"math/rand"
-	"os"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
 	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/logging"
+	"github.com/mohammadshaad/golang-book-store-backend/metrics"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+	"github.com/mohammadshaad/golang-book-store-backend/notifications"
+	"github.com/mohammadshaad/golang-book-store-backend/sessions"
 
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 
 	"github.com/go-playground/validator/v10"
-
-	"github.com/golang-jwt/jwt/v4"
 )
 
 var validate *validator.Validate
 
+var errBookNotFound = errors.New("book not found")
+
+// idParam parses the numeric ID in the route parameter with the given name
+func idParam(c *fiber.Ctx, name string) (uint, error) {
+	id, err := strconv.ParseUint(c.Params(name), 10, 32)
+	if err != nil {
+		return 0, apierror.BadRequest("Invalid ID format")
+	}
+	return uint(id), nil
+}
+
 func init() {
 	validate = validator.New()
+
+	// Report invalid fields by their JSON names
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
 }
 
 func LoginHandler(c *fiber.Ctx) error {
@@ -29,55 +61,121 @@ func LoginHandler(c *fiber.Ctx) error {
 	}
 
 	if err := c.BodyParser(&userData); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"success": false,
-			"message": "Cannot parse JSON",
-		})
+		return apierror.InvalidBody()
 	}
 
 	// Validate user input
 	if err := validate.Struct(userData); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"success": false,
-			"message": "Invalid input data",
-			"errors":  err.(validator.ValidationErrors),
-		})
+		return apierror.Validation(err)
+	}
+
+	// Slow down or refuse clients that keep failing, per account and per IP
+	accountKey := auth.AccountKey(userData.Email)
+	ipKey := auth.IPKey(c.IP())
+	if wait := loginWait(accountKey, ipKey); wait > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return apierror.New(fiber.StatusTooManyRequests, apierror.CodeRateLimited, "Too many failed login attempts, try again later")
 	}
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().Where("email = ?", userData.Email).First(&user).Error; err != nil {
-		// Handle database errors (e.g., no user with the given email)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+	if err := database.WithContext(c.UserContext()).Where("email = ?", userData.Email).First(&user).Error; err != nil {
+		// Compare against a dummy hash anyway so unknown emails take as long
+		// to answer as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(userData.Password))
+		return loginFailed(accountKey, ipKey)
 	}
 
 	// Compare the given password with the password in the database
 	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(userData.Password)); err != nil {
-		// Handle password incorrect error
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Incorrect password",
+		return loginFailed(accountKey, ipKey)
+	}
+
+	// The password was right, forget earlier failures on the account
+	auth.AccountThrottle.Reset(accountKey)
+
+	// Only active accounts can log in. Deactivated accounts get a session
+	// too, but it only reaches the route that activates them again.
+	if err := loginAccountError(user); err != nil {
+		return err
+	}
+
+	// With two-factor authentication enabled the password alone is not
+	// enough; hand out a token that only allows sending the code
+	if user.TOTPEnabled {
+		preAuthToken, err := CreatePreAuthToken(user)
+		if err != nil {
+			return apierror.Internal("Cannot log in")
+		}
+
+		return c.JSON(fiber.Map{
+			"success":             true,
+			"two_factor_required": true,
+			"pre_auth_token":      preAuthToken,
 		})
 	}
 
-	// Create a JWT token
-	token, err := CreateToken(user.ID)
+	// Create the JWT tokens
+	session, err := createSession(c.UserContext(), user, false)
 	if err != nil {
 		// Handle token creation error
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Cannot log in",
-		})
+		return apierror.Internal("Cannot log in")
 	}
 
-	// Return the token
-	return c.JSON(fiber.Map{
-		"success": true,
-		"token":   token,
-	})
+	// Return the tokens
+	metrics.RecordLogin("password", true)
+	return c.JSON(session)
 
 }
 
+// loginAccountError returns why the account may not log in, or nil. Unlike
+// middleware.InactiveAccountError it lets deactivated accounts through, so
+// their owners can log in to activate them again.
+func loginAccountError(user database.User) error {
+	if user.Status == database.AccountStatusDeactivated {
+		return nil
+	}
+	if err := middleware.InactiveAccountError(user); err != nil {
+		return err
+	}
+	return nil
+}
+
+// loginWait returns how long a login attempt has to wait given the failures
+// recorded for the account and the client IP
+func loginWait(accountKey, ipKey string) time.Duration {
+	accountWait, _ := auth.AccountThrottle.Check(accountKey)
+	ipWait, _ := auth.IPThrottle.Check(ipKey)
+	if ipWait > accountWait {
+		return ipWait
+	}
+	return accountWait
+}
+
+// loginFailed records a failed login and answers with the same error whether
+// the email or the password was wrong
+func loginFailed(accountKey, ipKey string) error {
+	auth.AccountThrottle.Fail(accountKey)
+	auth.IPThrottle.Fail(ipKey)
+	metrics.RecordLogin("password", false)
+
+	return apierror.New(fiber.StatusUnauthorized, apierror.CodeInvalidCredentials, "Invalid email or password")
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// dummyPasswordHash returns a bcrypt hash to compare against when the user
+// does not exist
+func dummyPasswordHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), 10)
+	})
+	return dummyHash
+}
+
 func RegisterHandler(c *fiber.Ctx) error {
 	var userData struct {
 		FirstName string            `json:"firstname" validate:"required"`
@@ -88,28 +186,19 @@ func RegisterHandler(c *fiber.Ctx) error {
 	}
 
 	if err := c.BodyParser(&userData); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"success": false,
-			"message": "Cannot parse JSON",
-		})
+		return apierror.InvalidBody()
 	}
 
 	// Validate user input
 	if err := validate.Struct(userData); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"success": false,
-			"message": "Invalid input data",
-			"errors":  err.(validator.ValidationErrors),
-		})
+		return apierror.Validation(err)
 	}
 
 	// Check if the user already exists (email must be unique)
 	var user database.User
-	if err := database.GetDB().Where("email = ?", userData.Email).First(&user).Error; err == nil {
+	if err := database.WithContext(c.UserContext()).Where("email = ?", userData.Email).First(&user).Error; err == nil {
 		// User already exists, don't register again
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-			"error": "User already exists",
-		})
+		return apierror.Conflict("User already exists")
 	}
 
 	// Generate a random numeric user ID
@@ -119,10 +208,7 @@ func RegisterHandler(c *fiber.Ctx) error {
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(userData.Password), 10)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"success": false,
-			"message": "Cannot hash password",
-		})
+		return apierror.Internal("Cannot hash password")
 	}
 
 	// Create a new user with the generated ID
@@ -133,61 +219,42 @@ func RegisterHandler(c *fiber.Ctx) error {
 		Email:     userData.Email,
 		Password:  hashedPassword,
 		Role:      userData.Role,
+		Status:    database.AccountStatusPendingVerification,
 	}
 
 	// Save the user to the database
-	if err := database.GetDB().Create(&newUser).Error; err != nil {
-		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-			"error": "User registration failed",
-		})
+	if err := database.WithContext(c.UserContext()).Create(&newUser).Error; err != nil {
+		return apierror.Conflict("User registration failed")
 	}
+	metrics.Registrations.Inc()
 
-	// Retrieve the auto-generated ID from the database
-	autoGeneratedID := newUser.ID
-
-	// Create a JWT token
-	token, err := CreateToken(autoGeneratedID)
-	if err != nil {
-		// Handle token creation error
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Cannot log in",
-		})
+	// The user can log in once the email address has been verified
+	if err := sendVerificationEmail(c.UserContext(), newUser); err != nil {
+		logging.FromContext(c.UserContext()).Error("Failed to send verification email", "user_id", newUser.ID, "error", err)
 	}
 
-	// Return the token
-	return c.JSON(fiber.Map{
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"success": true,
-		"token":   token,
+		"message": "Registration successful, check your email to verify your account",
 	})
 
 }
 
 func DeactivateAccountHandler(c *fiber.Ctx) error {
 	// Get the "id" URL parameter and convert it to a uint
-	idStr := c.Params("id")
-	id, err := strconv.ParseUint(idStr, 10, 32)
-	if err != nil {
+	id, ok := middleware.UserIDParam(c, "id")
+	if !ok {
 		// Handle invalid ID format
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
+		return apierror.BadRequest("Invalid ID format")
 	}
 
-	// Find the user in the database
-	var user database.User
-	if err := database.GetDB().First(&user, uint(id)).Error; err != nil {
-		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+	// Users can only deactivate their own account
+	if userID, ok := middleware.CurrentUserID(c); !ok || userID != id {
+		return apierror.Forbidden("You can only deactivate your own account")
 	}
 
-	// Deactivate the user
-	if err := database.GetDB().Model(&user).Update("active", false).Error; err != nil {
-		// Handle database errors
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Cannot deactivate user",
-		})
+	if _, err := deactivateAccount(c, id); err != nil {
+		return err
 	}
 
 	// Set the token's expiration time to now thereby invalidating it
@@ -204,32 +271,54 @@ func DeactivateAccountHandler(c *fiber.Ctx) error {
 	})
 }
 
-func ActivateAccountHandler(c *fiber.Ctx) error {
-	// Get the "id" URL parameter and convert it to a uint
-	idStr := c.Params("id")
-	id, err := strconv.ParseUint(idStr, 10, 32)
-	if err != nil {
-		// Handle invalid ID format
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
-	}
-
+// deactivateAccount deactivates an active account
+func deactivateAccount(c *fiber.Ctx, id uint) (database.User, error) {
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, uint(id)).Error; err != nil {
+	if err := database.WithContext(c.UserContext()).First(&user, id).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return user, apierror.NotFound("User not found")
+	}
+
+	// Only active accounts can be deactivated; suspensions are lifted by an
+	// admin
+	if user.Status != database.AccountStatusActive {
+		return user, apierror.Conflict("Account is not active")
 	}
 
-	// Activate the user
-	if err := database.GetDB().Model(&user).Update("active", true).Error; err != nil {
+	// Deactivate the user
+	if err := database.WithContext(c.UserContext()).Model(&user).Update("status", database.AccountStatusDeactivated).Error; err != nil {
 		// Handle database errors
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Cannot activate user",
-		})
+		return user, apierror.Internal("Cannot deactivate user")
+	}
+	// Log the account out everywhere; it can log in again to reactivate
+	if err := endSessions(c.UserContext(), user.ID); err != nil {
+		return user, apierror.Internal("Cannot log out existing sessions")
+	}
+	if err := revokeAPIKeys(c.UserContext(), user.ID); err != nil {
+		return user, apierror.Internal("Cannot revoke API keys")
+	}
+	user.Status = database.AccountStatusDeactivated
+
+	return user, nil
+}
+
+// Activate the logged in user's deactivated account again
+func ReactivateAccountHandler(c *fiber.Ctx) error {
+	// Get the "id" URL parameter and convert it to a uint
+	id, ok := middleware.UserIDParam(c, "id")
+	if !ok {
+		// Handle invalid ID format
+		return apierror.BadRequest("Invalid ID format")
+	}
+
+	// Users can only activate their own account; admins use the admin route
+	if userID, ok := middleware.CurrentUserID(c); !ok || userID != id {
+		return apierror.Forbidden("You can only activate your own account")
+	}
+
+	if _, err := activateAccount(c, id); err != nil {
+		return err
 	}
 
 	return c.JSON(fiber.Map{
@@ -238,62 +327,85 @@ func ActivateAccountHandler(c *fiber.Ctx) error {
 	})
 }
 
-func DeleteAccountHandler(c *fiber.Ctx) error {
+// Activate a deactivated account again (admin access)
+func ActivateAccountHandler(c *fiber.Ctx) error {
 	// Get the "id" URL parameter and convert it to a uint
-	idStr := c.Params("id")
-	id, err := strconv.ParseUint(idStr, 10, 32)
-	if err != nil {
+	id, ok := middleware.UserIDParam(c, "id")
+	if !ok {
 		// Handle invalid ID format
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
+		return apierror.BadRequest("Invalid ID format")
 	}
 
+	if _, err := activateAccount(c, id); err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "User activated successfully",
+	})
+}
+
+// activateAccount activates a deactivated account again
+func activateAccount(c *fiber.Ctx, id uint) (database.User, error) {
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, uint(id)).Error; err != nil {
+	if err := database.WithContext(c.UserContext()).First(&user, id).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return user, apierror.NotFound("User not found")
+	}
+
+	// Only deactivated accounts can be activated again; suspended or
+	// unverified accounts need their own flow
+	if user.Status != database.AccountStatusDeactivated {
+		return user, apierror.Conflict("Account is not deactivated")
 	}
 
-	// Delete the user's account from the database
-	if err := database.GetDB().Delete(&user).Error; err != nil {
+	// Activate the user, which also cancels a pending erasure request
+	if err := database.WithContext(c.UserContext()).Model(&user).Updates(map[string]interface{}{
+		"status":               database.AccountStatusActive,
+		"erasure_requested_at": nil,
+	}).Error; err != nil {
 		// Handle database errors
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Cannot delete user account",
-		})
+		return user, apierror.Internal("Cannot activate user")
 	}
+	middleware.InvalidateUser(user.ID)
+	user.Status = database.AccountStatusActive
+	user.ErasureRequestedAt = nil
 
-	// Set the token's expiration time to now thereby invalidating it
-	c.Cookie(&fiber.Cookie{
-		Name:     "jwt",
-		Value:    "",
-		Expires:  time.Now(),
-		HTTPOnly: true,
-	})
+	return user, nil
+}
 
-	return c.JSON(fiber.Map{
-		"success": true,
-		"message": "User account deleted successfully",
-	})
+func DeleteAccountHandler(c *fiber.Ctx) error {
+	// Get the "id" URL parameter and convert it to a uint
+	id, ok := middleware.UserIDParam(c, "id")
+	if !ok {
+		// Handle invalid ID format
+		return apierror.BadRequest("Invalid ID format")
+	}
+
+	// Users can only delete their own account
+	if userID, ok := middleware.CurrentUserID(c); !ok || userID != id {
+		return apierror.Forbidden("You can only delete your own account")
+	}
+
+	// Deactivate the account now and erase its data after the grace period
+	return requestErasure(c, id)
 }
 
 // Get users name
 func GetUserNameHandler(c *fiber.Ctx) error {
-	// Parse the user ID from the JWT token
-	token := c.Locals("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-	userID := uint(claims["user_id"].(float64))
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, userID).Error; err != nil {
+	if err := database.WithContext(c.UserContext()).First(&user, userID).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return apierror.NotFound("User not found")
 	}
 
 	return c.JSON(fiber.Map{
@@ -304,18 +416,17 @@ func GetUserNameHandler(c *fiber.Ctx) error {
 
 // User Home Page - Send the name of the logged in user in the response body
 func UserHomePageHandler(c *fiber.Ctx) error {
-	// Parse the user ID from the JWT token
-	token := c.Locals("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-	userID := uint(claims["user_id"].(float64))
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, userID).Error; err != nil {
+	if err := database.WithContext(c.UserContext()).First(&user, userID).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return apierror.NotFound("User not found")
 	}
 
 	return c.JSON(fiber.Map{
@@ -325,6 +436,13 @@ func UserHomePageHandler(c *fiber.Ctx) error {
 }
 
 func LogoutHandler(c *fiber.Ctx) error {
+	// End the session, so its tokens cannot be used or refreshed any more
+	if claims, ok := middleware.Claims(c); ok && claims.SessionID != "" {
+		if err := sessions.Revoke(c.UserContext(), claims.SessionID); err != nil {
+			return apierror.Internal("Cannot log out")
+		}
+	}
+
 	// Set the token's expiration time to now thereby invalidating it
 	c.Cookie(&fiber.Cookie{
 		Name:     "jwt",
@@ -342,22 +460,17 @@ func LogoutHandler(c *fiber.Ctx) error {
 
 func Profile(c *fiber.Ctx) error {
 	// Get the "id" URL parameter and convert it to a uint
-	idStr := c.Params("id")
-	id, err := strconv.ParseUint(idStr, 10, 32)
-	if err != nil {
+	id, ok := middleware.UserIDParam(c, "id")
+	if !ok {
 		// Handle invalid ID format
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
+		return apierror.BadRequest("Invalid ID format")
 	}
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, uint(id)).Error; err != nil {
+	if err := database.WithContext(c.UserContext()).First(&user, id).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return apierror.NotFound("User not found")
 	}
 
 	return c.JSON(user)
@@ -365,31 +478,40 @@ func Profile(c *fiber.Ctx) error {
 
 func UpdateProfile(c *fiber.Ctx) error {
 	// Get the "id" URL parameter and convert it to a uint
-	idStr := c.Params("id")
-	id, err := strconv.ParseUint(idStr, 10, 32)
-	if err != nil {
+	id, ok := middleware.UserIDParam(c, "id")
+	if !ok {
 		// Handle invalid ID format
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
+		return apierror.BadRequest("Invalid ID format")
+	}
+
+	user, err := updateProfile(c, id)
+	if err != nil {
+		return err
+	}
+
+	message := "User profile updated successfully"
+	if user.Status == database.AccountStatusPendingVerification {
+		message = "User profile updated, check your email to verify the new address"
 	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": message,
+	})
+}
 
+// updateProfile changes the profile fields set in the request body
+func updateProfile(c *fiber.Ctx, id uint) (database.User, error) {
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, uint(id)).Error; err != nil {
+	if err := database.WithContext(c.UserContext()).First(&user, id).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return user, apierror.NotFound("User not found")
 	}
 
 	var userData database.User
 
 	if err := c.BodyParser(&userData); err != nil {
-		return c.Status(400).JSON(fiber.Map{
-			"success": false,
-			"message": "Cannot parse JSON",
-		})
+		return user, apierror.InvalidBody()
 	}
 
 	// Update the user's first name if it's provided in the request
@@ -402,9 +524,23 @@ func UpdateProfile(c *fiber.Ctx) error {
 		user.LastName = userData.LastName
 	}
 
-	// Update the user's email if it's provided in the request
-	if userData.Email != "" {
+	// A new email address has to be verified before the account can be used
+	// again, so a typo or someone else's address cannot take it over
+	emailChanged := userData.Email != "" && userData.Email != user.Email
+	if emailChanged {
+		// Emails must stay unique, as on registration
+		var existing database.User
+		if err := database.WithContext(c.UserContext()).Where("email = ?", userData.Email).First(&existing).Error; err == nil {
+			return user, apierror.Conflict("Email already in use")
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return user, apierror.Internal("Cannot update user's profile")
+		}
+
 		user.Email = userData.Email
+		user.EmailVerifiedAt = nil
+		if user.Status == database.AccountStatusActive {
+			user.Status = database.AccountStatusPendingVerification
+		}
 	}
 
 	// Update the user's password if it's provided in the request
@@ -412,34 +548,34 @@ func UpdateProfile(c *fiber.Ctx) error {
 		// Hash the new password
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(userData.Password), 10)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{
-				"success": false,
-				"message": "Cannot hash password",
-			})
+			return user, apierror.Internal("Cannot hash password")
 		}
 		user.Password = hashedPassword
 	}
 
-	if err := database.GetDB().Save(&user).Error; err != nil {
+	if err := database.WithContext(c.UserContext()).Save(&user).Error; err != nil {
 		// Handle database errors
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Cannot update user's profile",
-		})
+		return user, apierror.Internal("Cannot update user's profile")
 	}
 
-	return c.JSON(fiber.Map{
-		"success": true,
-		"message": "User profile updated successfully",
-	})
+	if emailChanged {
+		// The tokens issued for the old address must not keep working
+		if err := endSessions(c.UserContext(), user.ID); err != nil {
+			return user, apierror.Internal("Cannot log out existing sessions")
+		}
+		if err := sendVerificationEmail(c.UserContext(), user); err != nil {
+			logging.FromContext(c.UserContext()).Error("Failed to send verification email", "user_id", user.ID, "error", err)
+		}
+	}
+
+	return user, nil
 }
 
 // Create a new book
 func CreateBookHandler(c *fiber.Ctx) error {
 	var newBook database.Book
 	if err := c.BodyParser(&newBook); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid input data",
-		})
+		return apierror.InvalidBody()
 	}
 
 	// Generate a random numeric book ID
@@ -450,25 +586,20 @@ func CreateBookHandler(c *fiber.Ctx) error {
 	newBook.ID = bookID
 
 	// Save the new book to the database
-	if err := database.GetDB().Create(&newBook).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create book",
-		})
+	if err := database.WithContext(c.UserContext()).Create(&newBook).Error; err != nil {
+		return apierror.Internal("Failed to create book")
 	}
+	setLocation(c, newBook.ID)
 	return c.JSON(newBook)
 }
 
 // Get a list of all books or a single book by ID
 func GetAllBooksHandler(c *fiber.Ctx) error {
-	id := c.Params("id")
-
-	if id == "" {
+	if c.Params("id") == "" {
 		// No ID parameter, fetch all books
 		var books []database.Book
-		if err := database.GetDB().Find(&books).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to fetch books",
-			})
+		if err := database.WithContext(c.UserContext()).Find(&books).Error; err != nil {
+			return apierror.Internal("Failed to fetch books")
 		}
 		// Return books as a JSON object with a 'books' property
 		return c.JSON(fiber.Map{
@@ -477,45 +608,50 @@ func GetAllBooksHandler(c *fiber.Ctx) error {
 	}
 
 	// ID parameter is present, fetch a single book by ID
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
 	var book database.Book
-	if err := database.GetDB().First(&book, id).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
+	if err := database.WithContext(c.UserContext()).First(&book, id).Error; err != nil {
+		return apierror.NotFound("Book not found")
 	}
 	return c.JSON(book)
 }
 
 // Get a single book by ID
 func GetBookByIDHandler(c *fiber.Ctx) error {
-	id := c.Params("id")
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
 	var book database.Book
-	if err := database.GetDB().First(&book, id).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
+	if err := database.WithContext(c.UserContext()).First(&book, id).Error; err != nil {
+		return apierror.NotFound("Book not found")
 	}
 	return c.JSON(book)
 }
 
 // Update a book by ID
 func UpdateBookHandler(c *fiber.Ctx) error {
-	id := c.Params("id")
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
 	var updatedBook database.Book
 	if err := c.BodyParser(&updatedBook); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid input data",
-		})
+		return apierror.InvalidBody()
 	}
 
 	// Find the book in the database
 	var book database.Book
-	if err := database.GetDB().First(&book, id).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
+	if err := database.WithContext(c.UserContext()).First(&book, id).Error; err != nil {
+		return apierror.NotFound("Book not found")
 	}
 
+	// Keep the previous state around to detect price drops and restocks
+	before := book
+
 	// Update the book's information
 	book.Title = updatedBook.Title
 	book.Author = updatedBook.Author
@@ -528,10 +664,13 @@ func UpdateBookHandler(c *fiber.Ctx) error {
 	book.Path = updatedBook.Path
 
 	// Save the updated book to the database
-	if err := database.GetDB().Save(&book).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update book",
-		})
+	if err := database.WithContext(c.UserContext()).Save(&book).Error; err != nil {
+		return apierror.Internal("Failed to update book")
+	}
+
+	// Let users watching this book know about price drops and restocks
+	if err := notifications.BookUpdated(c.UserContext(), before, book); err != nil {
+		logging.FromContext(c.UserContext()).Error("Failed to queue notifications", "book_id", book.ID, "error", err)
 	}
 
 	return c.JSON(book)
@@ -539,21 +678,20 @@ func UpdateBookHandler(c *fiber.Ctx) error {
 
 // Delete a book by ID
 func DeleteBookHandler(c *fiber.Ctx) error {
-	id := c.Params("id")
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
 
 	// Find the book in the database
 	var book database.Book
-	if err := database.GetDB().First(&book, id).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
+	if err := database.WithContext(c.UserContext()).First(&book, id).Error; err != nil {
+		return apierror.NotFound("Book not found")
 	}
 
 	// Delete the book from the database
-	if err := database.GetDB().Delete(&book).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to delete book",
-		})
+	if err := database.WithContext(c.UserContext()).Delete(&book).Error; err != nil {
+		return apierror.Internal("Failed to delete book")
 	}
 
 	return c.JSON(fiber.Map{
@@ -565,46 +703,347 @@ func DeleteBookHandler(c *fiber.Ctx) error {
 // Get all users
 func GetAllUsersHandler(c *fiber.Ctx) error {
 	var users []database.User
-	if err := database.GetDB().Find(&users).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch users",
-		})
+	if err := database.WithContext(c.UserContext()).Find(&users).Error; err != nil {
+		return apierror.Internal("Failed to fetch users")
 	}
 	return c.JSON(users)
 }
 
 // Get a single user by ID
 func GetUserByIDHandler(c *fiber.Ctx) error {
-	id := c.Params("id")
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
 	var user database.User
-	if err := database.GetDB().First(&user, id).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+	if err := database.WithContext(c.UserContext()).First(&user, id).Error; err != nil {
+		return apierror.NotFound("User not found")
+	}
+	return c.JSON(user)
+}
+
+// Suspend a user's account with a reason
+func SuspendUserHandler(c *fiber.Ctx) error {
+	var input struct {
+		Reason string `json:"reason" validate:"required"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	id, ok := middleware.UserIDParam(c, "id")
+	if !ok {
+		return apierror.BadRequest("Invalid ID format")
+	}
+
+	user, err := suspendAccount(c, id, input.Reason)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(user)
+}
+
+// suspendAccount suspends an account for the given reason
+func suspendAccount(c *fiber.Ctx, id uint, reason string) (database.User, error) {
+	var user database.User
+	if err := database.WithContext(c.UserContext()).First(&user, id).Error; err != nil {
+		return user, apierror.NotFound("User not found")
 	}
+
+	now := time.Now()
+	if err := database.WithContext(c.UserContext()).Model(&user).Updates(map[string]interface{}{
+		"status":           database.AccountStatusSuspended,
+		"suspended_reason": reason,
+		"suspended_at":     now,
+	}).Error; err != nil {
+		return user, apierror.Internal("Cannot suspend user")
+	}
+	if err := endSessions(c.UserContext(), user.ID); err != nil {
+		return user, apierror.Internal("Cannot log out existing sessions")
+	}
+	if err := revokeAPIKeys(c.UserContext(), user.ID); err != nil {
+		return user, apierror.Internal("Cannot revoke API keys")
+	}
+	user.Status = database.AccountStatusSuspended
+	user.SuspendedReason = reason
+	user.SuspendedAt = &now
+
+	return user, nil
+}
+
+// Lift the suspension of a user's account
+func UnsuspendUserHandler(c *fiber.Ctx) error {
+	id, ok := middleware.UserIDParam(c, "id")
+	if !ok {
+		return apierror.BadRequest("Invalid ID format")
+	}
+
+	user, err := unsuspendAccount(c, id)
+	if err != nil {
+		return err
+	}
+
 	return c.JSON(user)
 }
 
-// Create JWT token
-func CreateToken(userID uint) (string, error) {
-	// Define the payload
-	payload := jwt.MapClaims{}
-	payload["user_id"] = userID
-	payload["exp"] = time.Now().Add(time.Hour * 24).Unix() // 24 hours
+// unsuspendAccount lifts the suspension of an account
+func unsuspendAccount(c *fiber.Ctx, id uint) (database.User, error) {
+	var user database.User
+	if err := database.WithContext(c.UserContext()).First(&user, id).Error; err != nil {
+		return user, apierror.NotFound("User not found")
+	}
+
+	if user.Status != database.AccountStatusSuspended {
+		return user, apierror.Conflict("Account is not suspended")
+	}
 
-	// Create the token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, payload)
+	if err := database.WithContext(c.UserContext()).Model(&user).Updates(map[string]interface{}{
+		"status":           database.AccountStatusActive,
+		"suspended_reason": "",
+		"suspended_at":     nil,
+	}).Error; err != nil {
+		return user, apierror.Internal("Cannot unsuspend user")
+	}
+	middleware.InvalidateUser(user.ID)
+	user.Status = database.AccountStatusActive
+	user.SuspendedReason = ""
+	user.SuspendedAt = nil
 
-	// Generate the encoded token
-	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	return user, nil
+}
+
+// Change a user's role. The user is logged out everywhere and has to log in
+// again to get tokens with the new role.
+func UpdateUserRoleHandler(c *fiber.Ctx) error {
+	var input struct {
+		Role database.UserRole `json:"role" validate:"required,oneof=admin user"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+	var user database.User
+	if err := database.WithContext(c.UserContext()).First(&user, id).Error; err != nil {
+		return apierror.NotFound("User not found")
+	}
+
+	// Roles are changed by people, not scripts
+	adminID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return apierror.Forbidden("API keys cannot change roles")
+	}
+	// Keep admins from locking themselves out
+	if adminID == user.ID {
+		return apierror.Conflict("You cannot change your own role")
+	}
+
+	if err := database.WithContext(c.UserContext()).Model(&user).Update("role", input.Role).Error; err != nil {
+		return apierror.Internal("Cannot update role")
+	}
+	if err := endSessions(c.UserContext(), user.ID); err != nil {
+		return apierror.Internal("Cannot log out existing sessions")
+	}
+	if input.Role != database.UserRoleAdmin {
+		if err := revokeAPIKeys(c.UserContext(), user.ID); err != nil {
+			return apierror.Internal("Cannot revoke API keys")
+		}
+	}
+	user.Role = input.Role
+
+	return c.JSON(user)
+}
+
+// Unlock an account that was locked out after too many failed logins
+func UnlockAccountHandler(c *fiber.Ctx) error {
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+	var user database.User
+	if err := database.WithContext(c.UserContext()).First(&user, id).Error; err != nil {
+		return apierror.NotFound("User not found")
+	}
+
+	// Both steps of the login may have locked the account
+	auth.AccountThrottle.Reset(auth.AccountKey(user.Email))
+	auth.AccountThrottle.Reset(auth.TwoFactorKey(user.ID))
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Account unlocked successfully",
+	})
+}
+
+// Serve the public keys tokens are signed with, so other services can verify
+// them without a shared secret
+func JWKSHandler(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(auth.Keys().JWKS())
+}
+
+// Exchange a refresh token for a new access token carrying the user's
+// current role, and for a new refresh token replacing the used one
+func RefreshTokenHandler(c *fiber.Ctx) error {
+	var input struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	claims, err := auth.ParseToken(input.RefreshToken)
+	if err != nil || !claims.HasScope(auth.ScopeRefresh) {
+		return apierror.Unauthorized("Invalid or expired refresh token")
+	}
+
+	// Every refresh hands out a new refresh token for the same session; the
+	// session ends on logout, password resets and the like, or when a
+	// refresh token is used twice
+	userID, _ := claims.UserID()
+	next, err := auth.NewClaims(userID, "", config.Get().Auth.RefreshTokenTTL, auth.ScopeRefresh)
+	if err != nil {
+		return apierror.Internal("Cannot refresh token")
+	}
+	next.SessionID = claims.SessionID
+	next.ExpiresAt = claims.ExpiresAt
+	next.MFA = claims.MFA
+
+	if err := sessions.Rotate(c.UserContext(), claims.SessionID, userID, claims.ID, next.ID); err != nil {
+		if errors.Is(err, sessions.ErrInactive) || errors.Is(err, sessions.ErrReused) {
+			return apierror.Unauthorized("Invalid or expired refresh token")
+		}
+		return apierror.Internal("Cannot refresh token")
+	}
+	refreshToken, err := signToken(next)
+	if err != nil {
+		return apierror.Internal("Cannot refresh token")
+	}
+
+	// Read the user from the database so the new token has the current role
+	var user database.User
+	if err := database.WithContext(c.UserContext()).First(&user, userID).Error; err != nil {
+		return apierror.Unauthorized("Invalid or expired refresh token")
+	}
+	if err := middleware.InactiveAccountError(user); err != nil {
+		return err
+	}
+
+	token, err := CreateToken(user, claims.SessionID, claims.MFA)
+	if err != nil {
+		return apierror.Internal("Cannot refresh token")
+	}
+
+	return c.JSON(fiber.Map{
+		"success":       true,
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(config.Get().Auth.AccessTokenTTL.Seconds()),
+	})
+}
+
+// Create a short-lived access token for the user. mfa records whether the
+// user passed two-factor authentication.
+func CreateToken(user database.User, sessionID string, mfa bool) (string, error) {
+	// Access tokens carry a snapshot of the user's role and permissions, so
+	// they are short-lived and renewed with the refresh token
+	claims, err := auth.NewClaims(user.ID, string(user.Role), config.Get().Auth.AccessTokenTTL, auth.ScopeAPI)
+	if err != nil {
+		return "", err
+	}
+	claims.SessionID = sessionID
+	claims.MFA = mfa
+
+	return signToken(claims)
+}
+
+// Create the tokens of a new login: an access token and a refresh token
+// sharing one session ID, and the session they can be revoked through
+func createSession(ctx context.Context, user database.User, mfa bool) (fiber.Map, error) {
+	refresh, err := auth.NewClaims(user.ID, "", config.Get().Auth.RefreshTokenTTL, auth.ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	refresh.MFA = mfa
+
+	if err := sessions.Create(ctx, refresh.SessionID, user.ID, refresh.ID, refresh.ExpiresAt.Time); err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := signToken(refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := CreateToken(user, refresh.SessionID, mfa)
+	if err != nil {
+		return nil, err
+	}
+
+	session := fiber.Map{
+		"success":       true,
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(config.Get().Auth.AccessTokenTTL.Seconds()),
+	}
+	// Tell the client the session can only activate the account again
+	if user.Status == database.AccountStatusDeactivated {
+		session["account_status"] = user.Status
+	}
+	return session, nil
+}
+
+// Create a short-lived token that only allows completing a two-factor login
+func CreatePreAuthToken(user database.User) (string, error) {
+	claims, err := auth.NewClaims(user.ID, "", 5*time.Minute, auth.ScopePreAuth)
+	if err != nil {
+		return "", err
+	}
+
+	return signToken(claims)
+}
+
+// endSessions logs the user out everywhere and drops the account from the
+// auth cache, for changes after which the tokens it holds must not be used
+func endSessions(ctx context.Context, userID uint) error {
+	middleware.InvalidateUser(userID)
+	return sessions.RevokeAll(ctx, userID)
+}
+
+func signToken(claims *auth.Claims) (string, error) {
+	// Sign with the active key; its ID goes into the "kid" header
+	return auth.Keys().Sign(claims)
 }
 
 // Create a new cart item and add it to the user's cart
 func AddToCartHandler(c *fiber.Ctx) error {
-	// Parse the user ID from the JWT token
-	token := c.Locals("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-	userID := uint(claims["user_id"].(float64))
+	// Get whose cart this is
+	userID, err := cartUserID(c)
+	if err != nil {
+		return err
+	}
 
 	// Parse the book ID and quantity from the request body
 	var cartItem struct {
@@ -613,119 +1052,154 @@ func AddToCartHandler(c *fiber.Ctx) error {
 	}
 
 	if err := c.BodyParser(&cartItem); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid input data",
-		})
+		return apierror.InvalidBody()
 	}
 
 	// Validate the input
 	if err := validate.Struct(cartItem); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error":  "Invalid input data",
-			"errors": err.(validator.ValidationErrors),
-		})
+		return apierror.Validation(err)
 	}
 
-	// Check if the book is already in the user's cart
-	var existingCartItem database.CartItem
-	if err := database.GetDB().Where("user_id = ? AND book_id = ?", userID, cartItem.BookID).First(&existingCartItem).Error; err == nil {
-		// Book is already in the cart, update the quantity
-		existingCartItem.Quantity += cartItem.Quantity
-
-		// Retrieve the book price
-		var book database.Book
-		if err := database.GetDB().First(&book, cartItem.BookID).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to fetch book details",
-			})
+	// Add the book to the cart, or bump the quantity if it is already there
+	item, err := addBookToCart(c.UserContext(), userID, cartItem.BookID, cartItem.Quantity)
+	if err != nil {
+		if err == errBookNotFound {
+			return apierror.NotFound("Book not found")
 		}
+		return apierror.Internal("Failed to add to cart")
+	}
 
-		// Calculate the subtotal and assign it to the existing cart item
-		existingCartItem.Subtotal = float64(existingCartItem.Quantity) * book.Price
+	setLocation(c, item.BookID)
+	return c.JSON(item)
+}
 
-		if err := database.GetDB().Save(&existingCartItem).Error; err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to update cart",
-			})
+// cartUserID returns whose cart the request is about: the user in the user_id
+// param, which may be "me", or else the logged in user
+func cartUserID(c *fiber.Ctx) (uint, error) {
+	if c.Params("user_id") == "" {
+		userID, ok := middleware.CurrentUserID(c)
+		if !ok {
+			return 0, middleware.Unauthorized()
 		}
-		return c.JSON(existingCartItem)
+		return userID, nil
 	}
 
-	// Book is not in the cart, create a new cart item
-	newCartItem := database.CartItem{
-		UserID:   userID,
-		BookID:   cartItem.BookID,
-		Quantity: cartItem.Quantity,
+	userID, ok := middleware.UserIDParam(c, "user_id")
+	if !ok {
+		return 0, apierror.BadRequest("Invalid user ID format")
 	}
+	return userID, nil
+}
 
+// addBookToCart adds quantity copies of a book to the user's cart, merging
+// with an existing cart item for the same book
+func addBookToCart(ctx context.Context, userID, bookID, quantity uint) (database.CartItem, error) {
+	db := database.WithContext(ctx)
 	// Retrieve the book price
 	var book database.Book
-	if err := database.GetDB().First(&book, cartItem.BookID).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch book details",
-		})
+	if err := db.First(&book, bookID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return database.CartItem{}, errBookNotFound
+		}
+		return database.CartItem{}, err
+	}
+
+	// Check if the book is already in the user's cart
+	var existingCartItem database.CartItem
+	err := db.Where("user_id = ? AND book_id = ?", userID, bookID).First(&existingCartItem).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return database.CartItem{}, err
 	}
+	if err == nil {
+		// Book is already in the cart, update the quantity and subtotal
+		existingCartItem.Quantity += quantity
+		existingCartItem.Subtotal = float64(existingCartItem.Quantity) * book.Price
 
-	// Calculate the subtotal and assign it to the new cart item
-	newCartItem.Subtotal = float64(newCartItem.Quantity) * book.Price
+		if err := db.Save(&existingCartItem).Error; err != nil {
+			return database.CartItem{}, err
+		}
+		metrics.CartAdds.Inc()
+		return existingCartItem, nil
+	}
 
-	if err := database.GetDB().Create(&newCartItem).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to add to cart",
-		})
+	// Book is not in the cart, create a new cart item
+	newCartItem := database.CartItem{
+		UserID:   userID,
+		BookID:   bookID,
+		Quantity: quantity,
+		Subtotal: float64(quantity) * book.Price,
 	}
 
-	return c.JSON(newCartItem)
+	if err := db.Create(&newCartItem).Error; err != nil {
+		return database.CartItem{}, err
+	}
+
+	metrics.CartAdds.Inc()
+	return newCartItem, nil
 }
 
 // Get the user's cart items
 func GetCartHandler(c *fiber.Ctx) error {
-	// Parse the user ID from the JWT token
-	token := c.Locals("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-	userID := uint(claims["user_id"].(float64))
+	// Get whose cart this is
+	userID, err := cartUserID(c)
+	if err != nil {
+		return err
+	}
 
 	// Find all cart items for the user
 	var cartItems []database.CartItem
-	if err := database.GetDB().Where("user_id = ?", userID).Find(&cartItems).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch cart items",
-		})
-	}
-
-	if len(cartItems) == 0 {
-		return c.JSON(fiber.Map{
-			"message": "Cart is empty",
-		})
+	if err := database.WithContext(c.UserContext()).Where("user_id = ?", userID).Find(&cartItems).Error; err != nil {
+		return apierror.Internal("Failed to fetch cart items")
 	}
 
 	// Return the cart items
 	return c.JSON(cartItems)
 }
 
+// Get a single item of the user's cart
+func GetCartItemHandler(c *fiber.Ctx) error {
+	// Get whose cart this is
+	userID, err := cartUserID(c)
+	if err != nil {
+		return err
+	}
+
+	bookID, err := idParam(c, "book_id")
+	if err != nil {
+		return err
+	}
+
+	var cartItem database.CartItem
+	if err := database.WithContext(c.UserContext()).Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
+		return apierror.NotFound("Cart item not found")
+	}
+
+	return c.JSON(cartItem)
+}
+
 // Remove an item from the user's cart
 func RemoveFromCartHandler(c *fiber.Ctx) error {
-	// Parse the user ID from the JWT token
-	token := c.Locals("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-	userID := uint(claims["user_id"].(float64))
+	// Get whose cart this is
+	userID, err := cartUserID(c)
+	if err != nil {
+		return err
+	}
 
 	// Parse the book ID from the URL parameter
-	bookID := c.Params("book_id")
+	bookID, err := idParam(c, "book_id")
+	if err != nil {
+		return err
+	}
 
 	// Find the cart item to remove
 	var cartItem database.CartItem
-	if err := database.GetDB().Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Cart item not found",
-		})
+	if err := database.WithContext(c.UserContext()).Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
+		return apierror.NotFound("Cart item not found")
 	}
 
 	// Delete the cart item
-	if err := database.GetDB().Delete(&cartItem).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to remove item from cart",
-		})
+	if err := database.WithContext(c.UserContext()).Delete(&cartItem).Error; err != nil {
+		return apierror.Internal("Failed to remove item from cart")
 	}
 
 	return c.JSON(fiber.Map{
@@ -736,13 +1210,17 @@ func RemoveFromCartHandler(c *fiber.Ctx) error {
 
 // Update the quantity of a cart item
 func UpdateCartItemQuantityHandler(c *fiber.Ctx) error {
-	// Parse the user ID from the JWT token
-	token := c.Locals("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-	userID := uint(claims["user_id"].(float64))
+	// Get whose cart this is
+	userID, err := cartUserID(c)
+	if err != nil {
+		return err
+	}
 
 	// Parse the book ID from the URL parameter
-	bookID := c.Params("book_id")
+	bookID, err := idParam(c, "book_id")
+	if err != nil {
+		return err
+	}
 
 	// Parse the new quantity from the request body
 	var update struct {
@@ -750,33 +1228,24 @@ func UpdateCartItemQuantityHandler(c *fiber.Ctx) error {
 	}
 
 	if err := c.BodyParser(&update); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid input data",
-		})
+		return apierror.InvalidBody()
 	}
 
 	// Validate the input
 	if err := validate.Struct(update); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error":  "Invalid input data",
-			"errors": err.(validator.ValidationErrors),
-		})
+		return apierror.Validation(err)
 	}
 
 	// Find the cart item to update
 	var cartItem database.CartItem
-	if err := database.GetDB().Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Cart item not found",
-		})
+	if err := database.WithContext(c.UserContext()).Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
+		return apierror.NotFound("Cart item not found")
 	}
 
 	// Update the quantity
 	cartItem.Quantity = update.Quantity
-	if err := database.GetDB().Save(&cartItem).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update cart item quantity",
-		})
+	if err := database.WithContext(c.UserContext()).Save(&cartItem).Error; err != nil {
+		return apierror.Internal("Failed to update cart item quantity")
 	}
 
 	return c.JSON(cartItem)
@@ -785,82 +1254,131 @@ func UpdateCartItemQuantityHandler(c *fiber.Ctx) error {
 // Add a review for a book
 func AddReviewHandler(c *fiber.Ctx) error {
 	// Parse the book ID from the URL parameter
-	bookIDStr := c.Params("book_id")
-
-	// Convert the book ID to a uint
-	bookID, err := strconv.ParseUint(bookIDStr, 10, 32)
+	bookID, err := idParam(c, "book_id")
 	if err != nil {
-		// Handle invalid ID format
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid ID format",
-		})
+		return err
 	}
 
-	// Convert the book ID to a uint
-	bookIDUint := uint(bookID)
-
-	// Parse the user ID from the JWT token
-	token := c.Locals("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-	userID := uint(claims["user_id"].(float64))
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
 
 	// Check if the user has already reviewed the book
 	var existingReview database.Review
-	if err := database.GetDB().Where("user_id = ? AND book_id = ?", userID, bookIDUint).First(&existingReview).Error; err == nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "You have already reviewed this book",
-		})
+	if err := database.WithContext(c.UserContext()).Where("user_id = ? AND book_id = ?", userID, bookID).First(&existingReview).Error; err == nil {
+		return apierror.BadRequest("You have already reviewed this book")
 	}
 
 	// Check if the book exists
 	var book database.Book
-	if err := database.GetDB().First(&book, bookIDUint).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
+	if err := database.WithContext(c.UserContext()).First(&book, bookID).Error; err != nil {
+		return apierror.NotFound("Book not found")
 	}
 
 	// Check if the user exists
 	var user database.User
-	if err := database.GetDB().First(&user, userID).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+	if err := database.WithContext(c.UserContext()).First(&user, userID).Error; err != nil {
+		return apierror.NotFound("User not found")
 	}
 
 	// Parse the review data from the request body
 	var review database.Review
 	if err := c.BodyParser(&review); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid input data",
-		})
+		return apierror.InvalidBody()
 	}
 
 	// Set the book ID and user ID
-	review.BookID = bookIDUint
+	review.BookID = bookID
 	review.UserID = userID
 
 	// Save the review to the database
-	if err := database.GetDB().Create(&review).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to add review",
-		})
+	if err := database.WithContext(c.UserContext()).Create(&review).Error; err != nil {
+		return apierror.Internal("Failed to add review")
 	}
 
 	// Fetch the review again from the database to get the created_at value
-	if err := database.GetDB().Where("id = ?", review.ID).First(&review).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch review",
-		})
+	if err := database.WithContext(c.UserContext()).Where("id = ?", review.ID).First(&review).Error; err != nil {
+		return apierror.Internal("Failed to fetch review")
 	}
 
+	setLocation(c, review.ID)
 	return c.JSON(review)
 }
 
+// Get a single review of a book
+func GetReviewHandler(c *fiber.Ctx) error {
+	bookID, err := idParam(c, "book_id")
+	if err != nil {
+		return err
+	}
+	reviewID, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	var review database.Review
+	if err := database.WithContext(c.UserContext()).Where("book_id = ?", bookID).First(&review, reviewID).Error; err != nil {
+		return apierror.NotFound("Review not found")
+	}
+
+	return c.JSON(review)
+}
+
+// Remove a review that breaks the rules and tell its author
+func RemoveReviewHandler(c *fiber.Ctx) error {
+	bookID, err := idParam(c, "book_id")
+	if err != nil {
+		return err
+	}
+	reviewID, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	// The reason is optional and shown to the author
+	var input struct {
+		Reason string `json:"reason" validate:"max=500"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&input); err != nil {
+			return apierror.InvalidBody()
+		}
+	}
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	var review database.Review
+	if err := database.WithContext(c.UserContext()).Where("id = ? AND book_id = ?", reviewID, bookID).First(&review).Error; err != nil {
+		return apierror.NotFound("Review not found")
+	}
+
+	var book database.Book
+	if err := database.WithContext(c.UserContext()).Where("id = ?", bookID).First(&book).Error; err != nil {
+		return apierror.NotFound("Book not found")
+	}
+
+	if err := database.WithContext(c.UserContext()).Delete(&review).Error; err != nil {
+		return apierror.Internal("Failed to remove review")
+	}
+
+	notifications.ReviewRemoved(review, book, input.Reason)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Review removed successfully",
+	})
+}
+
 // Get reviews for a book with user names
 func GetBookReviewsHandler(c *fiber.Ctx) error {
 	// Parse the book ID from the URL parameter
-	bookID := c.Params("book_id")
+	bookID, err := idParam(c, "book_id")
+	if err != nil {
+		return err
+	}
 
 	// Find all reviews for the book and include user information
 	var reviews []struct {
@@ -868,20 +1386,12 @@ func GetBookReviewsHandler(c *fiber.Ctx) error {
 		FirstName string `json:"first_name"`
 		CreatedAt string `json:"created_at"`
 	}
-	if err := database.GetDB().Table("reviews").
+	if err := database.WithContext(c.UserContext()).Table("reviews").
 		Select("reviews.*, users.first_name, reviews.created_at").
 		Joins("LEFT JOIN users ON users.id = reviews.user_id").
 		Where("reviews.book_id = ?", bookID).
 		Scan(&reviews).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch reviews",
-		})
-	}
-
-	if len(reviews) == 0 {
-		return c.JSON(fiber.Map{
-			"message": "No reviews for this book",
-		})
+		return apierror.Internal("Failed to fetch reviews")
 	}
 
 	// Return the reviews with user first names and CreatedAt
@@ -890,20 +1400,22 @@ func GetBookReviewsHandler(c *fiber.Ctx) error {
 
 func DownloadBookHandler(c *fiber.Ctx) error {
 	// Parse the book ID from the URL parameter
-	bookID := c.Params("id")
+	bookID, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
 
 	// Find the book in the database by ID
 	var book database.Book
-	if err := database.GetDB().First(&book, bookID).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Book not found",
-		})
+	if err := database.WithContext(c.UserContext()).First(&book, bookID).Error; err != nil {
+		return apierror.NotFound("Book not found")
 	}
 
 	// Get the file path
 	filePath := book.Path
 
 	// send the file path as a response
+	metrics.Downloads.Inc()
 	return c.JSON(fiber.Map{
 		"file_path": filePath,
 	})
@@ -912,16 +1424,8 @@ func DownloadBookHandler(c *fiber.Ctx) error {
 // Cart section for admin to see all the users cart items
 func GetAllCartItemsHandler(c *fiber.Ctx) error {
 	var cartItems []database.CartItem
-	if err := database.GetDB().Find(&cartItems).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch cart items",
-		})
-	}
-
-	if len(cartItems) == 0 {
-		return c.JSON(fiber.Map{
-			"message": "Cart is empty",
-		})
+	if err := database.WithContext(c.UserContext()).Find(&cartItems).Error; err != nil {
+		return apierror.Internal("Failed to fetch cart items")
 	}
 
 	// Return the cart items
@@ -931,20 +1435,15 @@ func GetAllCartItemsHandler(c *fiber.Ctx) error {
 // Get a user's cart items
 func GetUserCartHandler(c *fiber.Ctx) error {
 	// Parse the user ID from the URL parameter
-	userID := c.Params("user_id")
+	userID, err := cartUserID(c)
+	if err != nil {
+		return err
+	}
 
 	// Find all cart items for the user
 	var cartItems []database.CartItem
-	if err := database.GetDB().Where("user_id = ?", userID).Find(&cartItems).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch cart items",
-		})
-	}
-
-	if len(cartItems) == 0 {
-		return c.JSON(fiber.Map{
-			"message": "Cart is empty",
-		})
+	if err := database.WithContext(c.UserContext()).Where("user_id = ?", userID).Find(&cartItems).Error; err != nil {
+		return apierror.Internal("Failed to fetch cart items")
 	}
 
 	// Return the cart items
@@ -954,24 +1453,26 @@ func GetUserCartHandler(c *fiber.Ctx) error {
 // Remove an item from the user's cart
 func DeleteCartItemHandler(c *fiber.Ctx) error {
 	// Parse the user ID from the URL parameter
-	userID := c.Params("user_id")
+	userID, err := cartUserID(c)
+	if err != nil {
+		return err
+	}
 
 	// Parse the book ID from the URL parameter
-	bookID := c.Params("book_id")
+	bookID, err := idParam(c, "book_id")
+	if err != nil {
+		return err
+	}
 
 	// Find the cart item to remove
 	var cartItem database.CartItem
-	if err := database.GetDB().Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Cart item not found",
-		})
+	if err := database.WithContext(c.UserContext()).Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
+		return apierror.NotFound("Cart item not found")
 	}
 
 	// Delete the cart item
-	if err := database.GetDB().Delete(&cartItem).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to remove item from cart",
-		})
+	if err := database.WithContext(c.UserContext()).Delete(&cartItem).Error; err != nil {
+		return apierror.Internal("Failed to remove item from cart")
 	}
 
 	return c.JSON(fiber.Map{
@@ -980,21 +1481,21 @@ func DeleteCartItemHandler(c *fiber.Ctx) error {
 	})
 }
 
-
 // Get the role of the user from the database
-func GetUserRoleHandler (c *fiber.Ctx) error {
+func GetUserRoleHandler(c *fiber.Ctx) error {
 	// Parse the user ID from the URL parameter
-	userID := c.Params("id")
+	userID, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
 
 	// Find the user in the database
 	var user database.User
-	if err := database.GetDB().First(&user, userID).Error; err != nil {
+	if err := database.WithContext(c.UserContext()).First(&user, userID).Error; err != nil {
 		// Handle database errors (e.g., no user with the given ID)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
+		return apierror.NotFound("User not found")
 	}
-    return c.JSON(fiber.Map{
-        "role": user.Role,
-    })
-}
\ No newline at end of file
+	return c.JSON(fiber.Map{
+		"role": user.Role,
+	})
+}
@@ -0,0 +1,359 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/mailer"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+func TestSuspendAndUnsuspend(t *testing.T) {
+	app := newTestApp(t)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	password, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	database.GetDB().Model(&user).Update("password", password)
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	suspend := fmt.Sprintf("/api/v1/admin/user/%d/suspend", user.ID)
+	unsuspend := fmt.Sprintf("/api/v1/admin/user/%d/unsuspend", user.ID)
+
+	// Lifting a suspension that does not exist is a conflict
+	if status := doRequest(t, app, "PUT", unsuspend, adminToken, nil, nil); status != fiber.StatusConflict {
+		t.Errorf("Expected unsuspending an active account to answer 409, got %d", status)
+	}
+
+	var suspended database.User
+	if status := doRequest(t, app, "PUT", suspend, adminToken, map[string]string{"reason": "Spam"}, &suspended); status != fiber.StatusOK {
+		t.Fatalf("Expected suspending to answer 200, got %d", status)
+	}
+	if suspended.Status != database.AccountStatusSuspended || suspended.SuspendedReason != "Spam" || suspended.SuspendedAt == nil {
+		t.Errorf("Expected a suspension for spam, got %+v", suspended)
+	}
+
+	// The user is logged out right away and told why on the next login
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", token, nil, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected a suspended user's token to be refused with 401, got %d", status)
+	}
+	var problem apierror.Error
+	if status := doRequest(t, app, "POST", "/api/v1/login", "", map[string]string{"email": user.Email, "password": "secret"}, &problem); status != fiber.StatusForbidden {
+		t.Errorf("Expected a suspended user's login to get 403, got %d", status)
+	}
+	if problem.Code != apierror.CodeAccountSuspended {
+		t.Errorf("Expected code %s, got %s", apierror.CodeAccountSuspended, problem.Code)
+	}
+
+	var lifted database.User
+	if status := doRequest(t, app, "PUT", unsuspend, adminToken, nil, &lifted); status != fiber.StatusOK {
+		t.Fatalf("Expected unsuspending to answer 200, got %d", status)
+	}
+	if lifted.Status != database.AccountStatusActive || lifted.SuspendedReason != "" || lifted.SuspendedAt != nil {
+		t.Errorf("Expected an active account without a suspension, got %+v", lifted)
+	}
+
+	// Suspensions need a reason
+	if status := doRequest(t, app, "PUT", suspend, adminToken, map[string]string{}, nil); status != fiber.StatusBadRequest {
+		t.Errorf("Expected a suspension without a reason to answer 400, got %d", status)
+	}
+	// and only admins can suspend
+	session, err := createSession(context.Background(), lifted, false)
+	if err != nil {
+		t.Fatalf("Creating a session failed: %v", err)
+	}
+	if status := doRequest(t, app, "PUT", suspend, session["token"].(string), map[string]string{"reason": "Spam"}, nil); status != fiber.StatusForbidden {
+		t.Errorf("Expected a user to get 403, got %d", status)
+	}
+}
+
+func TestDeactivateAndReactivate(t *testing.T) {
+	app := newTestApp(t)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	other, _ := createTestUser(t, "other@example.com", database.UserRoleStandard)
+	password, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	database.GetDB().Model(&user).Update("password", password)
+
+	if status := doRequest(t, app, "PUT", fmt.Sprintf("/api/v1/user/deactivate/%d", user.ID), token, nil, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected deactivating to answer 200, got %d", status)
+	}
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", token, nil, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected deactivating to end the session with 401, got %d", status)
+	}
+
+	// Deactivated users can still log in, but only to activate the account
+	var session struct {
+		Token         string `json:"token"`
+		AccountStatus string `json:"account_status"`
+	}
+	if status := doRequest(t, app, "POST", "/api/v1/login", "", map[string]string{"email": user.Email, "password": "secret"}, &session); status != fiber.StatusOK {
+		t.Fatalf("Expected a deactivated user to log in, got %d", status)
+	}
+	if session.AccountStatus != string(database.AccountStatusDeactivated) {
+		t.Errorf("Expected the login to tell the account is deactivated, got %q", session.AccountStatus)
+	}
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", session.Token, nil, nil); status != fiber.StatusForbidden {
+		t.Errorf("Expected the new token to be refused elsewhere, got %d", status)
+	}
+
+	// Nobody activates someone else's account through the user route
+	if status := doRequest(t, app, "PUT", fmt.Sprintf("/api/v1/user/activate/%d", other.ID), session.Token, nil, nil); status != fiber.StatusForbidden {
+		t.Errorf("Expected activating another account to answer 403, got %d", status)
+	}
+
+	if status := doRequest(t, app, "PUT", fmt.Sprintf("/api/v1/user/activate/%d", user.ID), session.Token, nil, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected activating to answer 200, got %d", status)
+	}
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", session.Token, nil, nil); status != fiber.StatusOK {
+		t.Errorf("Expected the token to work once the account is active, got %d", status)
+	}
+
+	// Active accounts cannot be activated again
+	if status := doRequest(t, app, "PUT", fmt.Sprintf("/api/v1/user/activate/%d", user.ID), session.Token, nil, nil); status != fiber.StatusConflict {
+		t.Errorf("Expected activating an active account to answer 409, got %d", status)
+	}
+}
+
+func TestReactivateThroughV2(t *testing.T) {
+	app := newTestApp(t)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	other, _ := createTestUser(t, "other@example.com", database.UserRoleStandard)
+	password, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	database.GetDB().Model(&user).Update("password", password)
+
+	if status := doRequest(t, app, "PUT", "/api/v2/users/me/status", token, map[string]string{"status": "deactivated"}, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected deactivating to answer 200, got %d", status)
+	}
+
+	var session struct {
+		Token string `json:"token"`
+	}
+	if status := doRequest(t, app, "POST", "/api/v2/login", "", map[string]string{"email": user.Email, "password": "secret"}, &session); status != fiber.StatusOK {
+		t.Fatalf("Expected a deactivated user to log in, got %d", status)
+	}
+	if status := doRequest(t, app, "PUT", "/api/v2/users/me/status", session.Token, map[string]string{"status": "active"}, nil); status != fiber.StatusForbidden {
+		t.Errorf("Expected the status route to refuse a deactivated account, got %d", status)
+	}
+	if status := doRequest(t, app, "POST", fmt.Sprintf("/api/v2/users/%d/reactivation", other.ID), session.Token, nil, nil); status != fiber.StatusForbidden {
+		t.Errorf("Expected activating another account to answer 403, got %d", status)
+	}
+
+	var activated database.User
+	if status := doRequest(t, app, "POST", "/api/v2/users/me/reactivation", session.Token, nil, &activated); status != fiber.StatusOK {
+		t.Fatalf("Expected activating to answer 200, got %d", status)
+	}
+	if activated.Status != database.AccountStatusActive {
+		t.Errorf("Expected the account to be active, got %q", activated.Status)
+	}
+	if status := doRequest(t, app, "GET", "/api/v2/users/me", session.Token, nil, nil); status != fiber.StatusOK {
+		t.Errorf("Expected the token to work once the account is active, got %d", status)
+	}
+}
+
+func TestProfileIsOwnerOrAdminOnly(t *testing.T) {
+	app := newTestApp(t)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	victim, _ := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	_, adminToken := createTestUser(t, "root@example.com", database.UserRoleAdmin)
+	victimProfile := fmt.Sprintf("/api/v1/user/profile/%d", victim.ID)
+
+	// Nobody reads or takes over someone else's account through the profile
+	if status := doRequest(t, app, "GET", victimProfile, token, nil, nil); status != fiber.StatusForbidden {
+		t.Errorf("Expected reading another profile to answer 403, got %d", status)
+	}
+	if status := doRequest(t, app, "PUT", victimProfile, token, map[string]string{"email": user.Email}, nil); status != fiber.StatusForbidden {
+		t.Errorf("Expected changing another profile to answer 403, got %d", status)
+	}
+	var stored database.User
+	database.GetDB().First(&stored, victim.ID)
+	if stored.Email != victim.Email {
+		t.Errorf("Expected the email to stay %s, got %s", victim.Email, stored.Email)
+	}
+
+	if status := doRequest(t, app, "PUT", fmt.Sprintf("/api/v1/user/profile/%d", user.ID), token, map[string]string{"firstname": "Ada"}, nil); status != fiber.StatusOK {
+		t.Errorf("Expected changing the own profile to answer 200, got %d", status)
+	}
+	if status := doRequest(t, app, "GET", victimProfile, adminToken, nil, nil); status != fiber.StatusOK {
+		t.Errorf("Expected an admin to read any profile, got %d", status)
+	}
+}
+
+func TestEmailChangeNeedsVerification(t *testing.T) {
+	app := newTestApp(t)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	createTestUser(t, "taken@example.com", database.UserRoleStandard)
+	now := time.Now()
+	database.GetDB().Model(&user).Update("email_verified_at", now)
+
+	outbox := &mailer.FileMailer{Dir: t.TempDir()}
+	previous := mailer.Default()
+	mailer.SetMailer(outbox)
+	t.Cleanup(func() { mailer.SetMailer(previous) })
+
+	if status := doRequest(t, app, "PATCH", "/api/v2/users/me", token, map[string]string{"email": "taken@example.com"}, nil); status != fiber.StatusConflict {
+		t.Errorf("Expected taking another account's email to answer 409, got %d", status)
+	}
+
+	var updated database.User
+	if status := doRequest(t, app, "PATCH", "/api/v2/users/me", token, map[string]string{"email": "new@example.com"}, &updated); status != fiber.StatusOK {
+		t.Fatalf("Expected changing the email to answer 200, got %d", status)
+	}
+	if updated.Status != database.AccountStatusPendingVerification || updated.EmailVerifiedAt != nil {
+		t.Errorf("Expected the account to wait for verification, got %q verified at %v", updated.Status, updated.EmailVerifiedAt)
+	}
+
+	// The old sessions end and the new address gets the verification link
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", token, nil, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the session to end, got %d", status)
+	}
+	sent, err := os.ReadDir(outbox.Dir)
+	if err != nil || len(sent) != 1 {
+		t.Fatalf("Expected one email, got %v (%v)", sent, err)
+	}
+	mail, _ := os.ReadFile(filepath.Join(outbox.Dir, sent[0].Name()))
+	if !strings.Contains(string(mail), "To: new@example.com") {
+		t.Errorf("Expected the verification email to go to the new address, got:\n%s", mail)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	session, err := createSession(context.Background(), user, false)
+	if err != nil {
+		t.Fatalf("Creating a session failed: %v", err)
+	}
+	first := session["refresh_token"].(string)
+
+	var refreshed struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if status := doRequest(t, app, "POST", "/api/v1/token/refresh", "", map[string]string{"refresh_token": first}, &refreshed); status != fiber.StatusOK {
+		t.Fatalf("Expected refreshing to answer 200, got %d", status)
+	}
+	if refreshed.RefreshToken == "" || refreshed.RefreshToken == first {
+		t.Fatal("Expected a new refresh token")
+	}
+
+	// Replaying the used token looks like theft and ends the session
+	if status := doRequest(t, app, "POST", "/api/v1/token/refresh", "", map[string]string{"refresh_token": first}, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected a used refresh token to answer 401, got %d", status)
+	}
+	if status := doRequest(t, app, "POST", "/api/v1/token/refresh", "", map[string]string{"refresh_token": refreshed.RefreshToken}, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the session's current refresh token to stop working, got %d", status)
+	}
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", refreshed.Token, nil, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the session's access token to stop working, got %d", status)
+	}
+}
+
+func TestLogoutEndsSession(t *testing.T) {
+	app := newTestApp(t)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	other, err := createSession(context.Background(), user, false)
+	if err != nil {
+		t.Fatalf("Creating a session failed: %v", err)
+	}
+
+	if status := doRequest(t, app, "POST", "/api/v1/user/logout", token, nil, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected logging out to answer 200, got %d", status)
+	}
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", token, nil, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the token to stop working after logging out, got %d", status)
+	}
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", other["token"].(string), nil, nil); status != fiber.StatusOK {
+		t.Errorf("Expected the user's other sessions to keep working, got %d", status)
+	}
+}
+
+func TestRoleChangeEndsSessions(t *testing.T) {
+	app := newTestApp(t)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+
+	path := fmt.Sprintf("/api/v1/admin/user/%d/role", user.ID)
+	if status := doRequest(t, app, "PUT", path, adminToken, map[string]string{"role": "admin"}, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected changing the role to answer 200, got %d", status)
+	}
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", token, nil, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the old role's token to be refused with 401, got %d", status)
+	}
+}
+
+func TestAddToCartErrors(t *testing.T) {
+	app := newTestApp(t)
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "Dune", Price: 9.5})
+
+	var problem apierror.Error
+	status := doRequest(t, app, "POST", "/api/v1/user/cart", token, map[string]interface{}{"book_id": book.ID + 1, "quantity": 1}, &problem)
+	if status != fiber.StatusNotFound || problem.Detail != "Book not found" {
+		t.Errorf("Expected an unknown book to answer 404, got %d %q", status, problem.Detail)
+	}
+
+	// Failing to read the book is not the book's fault
+	err := database.GetDB().Callback().Query().Before("gorm:query").Register("fail_books", func(tx *gorm.DB) {
+		if tx.Statement.Table == "books" {
+			tx.AddError(errors.New("connection lost"))
+		}
+	})
+	if err != nil {
+		t.Fatalf("Registering the callback failed: %v", err)
+	}
+	if status := doRequest(t, app, "POST", "/api/v1/user/cart", token, map[string]interface{}{"book_id": book.ID, "quantity": 1}, nil); status != fiber.StatusInternalServerError {
+		t.Errorf("Expected a database error to answer 500, got %d", status)
+	}
+}
+
+func TestNonNumericIDs(t *testing.T) {
+	app := newTestApp(t)
+	admin, token := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	createTestBook(t, database.Book{Title: "Dune"})
+	wishlist := database.Wishlist{UserID: admin.ID, Name: "Later", ShareToken: "share"}
+	database.GetDB().Create(&wishlist)
+	items := fmt.Sprintf("/api/v1/user/wishlists/%d/items/abc", wishlist.ID)
+
+	// Not even a condition that matches every row gets past the ID parsing
+	for _, route := range []struct{ method, path string }{
+		{"GET", "/api/v1/admin/book/abc"},
+		{"PUT", "/api/v1/admin/book/1%20OR%201=1"},
+		{"DELETE", "/api/v1/admin/book/abc"},
+		{"GET", "/api/v1/admin/book/abc/download"},
+		{"GET", "/api/v1/admin/user/abc"},
+		{"PUT", "/api/v1/admin/user/abc/role"},
+		{"POST", "/api/v1/admin/user/abc/unlock"},
+		{"POST", "/api/v1/admin/user/abc/erase"},
+		{"GET", "/api/v1/admin/role/abc"},
+		{"DELETE", "/api/v1/admin/api-keys/abc"},
+		{"GET", "/api/v2/api-keys/abc"},
+		{"GET", "/api/v2/books/abc"},
+		{"GET", "/api/v2/books/1/reviews/abc"},
+		{"GET", "/api/v2/books/abc/reviews"},
+		{"GET", "/api/v1/user/book/abc/reviews"},
+		{"GET", "/api/v2/carts/me/items/abc"},
+		{"PATCH", "/api/v2/carts/me/items/abc"},
+		{"DELETE", "/api/v1/user/cart/abc"},
+		{"PUT", "/api/v1/user/cart/abc"},
+		{"POST", "/api/v1/user/cart/abc/save-for-later"},
+		{"DELETE", "/api/v1/admin/cart/1/abc"},
+		{"GET", "/api/v1/user/wishlists/abc"},
+		{"PUT", "/api/v1/user/wishlists/abc"},
+		{"DELETE", "/api/v1/user/wishlists/abc"},
+		{"POST", "/api/v1/user/wishlists/abc/items"},
+		{"DELETE", items},
+		{"POST", items + "/move-to-cart"},
+		{"PUT", "/api/v1/user/notifications/abc/read"},
+	} {
+		if status := doRequest(t, app, route.method, route.path, token, map[string]string{"role": "admin"}, nil); status != fiber.StatusBadRequest {
+			t.Errorf("%s %s: expected 400, got %d", route.method, route.path, status)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/health"
+	"github.com/mohammadshaad/golang-book-store-backend/logging"
+	"github.com/mohammadshaad/golang-book-store-backend/mailer"
+)
+
+// readinessTimeout bounds how long the readiness probe waits for its checks
+const readinessTimeout = 3 * time.Second
+
+// readinessChecks are the dependencies an instance needs to serve traffic
+var readinessChecks = []health.Check{
+	{Name: "database", Run: database.Ping},
+	{Name: "migrations", Run: checkMigrations},
+	{Name: "book_storage", Run: func(ctx context.Context) error {
+		return health.Writable(config.Get().Storage.BooksDir)
+	}},
+	{Name: "mail_storage", Run: func(ctx context.Context) error {
+		return mailer.CheckStorage()
+	}},
+}
+
+// migrationsCurrent is set once the migrations were found current. The
+// schema does not go back, so the probe stops comparing it from then on.
+var migrationsCurrent atomic.Bool
+
+// Liveness probe: the process is up and serving requests
+func HealthzHandler(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status": "ok",
+	})
+}
+
+// Readiness probe: every dependency is reachable, so traffic may be routed
+// to this instance
+func ReadyzHandler(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), readinessTimeout)
+	defer cancel()
+
+	report := health.Run(ctx, readinessChecks)
+	for name, result := range report.Checks {
+		if result.Error != "" {
+			logging.FromContext(ctx).Warn("Readiness check failed", "check", name, "error", result.Error)
+		}
+	}
+	if !report.Ready() {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(report)
+	}
+	return c.JSON(report)
+}
+
+func checkMigrations(ctx context.Context) error {
+	if migrationsCurrent.Load() {
+		return nil
+	}
+
+	db := database.GetDB()
+	if db == nil {
+		return fmt.Errorf("database is not connected")
+	}
+
+	missing, err := database.PendingMigrations(db.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	migrationsCurrent.Store(true)
+	return nil
+}
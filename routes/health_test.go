@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/health"
+)
+
+func TestReadyz(t *testing.T) {
+	app := newTestApp(t)
+	config.Get().Storage.BooksDir = t.TempDir()
+
+	var report health.Report
+	if status := doRequest(t, app, "GET", "/readyz", "", nil, &report); status != fiber.StatusOK {
+		t.Fatalf("Expected the app to be ready, got %d: %+v", status, report)
+	}
+	for _, name := range []string{"database", "migrations", "book_storage", "mail_storage"} {
+		if report.Checks[name].Status != "ok" {
+			t.Errorf("Expected the %s check to pass, got %+v", name, report.Checks[name])
+		}
+	}
+
+	// Book files cannot be stored where a file is in the way
+	blocked := filepath.Join(t.TempDir(), "books")
+	if err := os.WriteFile(blocked, nil, 0o644); err != nil {
+		t.Fatalf("Creating the file failed: %v", err)
+	}
+	config.Get().Storage.BooksDir = blocked
+
+	// The probe is public, so it tells which check failed but not why
+	var body struct {
+		Checks map[string]map[string]interface{} `json:"checks"`
+	}
+	if status := doRequest(t, app, "GET", "/readyz", "", nil, &body); status != fiber.StatusServiceUnavailable {
+		t.Fatalf("Expected the app not to be ready, got %d", status)
+	}
+	failed := body.Checks["book_storage"]
+	if failed["status"] != "failed" {
+		t.Errorf("Expected the book storage check to fail, got %+v", failed)
+	}
+	if _, ok := failed["error"]; ok {
+		t.Errorf("Expected the error to stay out of the report, got %+v", failed)
+	}
+}
+
+func TestMetricsNeedTheToken(t *testing.T) {
+	app := newTestApp(t)
+	if status := doRequest(t, app, "GET", "/metrics", "", nil, nil); status != fiber.StatusNotFound {
+		t.Errorf("Expected metrics to be disabled without a token, got %d", status)
+	}
+
+	config.Get().Metrics.Token = "scrape-token"
+	app = fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+	DefineRoutes(app)
+
+	for token, want := range map[string]int{
+		"":             fiber.StatusUnauthorized,
+		"wrong-token":  fiber.StatusUnauthorized,
+		"scrape-token": fiber.StatusOK,
+	} {
+		if status := doRequest(t, app, "GET", "/metrics", token, nil, nil); status != want {
+			t.Errorf("Token %q: expected %d, got %d", token, want, status)
+		}
+	}
+}
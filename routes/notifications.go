@@ -0,0 +1,234 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+	"github.com/mohammadshaad/golang-book-store-backend/notifications"
+	"github.com/valyala/fasthttp"
+)
+
+// streamKeepAlive is how often an idle notification stream sends a comment
+// so proxies do not close the connection
+const streamKeepAlive = 30 * time.Second
+
+// Page sizes of the notification list
+const (
+	defaultNotificationLimit = 50
+	maxNotificationLimit     = 100
+)
+
+// Get the logged in user's notifications, newest first
+func GetNotificationsHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	query := database.WithContext(c.UserContext()).Where("user_id = ?", userID)
+
+	// Optionally only return notifications that have not been read yet
+	if c.QueryBool("unread") {
+		query = query.Where("read_at IS NULL")
+	}
+
+	// Keep the page bounded; a limit below one would mean no limit at all
+	limit := c.QueryInt("limit", defaultNotificationLimit)
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > maxNotificationLimit {
+		limit = maxNotificationLimit
+	}
+
+	var items []database.Notification
+	if err := query.Order("created_at DESC").Limit(limit).Find(&items).Error; err != nil {
+		return apierror.Internal("Failed to fetch notifications")
+	}
+
+	unread, err := countUnreadNotifications(c.UserContext(), userID)
+	if err != nil {
+		return apierror.Internal("Failed to fetch notifications")
+	}
+
+	return c.JSON(fiber.Map{
+		"notifications": items,
+		"unread_count":  unread,
+	})
+}
+
+// Get the number of unread notifications of the logged in user
+func GetUnreadNotificationCountHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	unread, err := countUnreadNotifications(c.UserContext(), userID)
+	if err != nil {
+		return apierror.Internal("Failed to count notifications")
+	}
+
+	return c.JSON(fiber.Map{
+		"unread_count": unread,
+	})
+}
+
+// Mark a single notification as read
+func MarkNotificationReadHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	// Find the notification, making sure it belongs to the user
+	var notification database.Notification
+	if err := database.WithContext(c.UserContext()).Where("id = ? AND user_id = ?", id, userID).First(&notification).Error; err != nil {
+		return apierror.NotFound("Notification not found")
+	}
+
+	if notification.ReadAt == nil {
+		now := time.Now()
+		notification.ReadAt = &now
+		if err := database.WithContext(c.UserContext()).Model(&notification).Update("read_at", now).Error; err != nil {
+			return apierror.Internal("Failed to update notification")
+		}
+	}
+
+	return c.JSON(notification)
+}
+
+// Mark all notifications of the logged in user as read
+func MarkAllNotificationsReadHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	result := database.WithContext(c.UserContext()).Model(&database.Notification{}).
+		Where("user_id = ? AND read_at IS NULL", userID).
+		Update("read_at", time.Now())
+	if result.Error != nil {
+		return apierror.Internal("Failed to update notifications")
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"updated": result.RowsAffected,
+	})
+}
+
+// Stream the logged in user's new notifications as server-sent events
+func StreamNotificationsHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	unread, err := countUnreadNotifications(c.UserContext(), userID)
+	if err != nil {
+		return apierror.Internal("Failed to fetch notifications")
+	}
+
+	// The stream outlives the request, so keep the claims to check them again
+	// while it runs
+	claims, ok := middleware.Claims(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	// Subscribe before the response starts so nothing is missed in between
+	events, unsubscribe := notifications.Subscribe(userID)
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
+		// The request context is gone once the handler returned
+		streamNotifications(w, unread, events, streamKeepAlive, func() error {
+			return middleware.TokenValidityError(context.Background(), claims)
+		})
+	}))
+
+	return nil
+}
+
+// streamNotifications writes the unread count and then every notification
+// as it arrives. It stops once the client goes away, the server shuts down
+// or, checked on every keep-alive, the session or the account has ended.
+func streamNotifications(w *bufio.Writer, unread int64, events <-chan database.Notification, keepAlive time.Duration, validityError func() error) {
+	// Start with the current unread count so the client can render a badge
+	if err := writeEvent(w, "unread_count", fiber.Map{"unread_count": unread}); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case n, ok := <-events:
+			if !ok {
+				// The server is shutting down
+				return
+			}
+			if err := writeEvent(w, "notification", n); err != nil {
+				return
+			}
+		case <-ticker.C:
+			// A logout, suspension or password reset ends the stream the
+			// token opened, like it ends every other use of the token
+			if err := validityError(); err != nil {
+				return
+			}
+			// Writing fails once the client has gone away
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes a single server-sent event and flushes it to the client
+func writeEvent(w *bufio.Writer, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func countUnreadNotifications(ctx context.Context, userID uint) (int64, error) {
+	var count int64
+	err := database.WithContext(ctx).Model(&database.Notification{}).
+		Where("user_id = ? AND read_at IS NULL", userID).
+		Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,145 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+	"github.com/mohammadshaad/golang-book-store-backend/notifications"
+)
+
+func TestQueryTokenOnlyOnStream(t *testing.T) {
+	app := newTestApp(t)
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+
+	// End streams right after their first event instead of keeping them open
+	notifications.CloseStreams()
+
+	for _, path := range []string{"/api/v1/user/notifications/stream", "/api/v2/users/me/notifications/stream", "/user/notifications/stream"} {
+		if status := doRequest(t, app, "GET", path+"?access_token="+token, "", nil, nil); status != fiber.StatusOK {
+			t.Errorf("Expected %s to accept the query token, got %d", path, status)
+		}
+	}
+
+	for _, path := range []string{"/api/v1/user/notifications", "/api/v1/user/profile/me", "/api/v2/users/me/notifications", "/api/v1/admin/users"} {
+		if status := doRequest(t, app, "GET", path+"?access_token="+token, "", nil, nil); status != fiber.StatusUnauthorized {
+			t.Errorf("Expected %s to reject the query token, got %d", path, status)
+		}
+	}
+}
+
+func TestNotificationLimit(t *testing.T) {
+	app := newTestApp(t)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+
+	for i := 0; i < maxNotificationLimit+5; i++ {
+		database.GetDB().Create(&database.Notification{UserID: user.ID, Type: database.NotificationPriceDrop, Title: fmt.Sprint(i)})
+	}
+
+	for _, tt := range []struct {
+		limit string
+		want  int
+	}{
+		{"", defaultNotificationLimit},
+		{"10", 10},
+		{"-1", 1},
+		{"0", 1},
+		{"1000", maxNotificationLimit},
+	} {
+		var body struct {
+			Notifications []database.Notification `json:"notifications"`
+		}
+		path := "/api/v1/user/notifications"
+		if tt.limit != "" {
+			path += "?limit=" + tt.limit
+		}
+		if status := doRequest(t, app, "GET", path, token, nil, &body); status != fiber.StatusOK {
+			t.Fatalf("Expected %s to answer 200, got %d", path, status)
+		}
+		if len(body.Notifications) != tt.want {
+			t.Errorf("Expected limit %q to return %d notifications, got %d", tt.limit, tt.want, len(body.Notifications))
+		}
+	}
+}
+
+func TestRemoveReviewNotifiesAuthor(t *testing.T) {
+	app := newTestApp(t)
+	author, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	book := createTestBook(t, database.Book{Title: "Dune"})
+
+	review := database.Review{BookID: book.ID, UserID: author.ID, Rating: 1, Comment: "Spam"}
+	database.GetDB().Create(&review)
+	path := fmt.Sprintf("/api/v1/admin/book/%d/reviews/%d", book.ID, review.ID)
+
+	// Only admins with books:manage moderate reviews
+	if status := doRequest(t, app, "DELETE", path, token, nil, nil); status != fiber.StatusForbidden {
+		t.Errorf("Expected a user to get 403, got %d", status)
+	}
+
+	notifications.Init(nil)
+	status := doRequest(t, app, "DELETE", path, adminToken, map[string]string{"reason": "Advertising"}, nil)
+	notifications.Close()
+	if status != fiber.StatusOK {
+		t.Fatalf("Expected removing the review to answer 200, got %d", status)
+	}
+
+	if err := database.GetDB().First(&database.Review{}, review.ID).Error; err == nil {
+		t.Error("Expected the review to be removed")
+	}
+
+	var inbox []database.Notification
+	database.GetDB().Where("user_id = ?", author.ID).Find(&inbox)
+	if len(inbox) != 1 || inbox[0].Type != database.NotificationReviewRemoved {
+		t.Fatalf("Expected the author to be notified once, got %+v", inbox)
+	}
+	if want := "Your review of Dune was removed by a moderator: Advertising"; inbox[0].Message != want {
+		t.Errorf("Expected %q, got %q", want, inbox[0].Message)
+	}
+
+	if status := doRequest(t, app, "DELETE", path, adminToken, nil, nil); status != fiber.StatusNotFound {
+		t.Errorf("Expected removing it again to answer 404, got %d", status)
+	}
+}
+
+func TestStreamEndsWithTheSession(t *testing.T) {
+	newTestApp(t)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	claims, err := auth.ParseToken(token)
+	if err != nil {
+		t.Fatalf("Parsing the token failed: %v", err)
+	}
+
+	events := make(chan database.Notification)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		streamNotifications(bufio.NewWriter(io.Discard), 0, events, 10*time.Millisecond, func() error {
+			return middleware.TokenValidityError(context.Background(), claims)
+		})
+	}()
+
+	// The stream stays open while the session lasts
+	select {
+	case <-done:
+		t.Fatal("Expected the stream to stay open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// and ends on the next keep-alive once the user logged out everywhere
+	if err := endSessions(context.Background(), user.ID); err != nil {
+		t.Fatalf("Ending the sessions failed: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the stream to end with the session")
+	}
+}
@@ -0,0 +1,218 @@
+package routes
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/logging"
+	"github.com/mohammadshaad/golang-book-store-backend/metrics"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+	"github.com/mohammadshaad/golang-book-store-backend/oidc"
+	"gorm.io/gorm"
+)
+
+// oidcStateCookie ties a login to the browser that started it, so a
+// callback link planted by someone else is refused
+const oidcStateCookie = "oidc_state"
+
+// oidcAppPath is where the frontend at APP_URL takes over after signing in
+// with the identity provider
+const oidcAppPath = "/auth/oidc/callback"
+
+// Send the user to the company identity provider to sign in
+func OIDCLoginHandler(c *fiber.Ctx) error {
+	provider := oidc.Default()
+	if provider == nil {
+		return apierror.NotFound(oidc.ErrNotConfigured.Error())
+	}
+
+	redirectURL, state, err := provider.StartLogin(c.UserContext())
+	if err != nil {
+		logging.FromContext(c.UserContext()).Error("Failed to start OIDC login", "error", err)
+		return apierror.New(fiber.StatusBadGateway, apierror.CodeUpstreamUnavailable, "Identity provider unavailable")
+	}
+
+	// Lax, because the provider sends the user back with a cross-site
+	// redirect
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(oidc.LoginTTL.Seconds()),
+		Secure:   c.Protocol() == "https",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	return c.Redirect(redirectURL, fiber.StatusFound)
+}
+
+// Finish signing in with the identity provider and send the user to the
+// frontend. The tokens, or the error, are passed in the URL fragment, which
+// browsers do not send to servers.
+func OIDCCallbackHandler(c *fiber.Ctx) error {
+	provider := oidc.Default()
+	if provider == nil {
+		return apierror.NotFound(oidc.ErrNotConfigured.Error())
+	}
+
+	fragment := url.Values{}
+	result, err := finishOIDCLogin(c, provider)
+	if err != nil {
+		var apiErr *apierror.Error
+		if !errors.As(err, &apiErr) {
+			apiErr = apierror.Internal("Cannot log in")
+		}
+		fragment.Set("error", apiErr.Code)
+		fragment.Set("error_description", apiErr.Detail)
+		for key, value := range apiErr.Extensions {
+			fragment.Set(key, fmt.Sprint(value))
+		}
+	}
+	for key, value := range result {
+		fragment.Set(key, fmt.Sprint(value))
+	}
+
+	return c.Redirect(config.Get().Server.AppURL+oidcAppPath+"#"+fragment.Encode(), fiber.StatusFound)
+}
+
+// finishOIDCLogin checks the callback, finds the user and returns what a
+// password login would
+func finishOIDCLogin(c *fiber.Ctx, provider *oidc.Provider) (fiber.Map, error) {
+	// Each login can only come back once, to the browser that started it
+	cookie := c.Cookies(oidcStateCookie)
+	c.ClearCookie(oidcStateCookie)
+
+	// The provider reports errors such as a cancelled sign in as parameters
+	if reason := c.Query("error"); reason != "" {
+		return nil, apierror.Unauthorized("Sign in was not completed").With("reason", reason)
+	}
+
+	state := c.Query("state")
+	if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+		return nil, apierror.BadRequest("Sign in expired, please try again")
+	}
+
+	claims, err := provider.FinishLogin(c.UserContext(), state, c.Query("code"))
+	if err != nil {
+		if errors.Is(err, oidc.ErrInvalidState) {
+			return nil, apierror.BadRequest("Sign in expired, please try again")
+		}
+		logging.FromContext(c.UserContext()).Warn("OIDC login failed", "error", err)
+		metrics.RecordLogin("oidc", false)
+		return nil, apierror.Unauthorized("Sign in failed")
+	}
+
+	user, err := findOrCreateOIDCUser(c.UserContext(), claims)
+	if err != nil {
+		logging.FromContext(c.UserContext()).Error("Failed to link OIDC user", "subject", claims.Subject, "error", err)
+		return nil, apierror.Conflict("Cannot link this identity to an account")
+	}
+
+	if err := middleware.InactiveAccountError(user); err != nil {
+		return nil, err
+	}
+
+	// Users who enabled two-factor authentication here still have to send
+	// a code, like after the password step of a login
+	if user.TOTPEnabled {
+		preAuthToken, err := CreatePreAuthToken(user)
+		if err != nil {
+			return nil, apierror.Internal("Cannot log in")
+		}
+		return fiber.Map{
+			"two_factor_required": true,
+			"pre_auth_token":      preAuthToken,
+		}, nil
+	}
+
+	// Issue the same tokens as a password login
+	session, err := createSession(c.UserContext(), user, claims.MultiFactor())
+	if err != nil {
+		return nil, apierror.Internal("Cannot log in")
+	}
+	delete(session, "success")
+
+	metrics.RecordLogin("oidc", true)
+	return session, nil
+}
+
+// findOrCreateOIDCUser returns the user linked to the identity, links an
+// existing account with the same verified email, or creates a new account.
+// Accounts created for an email the provider does not vouch for have to be
+// verified first, like after registering.
+func findOrCreateOIDCUser(ctx context.Context, claims *oidc.Claims) (database.User, error) {
+	db := database.WithContext(ctx)
+
+	var user database.User
+	err := db.Where("oidc_issuer = ? AND oidc_subject = ?", claims.Issuer, claims.Subject).First(&user).Error
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return database.User{}, err
+	}
+
+	if claims.Email == "" {
+		return database.User{}, errors.New("identity has no email address")
+	}
+
+	// Only link to an existing account when the provider vouches for the
+	// email, otherwise anyone could take over an account by its address
+	err = db.Where("email = ?", claims.Email).First(&user).Error
+	if err == nil {
+		if !claims.EmailVerified {
+			return database.User{}, errors.New("email is not verified by the provider")
+		}
+		if user.OIDCSubject != "" {
+			return database.User{}, errors.New("account is linked to another identity")
+		}
+
+		if err := db.Model(&user).Updates(map[string]interface{}{
+			"oidc_issuer":  claims.Issuer,
+			"oidc_subject": claims.Subject,
+		}).Error; err != nil {
+			return database.User{}, err
+		}
+		return user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return database.User{}, err
+	}
+
+	// New accounts get no password; they can only sign in through the
+	// provider until the user resets it
+	user = database.User{
+		FirstName:   claims.GivenName,
+		LastName:    claims.FamilyName,
+		Email:       claims.Email,
+		Role:        database.UserRoleStandard,
+		Status:      database.AccountStatusPendingVerification,
+		OIDCIssuer:  claims.Issuer,
+		OIDCSubject: claims.Subject,
+	}
+	if claims.EmailVerified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+		user.Status = database.AccountStatusActive
+	}
+
+	if err := db.Create(&user).Error; err != nil {
+		return database.User{}, err
+	}
+
+	if user.Status == database.AccountStatusPendingVerification {
+		if err := sendVerificationEmail(ctx, user); err != nil {
+			logging.FromContext(ctx).Error("Failed to send verification email", "user_id", user.ID, "error", err)
+		}
+	}
+	return user, nil
+}
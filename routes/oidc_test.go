@@ -0,0 +1,190 @@
+package routes
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/oidc"
+)
+
+// testIdentityProvider signs users in as whoever the test says, with any
+// code
+type testIdentityProvider struct {
+	server        *httptest.Server
+	subject       string
+	email         string
+	emailVerified bool
+	nonce         string
+}
+
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Generating a key failed: %v", err)
+	}
+
+	idp := &testIdentityProvider{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, oidc.Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    idp.server.URL,
+				Subject:   idp.subject,
+				Audience:  jwt.ClaimStrings{"bookstore"},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+			},
+			Nonce:         idp.nonce,
+			Email:         idp.email,
+			EmailVerified: idp.emailVerified,
+		})
+		token.Header["kid"] = "test"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			t.Errorf("Signing the ID token failed: %v", err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	oidc.SetDefault(oidc.NewProvider(oidc.Config{Issuer: idp.server.URL, ClientID: "bookstore", RedirectURL: "http://localhost/callback"}))
+	t.Cleanup(func() { oidc.SetDefault(nil) })
+	return idp
+}
+
+// signIn starts a login, lets the provider send the user back and returns
+// the fragment of the redirect to the frontend. A nil cookie means the
+// callback comes from another browser.
+func (idp *testIdentityProvider) signIn(t *testing.T, app *fiber.App, keepCookie bool) url.Values {
+	t.Helper()
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/auth/oidc/login", nil), -1)
+	if err != nil {
+		t.Fatalf("Starting the login failed: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("Expected the login to redirect, got %d", resp.StatusCode)
+	}
+	loginURL, _ := url.Parse(resp.Header.Get(fiber.HeaderLocation))
+	idp.nonce = loginURL.Query().Get("nonce")
+
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly {
+		t.Fatalf("Expected an HttpOnly state cookie, got %+v", cookie)
+	}
+
+	callback := "/api/v1/auth/oidc/callback?code=code&state=" + url.QueryEscape(loginURL.Query().Get("state"))
+	req := httptest.NewRequest("GET", callback, nil)
+	if keepCookie {
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	resp, err = app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("Calling back failed: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("Expected the callback to redirect, got %d", resp.StatusCode)
+	}
+
+	location := resp.Header.Get(fiber.HeaderLocation)
+	prefix := config.Get().Server.AppURL + oidcAppPath + "#"
+	if !strings.HasPrefix(location, prefix) {
+		t.Fatalf("Expected a redirect to %s, got %s", prefix, location)
+	}
+	fragment, err := url.ParseQuery(strings.TrimPrefix(location, prefix))
+	if err != nil {
+		t.Fatalf("Parsing the fragment failed: %v", err)
+	}
+	return fragment
+}
+
+func TestOIDCLogin(t *testing.T) {
+	app := newTestApp(t)
+	idp := newTestIdentityProvider(t)
+	idp.subject, idp.email, idp.emailVerified = "staff-1", "staff@example.com", true
+
+	// A callback without the browser's cookie is refused
+	if fragment := idp.signIn(t, app, false); fragment.Get("error") != apierror.CodeBadRequest {
+		t.Errorf("Expected a callback without the state cookie to fail, got %v", fragment)
+	}
+
+	fragment := idp.signIn(t, app, true)
+	if fragment.Get("token") == "" || fragment.Get("refresh_token") == "" {
+		t.Fatalf("Expected tokens in the fragment, got %v", fragment)
+	}
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", fragment.Get("token"), nil, nil); status != fiber.StatusOK {
+		t.Errorf("Expected the token to work, got %d", status)
+	}
+}
+
+func TestOIDCLoginWithTwoFactor(t *testing.T) {
+	app := newTestApp(t)
+	idp := newTestIdentityProvider(t)
+	user, _ := createTestUser(t, "staff@example.com", database.UserRoleStandard)
+	database.GetDB().Model(&user).Update("totp_enabled", true)
+	idp.subject, idp.email, idp.emailVerified = "staff-1", user.Email, true
+
+	fragment := idp.signIn(t, app, true)
+	if fragment.Get("token") != "" || fragment.Get("two_factor_required") != "true" || fragment.Get("pre_auth_token") == "" {
+		t.Errorf("Expected only a pre-auth token, got %v", fragment)
+	}
+}
+
+func TestOIDCLoginWithUnverifiedEmail(t *testing.T) {
+	app := newTestApp(t)
+	idp := newTestIdentityProvider(t)
+	idp.subject, idp.email, idp.emailVerified = "staff-1", "new@example.com", false
+
+	fragment := idp.signIn(t, app, true)
+	if fragment.Get("error") != apierror.CodeEmailNotVerified || fragment.Get("token") != "" {
+		t.Errorf("Expected the login to wait for email verification, got %v", fragment)
+	}
+
+	var user database.User
+	if err := database.GetDB().Where("email = ?", idp.email).First(&user).Error; err != nil {
+		t.Fatalf("Expected the account to be created: %v", err)
+	}
+	if user.Status != database.AccountStatusPendingVerification {
+		t.Errorf("Expected the account to be pending verification, got %q", user.Status)
+	}
+}
@@ -0,0 +1,84 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/openapi"
+)
+
+var routeParam = regexp.MustCompile(`:(\w+)`)
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openapi.Spec, &spec); err != nil {
+		t.Fatalf("Parsing the OpenAPI document failed: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.1") {
+		t.Errorf("Expected an OpenAPI 3.1 document, got %q", spec.OpenAPI)
+	}
+
+	app := fiber.New()
+	DefineRoutes(app)
+
+	registered := map[string]bool{}
+	for _, route := range app.GetRoutes(true) {
+		// Fiber answers HEAD for every GET route on its own
+		if route.Method == fiber.MethodHead {
+			continue
+		}
+
+		path := routeParam.ReplaceAllString(route.Path, "{$1}")
+		method := strings.ToLower(route.Method)
+
+		// Deprecated aliases are described by the v1 route they stand for
+		if _, ok := spec.Paths[path]; !ok && !strings.HasPrefix(path, "/api/") {
+			if _, ok := spec.Paths["/api/v1"+path][method]; ok {
+				continue
+			}
+		}
+		registered[method+" "+path] = true
+
+		if _, ok := spec.Paths[path][method]; !ok {
+			t.Errorf("%s %s is not described in openapi.json", route.Method, path)
+		}
+	}
+
+	// The document should not describe routes that no longer exist either
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			if !registered[method+" "+path] {
+				t.Errorf("openapi.json describes %s %s, which is not registered", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func TestDocsPagePolicy(t *testing.T) {
+	app := newTestApp(t)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/docs", nil), -1)
+	if err != nil {
+		t.Fatalf("GET /docs failed: %v", err)
+	}
+	defer resp.Body.Close()
+	page, _ := io.ReadAll(resp.Body)
+
+	policy := resp.Header.Get(fiber.HeaderContentSecurityPolicy)
+	for _, want := range []string{"default-src 'none'", "script-src https://unpkg.com/swagger-ui-dist@5.17.14/ 'sha256-", "connect-src 'self'"} {
+		if !strings.Contains(policy, want) {
+			t.Errorf("Expected the policy to contain %q, got %q", want, policy)
+		}
+	}
+	if strings.Contains(string(page), "persistAuthorization") {
+		t.Error("Expected tokens not to be stored in the browser")
+	}
+}
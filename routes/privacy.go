@@ -0,0 +1,127 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+	"github.com/mohammadshaad/golang-book-store-backend/privacy"
+	"gorm.io/gorm"
+)
+
+// Download everything stored about the logged in user as a JSON file
+func ExportDataHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	export, err := privacy.ExportUser(c.UserContext(), userID)
+	if err != nil {
+		return apierror.Internal("Failed to export data")
+	}
+
+	c.Attachment(fmt.Sprintf("bookstore-export-%d.json", userID))
+	return c.JSON(export)
+}
+
+// Ask for the logged in user's account and data to be erased
+func RequestErasureHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	return requestErasure(c, userID)
+}
+
+// Erase a user's account and data right away, skipping the grace period
+func EraseUserHandler(c *fiber.Ctx) error {
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+
+	if err := eraseUser(c.UserContext(), id); err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "User erased successfully",
+	})
+}
+
+// Erase every account whose grace period has passed, without waiting for the
+// background job
+func RunErasurePurgeHandler(c *fiber.Ctx) error {
+	count, err := privacy.PurgeDue(c.UserContext(), time.Now())
+	if err != nil {
+		return apierror.Internal("Failed to erase all due accounts").With("erased", count)
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"erased":  count,
+	})
+}
+
+// eraseUser erases the account right away and ends its sessions
+func eraseUser(ctx context.Context, id uint) error {
+	if err := privacy.EraseUser(ctx, id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apierror.NotFound("User not found")
+		}
+		return apierror.Internal("Failed to erase user")
+	}
+	// The sessions were deleted with the account; this clears them from
+	// the caches too
+	if err := endSessions(ctx, id); err != nil {
+		return apierror.Internal("Cannot log out existing sessions")
+	}
+	return nil
+}
+
+// requestErasure schedules the erasure and logs the user out
+func requestErasure(c *fiber.Ctx, userID uint) error {
+	erasesAt, err := scheduleErasure(c.UserContext(), userID)
+	if err != nil {
+		return err
+	}
+
+	// Set the token's expiration time to now thereby invalidating it
+	c.Cookie(&fiber.Cookie{
+		Name:     "jwt",
+		Value:    "",
+		Expires:  time.Now(),
+		HTTPOnly: true,
+	})
+
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"message":   "User account deactivated and scheduled for deletion",
+		"erases_at": erasesAt,
+	})
+}
+
+// scheduleErasure deactivates the account now and erases it once the grace
+// period has passed
+func scheduleErasure(ctx context.Context, userID uint) (time.Time, error) {
+	erasesAt, err := privacy.RequestErasure(ctx, userID)
+	if err != nil {
+		return erasesAt, apierror.Internal("Cannot delete user account")
+	}
+	if err := endSessions(ctx, userID); err != nil {
+		return erasesAt, apierror.Internal("Cannot log out existing sessions")
+	}
+	if err := revokeAPIKeys(ctx, userID); err != nil {
+		return erasesAt, apierror.Internal("Cannot revoke API keys")
+	}
+	return erasesAt, nil
+}
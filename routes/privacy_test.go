@@ -0,0 +1,32 @@
+package routes
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+)
+
+func TestEraseUser(t *testing.T) {
+	app := newTestApp(t)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	admin, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	erase := fmt.Sprintf("/api/v1/admin/user/%d/erase", user.ID)
+
+	if status := doRequest(t, app, "POST", erase, adminToken, nil, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected erasing a user to answer 200, got %d", status)
+	}
+	if status := doRequest(t, app, "GET", fmt.Sprintf("/api/v1/user/profile/%d", user.ID), token, nil, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the erased user's token to be refused with 401, got %d", status)
+	}
+
+	// Erasing the same user again must not claim success
+	if status := doRequest(t, app, "POST", erase, adminToken, nil, nil); status != fiber.StatusNotFound {
+		t.Errorf("Expected erasing an unknown user to answer 404, got %d", status)
+	}
+	missing := fmt.Sprintf("/api/v2/users/%d?immediate=true", admin.ID+100)
+	if status := doRequest(t, app, "DELETE", missing, adminToken, nil, nil); status != fiber.StatusNotFound {
+		t.Errorf("Expected erasing an unknown user through v2 to answer 404, got %d", status)
+	}
+}
@@ -2,57 +2,348 @@ package routes
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
-
-	jwtware "github.com/gofiber/jwt/v3"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/graph"
+	"github.com/mohammadshaad/golang-book-store-backend/metrics"
 	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+	"github.com/mohammadshaad/golang-book-store-backend/notifications"
+	"github.com/mohammadshaad/golang-book-store-backend/openapi"
+	"github.com/mohammadshaad/golang-book-store-backend/ratelimit"
 )
 
+// legacyDeprecatedAt is when the unversioned paths were deprecated in favour
+// of /api/v1
+var legacyDeprecatedAt = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+
+// DefineRoutes mounts every version of the API under /api/<version>. A new
+// version gets its own define function next to defineV1, e.g.
+// defineV2(api.Group("/v2")), registering new handlers for the routes whose
+// shape changes and the v1 handlers for the rest, so both are served side by
+// side.
 func DefineRoutes(app *fiber.App) {
+	// Probes, metrics, documentation and GraphQL are not part of any version
+	defineRootRoutes(app)
+
+	api := app.Group("/api")
+	defineV1(api.Group("/v1"))
+	defineV2(api.Group("/v2"))
+
+	// The paths from before versioning stay aliases of v1 until clients
+	// have moved on
+	if cfg := config.Get().API; cfg.LegacyRoutes {
+		defineV1(app.Group("", middleware.Deprecated(middleware.DeprecationConfig{
+			Since:  legacyDeprecatedAt,
+			Sunset: cfg.LegacySunset,
+			Successor: func(path string) string {
+				return "/api/v1" + path
+			},
+		})))
+	}
+}
+
+func defineV1(router fiber.Router) {
 	// Define public routes
-	definePublicRoutes(app)
+	definePublicRoutes(router)
 
 	// Define user-specific routes
-	defineUserRoutes(app)
+	defineUserRoutes(router)
 
 	// Define admin-specific routes
-	defineAdminRoutes(app)
+	defineAdminRoutes(router)
 }
 
-func StartApp(app *fiber.App, port int) {
-	fmt.Printf("Server is listening on port %d...\n", port)
-	app.Listen(fmt.Sprintf(":%d", port))
+// StartApp serves the app until it fails or the process receives SIGINT or
+// SIGTERM. It then stops accepting connections and gives in-flight requests
+// the shutdown timeout to finish.
+func StartApp(app *fiber.App, server config.ServerConfig) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	return serve(app, server, stop)
+}
+
+// serve is StartApp with the signals coming from stop
+func serve(app *fiber.App, server config.ServerConfig, stop <-chan os.Signal) error {
+	addr := fmt.Sprintf(":%d", server.Port)
+
+	listenErr := make(chan error, 1)
+	go func() {
+		if server.TLSCertFile != "" {
+			slog.Info("Server is listening", "port", server.Port, "tls", true)
+			listenErr <- app.ListenTLS(addr, server.TLSCertFile, server.TLSKeyFile)
+			return
+		}
+		slog.Info("Server is listening", "port", server.Port, "tls", false)
+		listenErr <- app.Listen(addr)
+	}()
+
+	select {
+	case err := <-listenErr:
+		// Listen only returns on its own when it fails, e.g. the port is taken
+		return fmt.Errorf("starting server: %w", err)
+	case sig := <-stop:
+		slog.Info("Shutting down", "signal", sig.String())
+	}
+
+	// Notification streams stay open until the client leaves, so end them
+	// instead of waiting for them
+	notifications.CloseStreams()
+
+	if err := app.ShutdownWithTimeout(server.ShutdownTimeout); err != nil {
+		return fmt.Errorf("shutting down server: %w", err)
+	}
+	return <-listenErr
 }
 
-func definePublicRoutes(app *fiber.App) {
+// limit applies the configured rate under the given policy name; each name
+// is a separate bucket per client
+func limit(name string, rate config.Rate) fiber.Handler {
+	return middleware.RateLimit(middleware.RateLimitConfig{
+		Policy: ratelimit.Policy{Name: name, Requests: rate.Requests, Per: rate.Per, Burst: rate.Burst},
+	})
+}
+
+// requireAuth checks the credentials of a request and limits it per user
+// or API key. Every request is first limited per IP, so a flood of bad
+// tokens is turned away before it costs a signature check or a database
+// lookup.
+func requireAuth(cfg middleware.AuthConfig, checkValidity fiber.Handler) []fiber.Handler {
+	limits := config.Get().RateLimit
+	return []fiber.Handler{
+		limit("client", limits.Client),
+		middleware.Authenticate(cfg),
+		checkValidity,
+		limit("api", limits.API),
+	}
+}
+
+func defineRootRoutes(app *fiber.App) {
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("Welcome to the book store!")
 	})
 
-	app.Post("/register", RegisterHandler)
-	app.Post("/login", LoginHandler)
+	// Probes and metrics for the orchestrator; never rate limited. Metrics
+	// are only served to scrapers with the metrics token.
+	app.Get("/healthz", HealthzHandler)
+	app.Get("/readyz", ReadyzHandler)
+	app.Get("/metrics", metrics.Handler(config.Get().Metrics.Token))
+
+	// Description of the API and an interactive explorer
+	app.Get("/openapi.json", openapi.SpecHandler)
+	app.Get("/docs", openapi.DocsHandler)
+
+	// Public keys for verifying our tokens, at the well-known location
+	app.Get("/.well-known/jwks.json", limit("public", config.Get().RateLimit.Public), JWKSHandler)
+
+	// Books, reviews and carts in one round trip. The schema grows instead
+	// of being versioned; the resolvers apply the rules of the REST routes.
+	app.Post("/graphql", append(
+		requireAuth(middleware.AuthConfig{AllowAPIKeys: true}, middleware.CheckJWTValidity),
+		graph.Handler,
+	)...)
+}
+
+// defineV2 registers version 2 of the API, which models resources rather than
+// actions: users, books and carts are addressed by ID, where "me" stands for
+// the logged in user, and changed with the matching verb. Creating answers
+// 201 Created with the new resource's Location and deleting answers 204 No
+// Content. Users reach their own resources and admins with the matching
+// permission everyone's.
+func defineV2(router fiber.Router) {
+	// Logins, registration and account emails work as in v1
+	definePublicRoutes(router)
+
+	// Scripts can use an API key instead of logging in
+	authenticated := requireAuth(middleware.AuthConfig{AllowAPIKeys: true}, middleware.CheckJWTValidity)
+
+	manageBooks := middleware.RequireAdmin(auth.PermissionManageBooks)
+	manageUsers := middleware.RequireAdmin(auth.PermissionManageUsers)
+	manageCarts := middleware.RequireAdmin(auth.PermissionManageCarts)
+	userOrAdmin := middleware.RequireSelfOrAdmin("id", auth.PermissionManageUsers)
+	cartOwnerOrAdmin := middleware.RequireSelfOrAdmin("user_id", auth.PermissionManageCarts)
+
+	router.Get("/users/me/notifications/stream", notificationStream()...)
+
+	// Deactivated accounts can log in, but only to activate the account
+	// again. Registered ahead of the group, whose middleware rejects them.
+	router.Post("/users/:id/reactivation", append(
+		requireAuth(middleware.AuthConfig{}, middleware.CheckJWTValidityForReactivation),
+		ReactivateUserHandler,
+	)...)
+
+	users := router.Group("/users", authenticated...)
+	users.Get("", manageUsers, GetAllUsersHandler)
+	users.Get("/:id", userOrAdmin, Profile)
+	users.Patch("/:id", userOrAdmin, UpdateUserHandler)
+	users.Delete("/:id", userOrAdmin, DeleteUserHandler)
+	users.Put("/:id/status", userOrAdmin, UpdateUserStatusHandler)
+	users.Put("/:id/role", manageUsers, UpdateUserRoleHandler)
+	users.Delete("/:id/lockout", manageUsers, noContent(UnlockAccountHandler))
+
+	// Resources only the logged in user has
+	me := users.Group("/me")
+	me.Get("/export", ExportDataHandler)
+	me.Delete("/session", noContent(LogoutHandler))
+	me.Post("/2fa/enroll", EnrollTwoFactorHandler)
+	me.Post("/2fa/confirm", ConfirmTwoFactorHandler)
+	me.Post("/2fa/recovery-codes", RegenerateRecoveryCodesHandler)
+	me.Post("/2fa/disable", DisableTwoFactorHandler)
+	me.Get("/wishlists", GetWishlistsHandler)
+	me.Post("/wishlists", CreateWishlistHandler)
+	me.Get("/wishlists/:id", GetWishlistHandler)
+	me.Patch("/wishlists/:id", UpdateWishlistHandler)
+	me.Delete("/wishlists/:id", noContent(DeleteWishlistHandler))
+	me.Post("/wishlists/:id/items", created(AddToWishlistHandler))
+	me.Delete("/wishlists/:id/items/:book_id", noContent(RemoveFromWishlistHandler))
+	me.Post("/wishlists/:id/items/:book_id/move-to-cart", MoveWishlistItemToCartHandler)
+	me.Get("/notifications", GetNotificationsHandler)
+	me.Get("/notifications/unread-count", GetUnreadNotificationCountHandler)
+	me.Put("/notifications/read-all", MarkAllNotificationsReadHandler)
+	me.Put("/notifications/:id/read", MarkNotificationReadHandler)
+
+	// API keys read the catalog only with the permission to manage it
+	readBooks := middleware.RequireKeyPermission(auth.PermissionManageBooks)
+
+	books := router.Group("/books", authenticated...)
+	books.Get("", readBooks, GetAllBooksHandler)
+	books.Post("", manageBooks, created(CreateBookHandler))
+	books.Get("/:id", readBooks, GetBookByIDHandler)
+	books.Put("/:id", manageBooks, UpdateBookHandler)
+	books.Delete("/:id", manageBooks, noContent(DeleteBookHandler))
+	books.Get("/:id/download", readBooks, DownloadBookHandler)
+	books.Get("/:book_id/reviews", readBooks, GetBookReviewsHandler)
+	books.Post("/:book_id/reviews", created(AddReviewHandler))
+	books.Get("/:book_id/reviews/:id", readBooks, GetReviewHandler)
+	books.Delete("/:book_id/reviews/:id", manageBooks, noContent(RemoveReviewHandler))
+
+	carts := router.Group("/carts", authenticated...)
+	carts.Get("", manageCarts, GetAllCartItemsHandler)
+	carts.Get("/:user_id/items", cartOwnerOrAdmin, GetCartHandler)
+	carts.Post("/:user_id/items", cartOwnerOrAdmin, created(AddToCartHandler))
+	carts.Get("/:user_id/items/:book_id", cartOwnerOrAdmin, GetCartItemHandler)
+	carts.Patch("/:user_id/items/:book_id", cartOwnerOrAdmin, UpdateCartItemQuantityHandler)
+	carts.Delete("/:user_id/items/:book_id", cartOwnerOrAdmin, noContent(RemoveFromCartHandler))
+	carts.Post("/:user_id/items/:book_id/save-for-later", cartOwnerOrAdmin, SaveForLaterHandler)
+
+	apiKeys := router.Group("/api-keys", authenticated...)
+	apiKeys.Get("", manageUsers, GetAPIKeysHandler)
+	apiKeys.Post("", manageUsers, CreateAPIKeyHandler)
+	apiKeys.Get("/:id", manageUsers, GetAPIKeyHandler)
+	apiKeys.Delete("/:id", manageUsers, noContent(RevokeAPIKeyHandler))
+
+	// Erase every account whose grace period has passed, without waiting for
+	// the background job
+	router.Post("/erasure-runs", append(authenticated, manageUsers, RunErasurePurgeHandler)...)
+}
+
+// notificationStream serves the notification stream. Browsers cannot set
+// headers on an EventSource, so unlike every other route the stream accepts
+// the access token as a query parameter. It is registered ahead of the group
+// it belongs to, whose middleware only accepts the header.
+func notificationStream() []fiber.Handler {
+	return append(
+		requireAuth(middleware.AuthConfig{AllowQueryToken: true}, middleware.CheckJWTValidity),
+		StreamNotificationsHandler,
+	)
+}
+
+// created answers 201 Created instead of 200 OK once the handler succeeded;
+// the handler sets the Location of the new resource
+func created(handler fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := handler(c); err != nil {
+			return err
+		}
+		c.Status(fiber.StatusCreated)
+		return nil
+	}
 }
 
-func defineUserRoutes(app *fiber.App) {
+// noContent answers 204 No Content once the handler succeeded, dropping the
+// confirmation message it wrote for v1
+func noContent(handler fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := handler(c); err != nil {
+			return err
+		}
+		c.Response().ResetBody()
+		c.Response().Header.Del(fiber.HeaderContentType)
+		c.Status(fiber.StatusNoContent)
+		return nil
+	}
+}
+
+// setLocation points the Location header at the resource with the given ID
+// in the collection the request was made to
+func setLocation(c *fiber.Ctx, id interface{}) {
+	c.Location(fmt.Sprintf("%s/%v", strings.TrimSuffix(c.Path(), "/"), id))
+}
+
+func definePublicRoutes(app fiber.Router) {
+	// Logins and account emails are limited per IP much tighter than the
+	// rest of the API. Each step of a login has its own bucket, so using
+	// one up does not lock a user out of the next.
+	limits := config.Get().RateLimit
+	public := limit("public", limits.Public)
+	accountEmail := limit("account-email", limits.AccountEmail)
+	oidc := limit("oidc", limits.OIDC)
+
+	app.Post("/register", limit("register", limits.Register), RegisterHandler)
+	app.Post("/login", limit("login", limits.Login), LoginHandler)
+	app.Post("/login/2fa", limit("login-2fa", limits.TwoFactor), LoginTwoFactorHandler)
+	app.Post("/token/refresh", limit("token-refresh", limits.TokenRefresh), RefreshTokenHandler)
+	app.Post("/verify-email", public, VerifyEmailHandler)
+	app.Post("/resend-verification", accountEmail, ResendVerificationHandler)
+	app.Post("/forgot-password", accountEmail, ForgotPasswordHandler)
+	app.Post("/reset-password", limit("reset-password", limits.ResetPassword), ResetPasswordHandler)
+
+	// Sign in with the company identity provider
+	app.Get("/auth/oidc/login", oidc, OIDCLoginHandler)
+	app.Get("/auth/oidc/callback", oidc, OIDCCallbackHandler)
+
+	// Read-only view of a public wishlist through its share link
+	app.Get("/wishlists/shared/:token", public, GetSharedWishlistHandler)
+}
+
+func defineUserRoutes(app fiber.Router) {
+	app.Get("/user/notifications/stream", notificationStream()...)
+
+	// Deactivated accounts can log in, but only to activate the account
+	// again. Registered ahead of the group, whose middleware rejects them.
+	app.Put("/user/activate/:id", append(
+		requireAuth(middleware.AuthConfig{}, middleware.CheckJWTValidityForReactivation),
+		ReactivateAccountHandler,
+	)...)
+
 	// Define a middleware to protect routes that require a valid JWT
-	user := app.Group("/user")
-	user.Use(jwtware.New(jwtware.Config{
-		SigningKey: []byte(os.Getenv("JWT_SECRET")),
-	}))
+	user := app.Group("/user", requireAuth(middleware.AuthConfig{}, middleware.CheckJWTValidity)...)
 
-	// Modify the middleware to check for JWT validity
-	user.Use(middleware.CheckJWTValidity)
+	// Users see and change their own profile; admins anyone's
+	profileOwnerOrAdmin := middleware.RequireSelfOrAdmin("id", auth.PermissionManageUsers)
 
 	user.Get("/", UserHomePageHandler)
-	user.Get("/profile/:id", Profile)
+	user.Get("/profile/:id", profileOwnerOrAdmin, Profile)
 	user.Get("/name/:id", GetUserNameHandler)
-	user.Put("/profile/:id", UpdateProfile)
+	user.Put("/profile/:id", profileOwnerOrAdmin, UpdateProfile)
 	user.Put("/deactivate/:id", DeactivateAccountHandler)
-	user.Put("/activate/:id", ActivateAccountHandler)
 	user.Delete("/delete/:id", DeleteAccountHandler)
+	user.Get("/export", ExportDataHandler)
+	user.Post("/erasure", RequestErasureHandler)
 	user.Post("/logout", LogoutHandler)
+	user.Post("/2fa/enroll", EnrollTwoFactorHandler)
+	user.Post("/2fa/confirm", ConfirmTwoFactorHandler)
+	user.Post("/2fa/recovery-codes", RegenerateRecoveryCodesHandler)
+	user.Post("/2fa/disable", DisableTwoFactorHandler)
 
 	user.Get("/books", GetAllBooksHandler)
 	user.Get("/book/:id", GetBookByIDHandler)
@@ -60,20 +351,31 @@ func defineUserRoutes(app *fiber.App) {
 	user.Get("/cart", GetCartHandler)
 	user.Delete("/cart/:book_id", RemoveFromCartHandler)
 	user.Put("/cart/:book_id", UpdateCartItemQuantityHandler)
+	user.Post("/cart/:book_id/save-for-later", SaveForLaterHandler)
+	user.Get("/wishlists", GetWishlistsHandler)
+	user.Post("/wishlists", CreateWishlistHandler)
+	user.Get("/wishlists/:id", GetWishlistHandler)
+	user.Put("/wishlists/:id", UpdateWishlistHandler)
+	user.Delete("/wishlists/:id", DeleteWishlistHandler)
+	user.Post("/wishlists/:id/items", AddToWishlistHandler)
+	user.Delete("/wishlists/:id/items/:book_id", RemoveFromWishlistHandler)
+	user.Post("/wishlists/:id/items/:book_id/move-to-cart", MoveWishlistItemToCartHandler)
 	user.Post("/book/:book_id/reviews", AddReviewHandler)
 	user.Get("/book/:book_id/reviews", GetBookReviewsHandler)
 	user.Get("/book/:id/download", DownloadBookHandler)
+	user.Get("/notifications", GetNotificationsHandler)
+	user.Get("/notifications/unread-count", GetUnreadNotificationCountHandler)
+	user.Put("/notifications/read-all", MarkAllNotificationsReadHandler)
+	user.Put("/notifications/:id/read", MarkNotificationReadHandler)
 	// getting the role of the user
 	user.Get("/role/:id", GetUserRoleHandler)
 
 }
 
-func defineAdminRoutes(app *fiber.App) {
+func defineAdminRoutes(app fiber.Router) {
 	// Define a middleware to protect routes that require a valid JWT
-	admin := app.Group("/admin")
-	admin.Use(jwtware.New(jwtware.Config{
-		SigningKey: []byte(os.Getenv("JWT_SECRET")),
-	}))
+	// Scripts can use an API key instead of logging in as an admin
+	admin := app.Group("/admin", requireAuth(middleware.AuthConfig{AllowAPIKeys: true}, middleware.CheckJWTValidity)...)
 
 	// Add a custom middleware to check for the "admin" role
 	admin.Use(middleware.CheckAdminRole)
@@ -83,18 +385,34 @@ func defineAdminRoutes(app *fiber.App) {
 		return c.SendString("Welcome admin!")
 	})
 
-	admin.Get("/books", GetAllBooksHandler)
-	admin.Get("/book/:id", GetBookByIDHandler)
-	admin.Post("/book", CreateBookHandler)
-	admin.Put("/book/:id", UpdateBookHandler)
-	admin.Delete("/book/:id", DeleteBookHandler)
-	admin.Get("/users", GetAllUsersHandler)
-	admin.Get("/user/:id", GetUserByIDHandler)
-	admin.Get("/book/:id/download", DownloadBookHandler)
-	admin.Get("/book/:book_id/reviews", GetBookReviewsHandler)
-	admin.Get("/cart", GetAllCartItemsHandler)
-	admin.Get("/cart/:user_id", GetUserCartHandler)
-	admin.Delete("/cart/:user_id/:book_id", DeleteCartItemHandler)
+	// Each admin route also needs the matching permission in the token
+	manageBooks := middleware.RequirePermission(auth.PermissionManageBooks)
+	manageUsers := middleware.RequirePermission(auth.PermissionManageUsers)
+	manageCarts := middleware.RequirePermission(auth.PermissionManageCarts)
+
+	admin.Get("/books", manageBooks, GetAllBooksHandler)
+	admin.Get("/book/:id", manageBooks, GetBookByIDHandler)
+	admin.Post("/book", manageBooks, CreateBookHandler)
+	admin.Put("/book/:id", manageBooks, UpdateBookHandler)
+	admin.Delete("/book/:id", manageBooks, DeleteBookHandler)
+	admin.Get("/users", manageUsers, GetAllUsersHandler)
+	admin.Get("/user/:id", manageUsers, GetUserByIDHandler)
+	admin.Put("/user/:id/role", manageUsers, UpdateUserRoleHandler)
+	admin.Post("/user/:id/unlock", manageUsers, UnlockAccountHandler)
+	admin.Put("/user/:id/suspend", manageUsers, SuspendUserHandler)
+	admin.Put("/user/:id/unsuspend", manageUsers, UnsuspendUserHandler)
+	admin.Put("/user/:id/activate", manageUsers, ActivateAccountHandler)
+	admin.Post("/user/:id/erase", manageUsers, EraseUserHandler)
+	admin.Post("/erasure/run", manageUsers, RunErasurePurgeHandler)
+	admin.Get("/api-keys", manageUsers, GetAPIKeysHandler)
+	admin.Post("/api-keys", manageUsers, CreateAPIKeyHandler)
+	admin.Delete("/api-keys/:id", manageUsers, RevokeAPIKeyHandler)
+	admin.Get("/book/:id/download", manageBooks, DownloadBookHandler)
+	admin.Get("/book/:book_id/reviews", manageBooks, GetBookReviewsHandler)
+	admin.Delete("/book/:book_id/reviews/:id", manageBooks, RemoveReviewHandler)
+	admin.Get("/cart", manageCarts, GetAllCartItemsHandler)
+	admin.Get("/cart/:user_id", manageCarts, GetUserCartHandler)
+	admin.Delete("/cart/:user_id/:book_id", manageCarts, DeleteCartItemHandler)
 	admin.Post("/logout", LogoutHandler)
-	admin.Get("/role/:id", GetUserRoleHandler)
+	admin.Get("/role/:id", manageUsers, GetUserRoleHandler)
 }
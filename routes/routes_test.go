@@ -0,0 +1,237 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/database/databasetest"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+	"github.com/mohammadshaad/golang-book-store-backend/ratelimit"
+)
+
+// newTestApp serves every route against an empty in-memory database
+func newTestApp(t *testing.T) *fiber.App {
+	t.Helper()
+
+	config.Set(config.Default())
+	databasetest.Open(t)
+
+	key, err := auth.GenerateSigningKey()
+	if err != nil {
+		t.Fatalf("Generating a signing key failed: %v", err)
+	}
+	auth.SetKeys(auth.NewKeySet(key))
+
+	// Every test starts with full rate limit buckets and no failed logins
+	auth.InitThrottles()
+	previous := ratelimit.Default()
+	ratelimit.SetDefault(ratelimit.NewMemoryStore())
+	t.Cleanup(func() { ratelimit.SetDefault(previous) })
+
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+	DefineRoutes(app)
+	return app
+}
+
+// createTestUser stores an active user with the role and returns an access
+// token for them
+func createTestUser(t *testing.T, email string, role database.UserRole) (database.User, string) {
+	t.Helper()
+
+	user := database.User{Email: email, FirstName: "Test", Role: role, Status: database.AccountStatusActive}
+	if err := database.GetDB().Create(&user).Error; err != nil {
+		t.Fatalf("Creating user %s failed: %v", email, err)
+	}
+	// IDs start over with every test database
+	middleware.InvalidateUser(user.ID)
+
+	session, err := createSession(context.Background(), user, false)
+	if err != nil {
+		t.Fatalf("Creating a session failed: %v", err)
+	}
+	return user, session["token"].(string)
+}
+
+// createTestBook stores a book
+func createTestBook(t *testing.T, book database.Book) database.Book {
+	t.Helper()
+
+	if err := database.GetDB().Create(&book).Error; err != nil {
+		t.Fatalf("Creating book %s failed: %v", book.Title, err)
+	}
+	return book
+}
+
+// doRequest sends a request with an optional bearer token and JSON body and
+// decodes the JSON response into out, if given
+func doRequest(t *testing.T, app *fiber.App, method, path, token string, body interface{}, out interface{}) int {
+	t.Helper()
+
+	headers := map[string]string{}
+	if token != "" {
+		headers[fiber.HeaderAuthorization] = "Bearer " + token
+	}
+	return doRequestWithHeaders(t, app, method, path, headers, body, out)
+}
+
+// doRequestWithHeaders is doRequest with any headers instead of a token
+func doRequestWithHeaders(t *testing.T, app *fiber.App, method, path string, headers map[string]string, body interface{}, out interface{}) int {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("Encoding the request body failed: %v", err)
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Decoding the response of %s %s failed: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestRateLimits(t *testing.T) {
+	newTestApp(t)
+	limits := &config.Get().RateLimit
+	limits.Client = config.Rate{Requests: 2, Per: time.Hour}
+	limits.Login = config.Rate{Requests: 1, Per: time.Hour}
+	app := fiber.New(fiber.Config{ErrorHandler: apierror.Handler})
+	DefineRoutes(app)
+
+	// Bad tokens are limited per IP before they are checked
+	for i, want := range []int{fiber.StatusUnauthorized, fiber.StatusUnauthorized, fiber.StatusTooManyRequests} {
+		if status := doRequest(t, app, "GET", "/api/v1/user/", "not-a-token", nil, nil); status != want {
+			t.Errorf("Request %d with a bad token: expected %d, got %d", i+1, want, status)
+		}
+	}
+
+	// Using up the login bucket leaves the next steps of a login alone
+	credentials := map[string]string{"email": "nobody@example.com", "password": "wrong-password"}
+	if status := doRequest(t, app, "POST", "/api/v1/login", "", credentials, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the first login to be checked, got %d", status)
+	}
+	if status := doRequest(t, app, "POST", "/api/v1/login", "", credentials, nil); status != fiber.StatusTooManyRequests {
+		t.Errorf("Expected the second login to be limited, got %d", status)
+	}
+	for _, path := range []string{"/api/v1/login/2fa", "/api/v1/token/refresh", "/api/v1/reset-password"} {
+		if status := doRequest(t, app, "POST", path, "", map[string]string{}, nil); status == fiber.StatusTooManyRequests {
+			t.Errorf("Expected %s to have its own bucket", path)
+		}
+	}
+}
+
+// freePort finds a port nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Finding a free port failed: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServeShutsDownGracefully(t *testing.T) {
+	started := make(chan struct{})
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		return c.SendString("done")
+	})
+
+	server := config.Default().Server
+	server.Port = freePort(t)
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() { served <- serve(app, server, stop) }()
+
+	// Wait for the server, then start a request and stop while it runs
+	url := fmt.Sprintf("http://127.0.0.1:%d/slow", server.Port)
+	response := make(chan error, 1)
+	go func() {
+		var err error
+		for i := 0; i < 50; i++ {
+			var resp *http.Response
+			if resp, err = http.Get(url); err == nil {
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(body) != "done" {
+					err = fmt.Errorf("unexpected body %q", body)
+				}
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		response <- err
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request never reached the server")
+	}
+	stop <- syscall.SIGTERM
+
+	if err := <-response; err != nil {
+		t.Errorf("Expected the in-flight request to finish: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The server did not shut down")
+	}
+}
+
+func TestServeReportsListenErrors(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Listening failed: %v", err)
+	}
+	defer l.Close()
+
+	server := config.Default().Server
+	server.Port = l.Addr().(*net.TCPAddr).Port
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	if err := serve(app, server, make(chan os.Signal)); err == nil {
+		t.Error("Expected an error when the port is taken")
+	}
+}
@@ -0,0 +1,384 @@
+package routes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/metrics"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// totpIssuer is shown as the account's issuer in authenticator apps
+	totpIssuer = "Book Store"
+
+	// recoveryCodeCount is how many recovery codes a user gets at a time
+	recoveryCodeCount = 10
+)
+
+// Complete a two-factor login with the pre-auth token from LoginHandler and a
+// TOTP or recovery code
+func LoginTwoFactorHandler(c *fiber.Ctx) error {
+	var input struct {
+		PreAuthToken string `json:"pre_auth_token" validate:"required"`
+		Code         string `json:"code" validate:"required_without=RecoveryCode"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	userID, err := parsePreAuthToken(input.PreAuthToken)
+	if err != nil {
+		return apierror.Unauthorized("Invalid or expired login, start again")
+	}
+
+	// Codes are short, so guessing them is throttled like passwords
+	throttleKey := auth.TwoFactorKey(userID)
+	if wait, _ := auth.AccountThrottle.Check(throttleKey); wait > 0 {
+		c.Set(fiber.HeaderRetryAfter, fmt.Sprint(int(wait.Seconds())+1))
+		return apierror.New(fiber.StatusTooManyRequests, apierror.CodeRateLimited, "Too many failed attempts, try again later")
+	}
+
+	var user database.User
+	if err := database.WithContext(c.UserContext()).First(&user, userID).Error; err != nil || !user.TOTPEnabled {
+		return apierror.Unauthorized("Invalid or expired login, start again")
+	}
+
+	// The account may have been suspended since the password step
+	if err := loginAccountError(user); err != nil {
+		return err
+	}
+
+	var verified bool
+	if input.Code != "" {
+		verified, err = useTOTPCode(c.UserContext(), user, input.Code)
+	} else {
+		verified, err = useRecoveryCode(c.UserContext(), user.ID, input.RecoveryCode)
+	}
+	if err != nil {
+		return apierror.Internal("Cannot log in")
+	}
+	if !verified {
+		auth.AccountThrottle.Fail(throttleKey)
+		metrics.RecordLogin("2fa", false)
+		return apierror.Unauthorized("Invalid two-factor code")
+	}
+	auth.AccountThrottle.Reset(throttleKey)
+
+	session, err := createSession(c.UserContext(), user, true)
+	if err != nil {
+		return apierror.Internal("Cannot log in")
+	}
+
+	metrics.RecordLogin("2fa", true)
+	return c.JSON(session)
+}
+
+// Start two-factor enrollment by generating a new TOTP secret
+func EnrollTwoFactorHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	var user database.User
+	if err := database.WithContext(c.UserContext()).First(&user, userID).Error; err != nil {
+		return apierror.NotFound("User not found")
+	}
+
+	if user.TOTPEnabled {
+		return apierror.Conflict("Two-factor authentication is already enabled")
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return apierror.Internal("Cannot start two-factor enrollment")
+	}
+
+	// The secret only becomes active once it is confirmed with a code
+	if err := database.WithContext(c.UserContext()).Model(&user).Updates(map[string]interface{}{
+		"totp_secret":    secret,
+		"totp_last_step": 0,
+	}).Error; err != nil {
+		return apierror.Internal("Cannot start two-factor enrollment")
+	}
+
+	return c.JSON(fiber.Map{
+		"secret":           secret,
+		"provisioning_uri": auth.TOTPProvisioningURI(secret, totpIssuer, user.Email),
+	})
+}
+
+// Confirm two-factor enrollment with the password and a code from the
+// authenticator app and hand out the recovery codes. Asking for the password
+// keeps someone holding a stolen token from locking the owner out with their
+// own authenticator.
+func ConfirmTwoFactorHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	var input struct {
+		Password string `json:"password" validate:"required"`
+		Code     string `json:"code" validate:"required"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	var user database.User
+	if err := database.WithContext(c.UserContext()).First(&user, userID).Error; err != nil {
+		return apierror.NotFound("User not found")
+	}
+
+	if user.TOTPEnabled {
+		return apierror.Conflict("Two-factor authentication is already enabled")
+	}
+	if user.TOTPSecret == "" {
+		return apierror.BadRequest("Start two-factor enrollment first")
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(input.Password)); err != nil {
+		return apierror.BadRequest("Incorrect password")
+	}
+
+	verified, err := useTOTPCode(c.UserContext(), user, input.Code)
+	if err != nil {
+		return apierror.Internal("Cannot enable two-factor authentication")
+	}
+	if !verified {
+		return apierror.BadRequest("Invalid two-factor code")
+	}
+
+	if err := database.WithContext(c.UserContext()).Model(&user).Update("totp_enabled", true).Error; err != nil {
+		return apierror.Internal("Cannot enable two-factor authentication")
+	}
+
+	codes, err := replaceRecoveryCodes(c.UserContext(), user.ID)
+	if err != nil {
+		return apierror.Internal("Cannot generate recovery codes")
+	}
+
+	return c.JSON(fiber.Map{
+		"success":        true,
+		"message":        "Two-factor authentication enabled, store the recovery codes in a safe place",
+		"recovery_codes": codes,
+	})
+}
+
+// Replace the user's recovery codes with a new set
+func RegenerateRecoveryCodesHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	var input struct {
+		Code string `json:"code" validate:"required"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	var user database.User
+	if err := database.WithContext(c.UserContext()).First(&user, userID).Error; err != nil {
+		return apierror.NotFound("User not found")
+	}
+
+	if !user.TOTPEnabled {
+		return apierror.BadRequest("Two-factor authentication is not enabled")
+	}
+
+	verified, err := useTOTPCode(c.UserContext(), user, input.Code)
+	if err != nil {
+		return apierror.Internal("Cannot generate recovery codes")
+	}
+	if !verified {
+		return apierror.BadRequest("Invalid two-factor code")
+	}
+
+	codes, err := replaceRecoveryCodes(c.UserContext(), user.ID)
+	if err != nil {
+		return apierror.Internal("Cannot generate recovery codes")
+	}
+
+	return c.JSON(fiber.Map{
+		"success":        true,
+		"recovery_codes": codes,
+	})
+}
+
+// Turn off two-factor authentication; needs the password and a current code
+func DisableTwoFactorHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	var input struct {
+		Password string `json:"password" validate:"required"`
+		Code     string `json:"code" validate:"required"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	var user database.User
+	if err := database.WithContext(c.UserContext()).First(&user, userID).Error; err != nil {
+		return apierror.NotFound("User not found")
+	}
+
+	if !user.TOTPEnabled {
+		return apierror.BadRequest("Two-factor authentication is not enabled")
+	}
+
+	if user.Role == database.UserRoleAdmin && auth.AdminTwoFactorRequired() {
+		return apierror.Forbidden("Two-factor authentication is required for admin accounts")
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(input.Password)); err != nil {
+		return apierror.BadRequest("Incorrect password")
+	}
+
+	verified, err := useTOTPCode(c.UserContext(), user, input.Code)
+	if err != nil {
+		return apierror.Internal("Cannot disable two-factor authentication")
+	}
+	if !verified {
+		return apierror.BadRequest("Invalid two-factor code")
+	}
+
+	if err := database.WithContext(c.UserContext()).Model(&user).Updates(map[string]interface{}{
+		"totp_enabled":   false,
+		"totp_secret":    "",
+		"totp_last_step": 0,
+	}).Error; err != nil {
+		return apierror.Internal("Cannot disable two-factor authentication")
+	}
+
+	if err := database.WithContext(c.UserContext()).Where("user_id = ?", user.ID).Delete(&database.RecoveryCode{}).Error; err != nil {
+		return apierror.Internal("Cannot disable two-factor authentication")
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// parsePreAuthToken checks a pre-auth token from the password step of a
+// two-factor login and returns the user it was issued to
+func parsePreAuthToken(raw string) (uint, error) {
+	claims, err := auth.ParseToken(raw)
+	if err != nil {
+		return 0, errors.New("invalid pre-auth token")
+	}
+	if !claims.HasScope(auth.ScopePreAuth) {
+		return 0, errors.New("not a pre-auth token")
+	}
+
+	return claims.UserID()
+}
+
+// useTOTPCode checks a TOTP code and remembers its time step so the same
+// code cannot be used again
+func useTOTPCode(ctx context.Context, user database.User, code string) (bool, error) {
+	step, ok := auth.ValidateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return false, nil
+	}
+
+	// Only one concurrent request can move the step forward
+	result := database.WithContext(ctx).Model(&database.User{}).
+		Where("id = ? AND totp_last_step < ?", user.ID, step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// useRecoveryCode redeems one of the user's unused recovery codes
+func useRecoveryCode(ctx context.Context, userID uint, code string) (bool, error) {
+	result := database.WithContext(ctx).Model(&database.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// replaceRecoveryCodes deletes the user's recovery codes and stores a fresh
+// set, returning the codes in plain text for the user to write down
+func replaceRecoveryCodes(ctx context.Context, userID uint) ([]string, error) {
+	db := database.WithContext(ctx)
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Where("user_id = ?", userID).Delete(&database.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		recoveryCode := database.RecoveryCode{
+			UserID:   userID,
+			CodeHash: hashRecoveryCode(code),
+		}
+		if err := db.Create(&recoveryCode).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// Recovery codes are random and long enough that a plain SHA-256 hash is
+// sufficient
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(auth.NormalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,231 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/config"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPassword = "secret"
+
+// createTwoFactorUser stores a user with a password and two-factor
+// authentication enabled through the API. The code confirming the enrollment
+// uses up the current time step.
+func createTwoFactorUser(t *testing.T, app *fiber.App, email string) (user database.User, secret string, recoveryCodes []string) {
+	t.Helper()
+
+	user, token := createTestUser(t, email, database.UserRoleStandard)
+	password, _ := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	database.GetDB().Model(&user).Update("password", password)
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	if status := doRequest(t, app, "POST", "/api/v1/user/2fa/enroll", token, nil, &enrollment); status != fiber.StatusOK {
+		t.Fatalf("Expected enrolling to answer 200, got %d", status)
+	}
+
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	body := map[string]string{"password": testPassword, "code": totpCode(t, enrollment.Secret, 0)}
+	if status := doRequest(t, app, "POST", "/api/v1/user/2fa/confirm", token, body, &confirmed); status != fiber.StatusOK {
+		t.Fatalf("Expected confirming to answer 200, got %d", status)
+	}
+	return user, enrollment.Secret, confirmed.RecoveryCodes
+}
+
+// totpCode returns the code for the time step the given number of steps
+// from now
+func totpCode(t *testing.T, secret string, steps int) string {
+	t.Helper()
+
+	code, err := auth.TOTPCode(secret, time.Now().Add(time.Duration(steps)*30*time.Second))
+	if err != nil {
+		t.Fatalf("Generating a code failed: %v", err)
+	}
+	return code
+}
+
+// startLogin sends the password step of a login and returns the pre-auth
+// token it hands out
+func startLogin(t *testing.T, app *fiber.App, email string) string {
+	t.Helper()
+
+	var login struct {
+		Token             string `json:"token"`
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		PreAuthToken      string `json:"pre_auth_token"`
+	}
+	if status := doRequest(t, app, "POST", "/api/v1/login", "", map[string]string{"email": email, "password": testPassword}, &login); status != fiber.StatusOK {
+		t.Fatalf("Expected the password step to answer 200, got %d", status)
+	}
+	if !login.TwoFactorRequired || login.PreAuthToken == "" || login.Token != "" {
+		t.Fatalf("Expected only a pre-auth token, got %+v", login)
+	}
+	return login.PreAuthToken
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	app := newTestApp(t)
+	user, secret, _ := createTwoFactorUser(t, app, "reader@example.com")
+
+	preAuthToken := startLogin(t, app, user.Email)
+
+	// The pre-auth token only completes the login
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", preAuthToken, nil, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected the pre-auth token to be refused with 401, got %d", status)
+	}
+
+	code := totpCode(t, secret, 1)
+	var session struct {
+		Token string `json:"token"`
+	}
+	if status := doRequest(t, app, "POST", "/api/v1/login/2fa", "", map[string]string{"pre_auth_token": preAuthToken, "code": code}, &session); status != fiber.StatusOK {
+		t.Fatalf("Expected the code to complete the login, got %d", status)
+	}
+	if status := doRequest(t, app, "GET", "/api/v1/user/profile/me", session.Token, nil, nil); status != fiber.StatusOK {
+		t.Errorf("Expected the token to work, got %d", status)
+	}
+
+	// A code cannot be used twice, even for a new login
+	preAuthToken = startLogin(t, app, user.Email)
+	if status := doRequest(t, app, "POST", "/api/v1/login/2fa", "", map[string]string{"pre_auth_token": preAuthToken, "code": code}, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected a replayed code to answer 401, got %d", status)
+	}
+}
+
+func TestRecoveryCodesWorkOnce(t *testing.T) {
+	app := newTestApp(t)
+	user, _, recoveryCodes := createTwoFactorUser(t, app, "reader@example.com")
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %d", recoveryCodeCount, len(recoveryCodes))
+	}
+
+	body := map[string]string{"pre_auth_token": startLogin(t, app, user.Email), "recovery_code": recoveryCodes[0]}
+	if status := doRequest(t, app, "POST", "/api/v1/login/2fa", "", body, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected the recovery code to complete the login, got %d", status)
+	}
+
+	body["pre_auth_token"] = startLogin(t, app, user.Email)
+	if status := doRequest(t, app, "POST", "/api/v1/login/2fa", "", body, nil); status != fiber.StatusUnauthorized {
+		t.Errorf("Expected a used recovery code to answer 401, got %d", status)
+	}
+}
+
+func TestAdminsNeedTwoFactorWhenRequired(t *testing.T) {
+	app := newTestApp(t)
+	config.Get().Auth.RequireAdmin2FA = true
+	admin, token := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+
+	var problem apierror.Error
+	if status := doRequest(t, app, "GET", "/api/v1/admin/users", token, nil, &problem); status != fiber.StatusForbidden {
+		t.Errorf("Expected a login without a second factor to get 403, got %d", status)
+	}
+	if problem.Code != apierror.CodeTwoFactorRequired {
+		t.Errorf("Expected code %s, got %s", apierror.CodeTwoFactorRequired, problem.Code)
+	}
+
+	session, err := createSession(context.Background(), admin, true)
+	if err != nil {
+		t.Fatalf("Creating a session failed: %v", err)
+	}
+	if status := doRequest(t, app, "GET", "/api/v1/admin/users", session["token"].(string), nil, nil); status != fiber.StatusOK {
+		t.Errorf("Expected a two-factor login to reach /admin, got %d", status)
+	}
+}
+
+func TestConfirmTwoFactorNeedsPassword(t *testing.T) {
+	app := newTestApp(t)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	password, _ := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	database.GetDB().Model(&user).Update("password", password)
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	if status := doRequest(t, app, "POST", "/api/v1/user/2fa/enroll", token, nil, &enrollment); status != fiber.StatusOK {
+		t.Fatalf("Expected enrolling to answer 200, got %d", status)
+	}
+
+	// A stolen token alone cannot put an authenticator on the account
+	for _, body := range []map[string]string{
+		{"code": totpCode(t, enrollment.Secret, 0)},
+		{"password": "wrong", "code": totpCode(t, enrollment.Secret, 0)},
+	} {
+		if status := doRequest(t, app, "POST", "/api/v1/user/2fa/confirm", token, body, nil); status != fiber.StatusBadRequest {
+			t.Errorf("Expected confirming with %v to answer 400, got %d", body, status)
+		}
+	}
+
+	var stored database.User
+	database.GetDB().First(&stored, user.ID)
+	if stored.TOTPEnabled {
+		t.Error("Expected two-factor authentication to stay off")
+	}
+}
+
+func TestDisableTwoFactorNeedsPasswordAndCode(t *testing.T) {
+	app := newTestApp(t)
+	user, secret, _ := createTwoFactorUser(t, app, "reader@example.com")
+	session, err := createSession(context.Background(), user, true)
+	if err != nil {
+		t.Fatalf("Creating a session failed: %v", err)
+	}
+	token := session["token"].(string)
+	code := totpCode(t, secret, 1)
+
+	for _, body := range []map[string]string{
+		{"code": code},
+		{"password": testPassword},
+		{"password": "wrong", "code": code},
+		{"password": testPassword, "code": "000000"},
+	} {
+		if status := doRequest(t, app, "POST", "/api/v1/user/2fa/disable", token, body, nil); status != fiber.StatusBadRequest {
+			t.Errorf("Expected disabling with %v to answer 400, got %d", body, status)
+		}
+	}
+
+	if status := doRequest(t, app, "POST", "/api/v1/user/2fa/disable", token, map[string]string{"password": testPassword, "code": code}, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected disabling to answer 200, got %d", status)
+	}
+	var stored database.User
+	database.GetDB().First(&stored, user.ID)
+	if stored.TOTPEnabled || stored.TOTPSecret != "" {
+		t.Errorf("Expected two-factor authentication to be off, got %+v", stored)
+	}
+}
+
+func TestUnlockClearsTwoFactorLockout(t *testing.T) {
+	app := newTestApp(t)
+	user, secret, _ := createTwoFactorUser(t, app, "reader@example.com")
+	_, adminToken := createTestUser(t, "admin@example.com", database.UserRoleAdmin)
+	preAuthToken := startLogin(t, app, user.Email)
+
+	// Keep guessing until the codes are throttled
+	throttled := false
+	for i := 0; i < 20 && !throttled; i++ {
+		status := doRequest(t, app, "POST", "/api/v1/login/2fa", "", map[string]string{"pre_auth_token": preAuthToken, "code": "000000"}, nil)
+		throttled = status == fiber.StatusTooManyRequests
+	}
+	if !throttled {
+		t.Fatal("Expected wrong codes to be throttled")
+	}
+
+	if status := doRequest(t, app, "POST", fmt.Sprintf("/api/v1/admin/user/%d/unlock", user.ID), adminToken, nil, nil); status != fiber.StatusOK {
+		t.Fatalf("Expected unlocking to answer 200, got %d", status)
+	}
+
+	body := map[string]string{"pre_auth_token": preAuthToken, "code": totpCode(t, secret, 1)}
+	if status := doRequest(t, app, "POST", "/api/v1/login/2fa", "", body, nil); status != fiber.StatusOK {
+		t.Errorf("Expected the code to work once unlocked, got %d", status)
+	}
+}
@@ -0,0 +1,147 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/auth"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+)
+
+// Update the profile fields set in the request body and return the user
+func UpdateUserHandler(c *fiber.Ctx) error {
+	id, ok := middleware.UserIDParam(c, "id")
+	if !ok {
+		return apierror.BadRequest("Invalid ID format")
+	}
+
+	user, err := updateProfile(c, id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(user)
+}
+
+// Delete a user. The account is deactivated right away and erased once the
+// grace period has passed, until then an admin can still restore it. Admins
+// can erase it right away with ?immediate=true.
+func DeleteUserHandler(c *fiber.Ctx) error {
+	id, ok := middleware.UserIDParam(c, "id")
+	if !ok {
+		return apierror.BadRequest("Invalid ID format")
+	}
+
+	if c.QueryBool("immediate") {
+		if err := middleware.AdminAccessError(c, auth.PermissionManageUsers); err != nil {
+			return err
+		}
+		if err := eraseUser(c.UserContext(), id); err != nil {
+			return err
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	erasesAt, err := scheduleErasure(c.UserContext(), id)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"erases_at": erasesAt,
+	})
+}
+
+// Activate the logged in user's deactivated account again and return the
+// user. Deactivated accounts can only reach this route; admins change the
+// status instead.
+func ReactivateUserHandler(c *fiber.Ctx) error {
+	id, ok := middleware.UserIDParam(c, "id")
+	if !ok {
+		return apierror.BadRequest("Invalid ID format")
+	}
+
+	// Users can only activate their own account
+	if userID, ok := middleware.CurrentUserID(c); !ok || userID != id {
+		return apierror.Forbidden("You can only activate your own account")
+	}
+
+	user, err := activateAccount(c, id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(user)
+}
+
+// Change the status of an account. Users can deactivate their own account;
+// admins suspend accounts and make suspended or deactivated accounts active
+// again.
+func UpdateUserStatusHandler(c *fiber.Ctx) error {
+	id, ok := middleware.UserIDParam(c, "id")
+	if !ok {
+		return apierror.BadRequest("Invalid ID format")
+	}
+
+	var input struct {
+		Status database.AccountStatus `json:"status" validate:"required,oneof=active deactivated suspended"`
+		Reason string                 `json:"reason" validate:"required_if=Status suspended"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	if input.Status == database.AccountStatusDeactivated {
+		// Users can only deactivate their own account
+		if userID, ok := middleware.CurrentUserID(c); !ok || userID != id {
+			return apierror.Forbidden("You can only deactivate your own account")
+		}
+
+		user, err := deactivateAccount(c, id)
+		if err != nil {
+			return err
+		}
+		return c.JSON(user)
+	}
+
+	if err := middleware.AdminAccessError(c, auth.PermissionManageUsers); err != nil {
+		return err
+	}
+
+	if input.Status == database.AccountStatusSuspended {
+		user, err := suspendAccount(c, id, input.Reason)
+		if err != nil {
+			return err
+		}
+		return c.JSON(user)
+	}
+
+	var user database.User
+	if err := database.WithContext(c.UserContext()).First(&user, id).Error; err != nil {
+		return apierror.NotFound("User not found")
+	}
+
+	var err error
+	switch user.Status {
+	case database.AccountStatusActive:
+		// Nothing to do
+	case database.AccountStatusSuspended:
+		user, err = unsuspendAccount(c, id)
+	case database.AccountStatusDeactivated:
+		user, err = activateAccount(c, id)
+	default:
+		// Unverified accounts become active by verifying their email
+		err = apierror.Conflict("Account is not suspended or deactivated")
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(user)
+}
@@ -0,0 +1,459 @@
+package routes
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/apierror"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"github.com/mohammadshaad/golang-book-store-backend/middleware"
+	"gorm.io/gorm"
+)
+
+// savedForLaterName is the name of the list cart items are moved to when a
+// user saves them for later
+const savedForLaterName = "Saved for later"
+
+// Get all wishlists of the logged in user
+func GetWishlistsHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	var wishlists []database.Wishlist
+	if err := database.WithContext(c.UserContext()).Preload("Items.Book").Where("user_id = ?", userID).Find(&wishlists).Error; err != nil {
+		return apierror.Internal("Failed to fetch wishlists")
+	}
+
+	return c.JSON(wishlists)
+}
+
+// Create a new wishlist for the logged in user
+func CreateWishlistHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	var input struct {
+		Name   string `json:"name" validate:"required"`
+		Public bool   `json:"public"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	shareToken, err := newShareToken()
+	if err != nil {
+		return apierror.Internal("Failed to create wishlist")
+	}
+
+	wishlist := database.Wishlist{
+		UserID:     userID,
+		Name:       input.Name,
+		Public:     input.Public,
+		ShareToken: shareToken,
+	}
+
+	if err := database.WithContext(c.UserContext()).Create(&wishlist).Error; err != nil {
+		return apierror.Internal("Failed to create wishlist")
+	}
+
+	setLocation(c, wishlist.ID)
+	return c.Status(fiber.StatusCreated).JSON(wishlist)
+}
+
+// Get a single wishlist of the logged in user
+func GetWishlistHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+	wishlist, err := findUserWishlist(c.UserContext(), userID, id)
+	if err != nil {
+		return apierror.NotFound("Wishlist not found")
+	}
+
+	return c.JSON(wishlist)
+}
+
+// Rename a wishlist or change its visibility
+func UpdateWishlistHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+	wishlist, err := findUserWishlist(c.UserContext(), userID, id)
+	if err != nil {
+		return apierror.NotFound("Wishlist not found")
+	}
+
+	var input struct {
+		Name   string `json:"name"`
+		Public *bool  `json:"public"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Only update the fields that were provided in the request
+	if input.Name != "" {
+		wishlist.Name = input.Name
+	}
+	if input.Public != nil {
+		wishlist.Public = *input.Public
+	}
+
+	if err := database.WithContext(c.UserContext()).Omit("Items").Save(&wishlist).Error; err != nil {
+		return apierror.Internal("Failed to update wishlist")
+	}
+
+	return c.JSON(wishlist)
+}
+
+// Delete a wishlist and the items on it
+func DeleteWishlistHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+	wishlist, err := findUserWishlist(c.UserContext(), userID, id)
+	if err != nil {
+		return apierror.NotFound("Wishlist not found")
+	}
+
+	if err := database.WithContext(c.UserContext()).Where("wishlist_id = ?", wishlist.ID).Delete(&database.WishlistItem{}).Error; err != nil {
+		return apierror.Internal("Failed to delete wishlist")
+	}
+
+	if err := database.WithContext(c.UserContext()).Delete(&wishlist).Error; err != nil {
+		return apierror.Internal("Failed to delete wishlist")
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Wishlist deleted successfully",
+	})
+}
+
+// Add a book to one of the user's wishlists
+func AddToWishlistHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+	wishlist, err := findUserWishlist(c.UserContext(), userID, id)
+	if err != nil {
+		return apierror.NotFound("Wishlist not found")
+	}
+
+	var input struct {
+		BookID uint `json:"book_id" validate:"required"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return apierror.InvalidBody()
+	}
+
+	// Validate the input
+	if err := validate.Struct(input); err != nil {
+		return apierror.Validation(err)
+	}
+
+	item, err := addBookToWishlist(c.UserContext(), wishlist.ID, input.BookID)
+	if err != nil {
+		if err == errBookNotFound {
+			return apierror.NotFound("Book not found")
+		}
+		return apierror.Internal("Failed to add to wishlist")
+	}
+
+	setLocation(c, item.BookID)
+	return c.JSON(item)
+}
+
+// Remove a book from one of the user's wishlists
+func RemoveFromWishlistHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+	wishlist, err := findUserWishlist(c.UserContext(), userID, id)
+	if err != nil {
+		return apierror.NotFound("Wishlist not found")
+	}
+
+	bookID, err := idParam(c, "book_id")
+	if err != nil {
+		return err
+	}
+
+	// Find the wishlist item to remove
+	var item database.WishlistItem
+	if err := database.WithContext(c.UserContext()).Where("wishlist_id = ? AND book_id = ?", wishlist.ID, bookID).First(&item).Error; err != nil {
+		return apierror.NotFound("Wishlist item not found")
+	}
+
+	if err := database.WithContext(c.UserContext()).Delete(&item).Error; err != nil {
+		return apierror.Internal("Failed to remove item from wishlist")
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Item removed from wishlist",
+	})
+}
+
+// Move a book from a wishlist into the user's cart
+func MoveWishlistItemToCartHandler(c *fiber.Ctx) error {
+	// Get the logged in user from the token
+	userID, ok := middleware.CurrentUserID(c)
+	if !ok {
+		return middleware.Unauthorized()
+	}
+
+	id, err := idParam(c, "id")
+	if err != nil {
+		return err
+	}
+	wishlist, err := findUserWishlist(c.UserContext(), userID, id)
+	if err != nil {
+		return apierror.NotFound("Wishlist not found")
+	}
+
+	// The quantity is optional and defaults to a single copy
+	var input struct {
+		Quantity uint `json:"quantity"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&input); err != nil {
+			return apierror.InvalidBody()
+		}
+	}
+	if input.Quantity == 0 {
+		input.Quantity = 1
+	}
+
+	bookID, err := idParam(c, "book_id")
+	if err != nil {
+		return err
+	}
+
+	// Find the wishlist item to move
+	var item database.WishlistItem
+	if err := database.WithContext(c.UserContext()).Where("wishlist_id = ? AND book_id = ?", wishlist.ID, bookID).First(&item).Error; err != nil {
+		return apierror.NotFound("Wishlist item not found")
+	}
+
+	cartItem, err := addBookToCart(c.UserContext(), userID, item.BookID, input.Quantity)
+	if err != nil {
+		if err == errBookNotFound {
+			return apierror.NotFound("Book not found")
+		}
+		return apierror.Internal("Failed to add to cart")
+	}
+
+	if err := database.WithContext(c.UserContext()).Delete(&item).Error; err != nil {
+		return apierror.Internal("Failed to remove item from wishlist")
+	}
+
+	return c.JSON(cartItem)
+}
+
+// Move a book from the user's cart to their "Saved for later" list
+func SaveForLaterHandler(c *fiber.Ctx) error {
+	// Get whose cart this is
+	userID, err := cartUserID(c)
+	if err != nil {
+		return err
+	}
+
+	bookID, err := idParam(c, "book_id")
+	if err != nil {
+		return err
+	}
+
+	// Find the cart item to move
+	var cartItem database.CartItem
+	if err := database.WithContext(c.UserContext()).Where("user_id = ? AND book_id = ?", userID, bookID).First(&cartItem).Error; err != nil {
+		return apierror.NotFound("Cart item not found")
+	}
+
+	// Find the user's "Saved for later" list, creating it on first use
+	var wishlist database.Wishlist
+	if err := database.WithContext(c.UserContext()).Where("user_id = ? AND name = ?", userID, savedForLaterName).First(&wishlist).Error; err != nil {
+		shareToken, err := newShareToken()
+		if err != nil {
+			return apierror.Internal("Failed to save item for later")
+		}
+		wishlist = database.Wishlist{
+			UserID:     userID,
+			Name:       savedForLaterName,
+			ShareToken: shareToken,
+		}
+		if err := database.WithContext(c.UserContext()).Create(&wishlist).Error; err != nil {
+			return apierror.Internal("Failed to save item for later")
+		}
+	}
+
+	item, err := addBookToWishlist(c.UserContext(), wishlist.ID, cartItem.BookID)
+	if err != nil {
+		return apierror.Internal("Failed to save item for later")
+	}
+
+	if err := database.WithContext(c.UserContext()).Delete(&cartItem).Error; err != nil {
+		return apierror.Internal("Failed to remove item from cart")
+	}
+
+	return c.JSON(item)
+}
+
+// Get a public wishlist through its share link (read-only, no login needed)
+func GetSharedWishlistHandler(c *fiber.Ctx) error {
+	var wishlist database.Wishlist
+	if err := database.WithContext(c.UserContext()).Preload("Items.Book").
+		Where("share_token = ? AND public = ?", c.Params("token"), true).
+		First(&wishlist).Error; err != nil {
+		return apierror.NotFound("Wishlist not found")
+	}
+
+	// Only expose what is needed to render the list; anyone with the link
+	// can see it, so the books leave out where their files are stored
+	items := make([]fiber.Map, len(wishlist.Items))
+	for i, item := range wishlist.Items {
+		items[i] = fiber.Map{
+			"book_id": item.BookID,
+			"book":    newPublicBook(item.Book),
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"name":  wishlist.Name,
+		"items": items,
+	})
+}
+
+// publicBook is what visitors without an account may see of a book
+type publicBook struct {
+	ID            uint    `json:"id"`
+	Title         string  `json:"title"`
+	Author        string  `json:"author"`
+	ISBN          string  `json:"isbn"`
+	Genre         string  `json:"genre"`
+	Price         float64 `json:"price"`
+	Quantity      int     `json:"quantity"`
+	Description   string  `json:"description"`
+	Image         string  `json:"image"`
+	AverageRating float64 `json:"average_rating"`
+}
+
+func newPublicBook(book database.Book) publicBook {
+	return publicBook{
+		ID:            book.ID,
+		Title:         book.Title,
+		Author:        book.Author,
+		ISBN:          book.ISBN,
+		Genre:         book.Genre,
+		Price:         book.Price,
+		Quantity:      book.Quantity,
+		Description:   book.Description,
+		Image:         book.Image,
+		AverageRating: book.AverageRating,
+	}
+}
+
+// findUserWishlist loads a wishlist with its books, making sure it belongs to
+// the given user
+func findUserWishlist(ctx context.Context, userID, id uint) (database.Wishlist, error) {
+	var wishlist database.Wishlist
+	err := database.WithContext(ctx).Preload("Items.Book").
+		Where("id = ? AND user_id = ?", id, userID).
+		First(&wishlist).Error
+	return wishlist, err
+}
+
+// addBookToWishlist saves a book on a wishlist; adding a book that is already
+// on the list returns the existing item
+func addBookToWishlist(ctx context.Context, wishlistID, bookID uint) (database.WishlistItem, error) {
+	db := database.WithContext(ctx)
+	var book database.Book
+	if err := db.First(&book, bookID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return database.WishlistItem{}, errBookNotFound
+		}
+		return database.WishlistItem{}, err
+	}
+
+	var item database.WishlistItem
+	err := db.Where("wishlist_id = ? AND book_id = ?", wishlistID, bookID).First(&item).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return database.WishlistItem{}, err
+	}
+	if err == nil {
+		item.Book = book
+		return item, nil
+	}
+
+	item = database.WishlistItem{
+		WishlistID: wishlistID,
+		BookID:     bookID,
+	}
+	if err := db.Create(&item).Error; err != nil {
+		return database.WishlistItem{}, err
+	}
+	item.Book = book
+
+	return item, nil
+}
+
+// newShareToken generates the random token used in a wishlist's share link
+func newShareToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,127 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+)
+
+func TestSharedWishlistHidesBookFiles(t *testing.T) {
+	app := newTestApp(t)
+	user, _ := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "Dune", Price: 9.5, Path: "/srv/books/dune.pdf"})
+
+	wishlist := database.Wishlist{UserID: user.ID, Name: "Birthday", Public: true, ShareToken: "shared-token"}
+	if err := database.GetDB().Create(&wishlist).Error; err != nil {
+		t.Fatalf("Creating the wishlist failed: %v", err)
+	}
+	if _, err := addBookToWishlist(context.Background(), wishlist.ID, book.ID); err != nil {
+		t.Fatalf("Adding the book failed: %v", err)
+	}
+
+	var body struct {
+		Name  string `json:"name"`
+		Items []struct {
+			BookID uint                   `json:"book_id"`
+			Book   map[string]interface{} `json:"book"`
+		} `json:"items"`
+	}
+	if status := doRequest(t, app, "GET", "/api/v1/wishlists/shared/shared-token", "", nil, &body); status != fiber.StatusOK {
+		t.Fatalf("Expected status 200, got %d", status)
+	}
+
+	if body.Name != "Birthday" || len(body.Items) != 1 {
+		t.Fatalf("Expected the wishlist with one item, got %+v", body)
+	}
+	if body.Items[0].Book["title"] != "Dune" {
+		t.Errorf("Expected the book's title, got %v", body.Items[0].Book)
+	}
+	if _, ok := body.Items[0].Book["path"]; ok {
+		t.Errorf("Expected the book's file path to be hidden, got %v", body.Items[0].Book)
+	}
+
+	// Private wishlists are not shared, even with the token
+	database.GetDB().Model(&wishlist).Update("public", false)
+	if status := doRequest(t, app, "GET", "/api/v1/wishlists/shared/shared-token", "", nil, nil); status != fiber.StatusNotFound {
+		t.Errorf("Expected a private wishlist to answer 404, got %d", status)
+	}
+}
+
+func TestWishlistItems(t *testing.T) {
+	app := newTestApp(t)
+	_, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	_, otherToken := createTestUser(t, "other@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "Dune", Price: 9.5})
+
+	var wishlist database.Wishlist
+	if status := doRequest(t, app, "POST", "/api/v1/user/wishlists", token, map[string]interface{}{"name": "Later"}, &wishlist); status != fiber.StatusCreated {
+		t.Fatalf("Expected creating a wishlist to answer 201, got %d", status)
+	}
+	items := fmt.Sprintf("/api/v1/user/wishlists/%d/items", wishlist.ID)
+
+	// Adding the same book twice keeps a single item
+	for i := 0; i < 2; i++ {
+		if status := doRequest(t, app, "POST", items, token, map[string]interface{}{"book_id": book.ID}, nil); status != fiber.StatusOK {
+			t.Fatalf("Expected adding the book to answer 200, got %d", status)
+		}
+	}
+	var count int64
+	database.GetDB().Model(&database.WishlistItem{}).Where("wishlist_id = ?", wishlist.ID).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected one wishlist item, got %d", count)
+	}
+
+	if status := doRequest(t, app, "POST", items, token, map[string]interface{}{"book_id": 999}, nil); status != fiber.StatusNotFound {
+		t.Errorf("Expected adding a missing book to answer 404, got %d", status)
+	}
+
+	// Other users can neither see nor change the wishlist
+	if status := doRequest(t, app, "GET", fmt.Sprintf("/api/v1/user/wishlists/%d", wishlist.ID), otherToken, nil, nil); status != fiber.StatusNotFound {
+		t.Errorf("Expected another user's wishlist to answer 404, got %d", status)
+	}
+	if status := doRequest(t, app, "POST", items, otherToken, map[string]interface{}{"book_id": book.ID}, nil); status != fiber.StatusNotFound {
+		t.Errorf("Expected adding to another user's wishlist to answer 404, got %d", status)
+	}
+}
+
+func TestMoveWishlistItemToCart(t *testing.T) {
+	app := newTestApp(t)
+	user, token := createTestUser(t, "reader@example.com", database.UserRoleStandard)
+	book := createTestBook(t, database.Book{Title: "Dune", Price: 9.5})
+
+	wishlist := database.Wishlist{UserID: user.ID, Name: "Later", ShareToken: "token"}
+	if err := database.GetDB().Create(&wishlist).Error; err != nil {
+		t.Fatalf("Creating the wishlist failed: %v", err)
+	}
+	if _, err := addBookToWishlist(context.Background(), wishlist.ID, book.ID); err != nil {
+		t.Fatalf("Adding the book failed: %v", err)
+	}
+
+	// The book is already in the cart once, so moving merges the quantities
+	if _, err := addBookToCart(context.Background(), user.ID, book.ID, 1); err != nil {
+		t.Fatalf("Adding the book to the cart failed: %v", err)
+	}
+
+	path := fmt.Sprintf("/api/v1/user/wishlists/%d/items/%d/move-to-cart", wishlist.ID, book.ID)
+	var item database.CartItem
+	if status := doRequest(t, app, "POST", path, token, map[string]interface{}{"quantity": 2}, &item); status != fiber.StatusOK {
+		t.Fatalf("Expected moving the item to answer 200, got %d", status)
+	}
+	if item.Quantity != 3 || item.Subtotal != 28.5 {
+		t.Errorf("Expected 3 copies for 28.5, got %d for %.2f", item.Quantity, item.Subtotal)
+	}
+
+	var left int64
+	database.GetDB().Model(&database.WishlistItem{}).Where("wishlist_id = ?", wishlist.ID).Count(&left)
+	if left != 0 {
+		t.Errorf("Expected the item to leave the wishlist, %d left", left)
+	}
+
+	// It is gone now, so moving it again fails
+	if status := doRequest(t, app, "POST", path, token, nil, nil); status != fiber.StatusNotFound {
+		t.Errorf("Expected moving a missing item to answer 404, got %d", status)
+	}
+}
@@ -0,0 +1,183 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mohammadshaad/golang-book-store-backend/database"
+	"gorm.io/gorm"
+)
+
+// ErrInactive is returned for a session that is unknown, expired or revoked
+var ErrInactive = errors.New("session is no longer active")
+
+// ErrReused is returned when a refresh token that was already exchanged is
+// presented again. The session has then been revoked.
+var ErrReused = errors.New("refresh token was already used")
+
+// cacheTTL is how long a session is trusted to be active without looking at
+// the database again. Revoking through this package clears the cache right
+// away, so this only bounds how long other instances lag behind.
+const cacheTTL = time.Minute
+
+// maxCacheEntries bounds the memory the cache can take
+const maxCacheEntries = 10000
+
+// Create stores a new session for the user, renewable with the refresh
+// token refreshTokenID until expiresAt
+func Create(ctx context.Context, id string, userID uint, refreshTokenID string, expiresAt time.Time) error {
+	return database.WithContext(ctx).Create(&database.Session{
+		ID:             id,
+		UserID:         userID,
+		RefreshTokenID: refreshTokenID,
+		ExpiresAt:      expiresAt,
+	}).Error
+}
+
+// Active reports whether the user's session may still be used. It is
+// checked on every authenticated request, so it is served from a cache.
+func Active(ctx context.Context, id string, userID uint) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+
+	now := time.Now()
+	if entry, ok := cache.get(id, now); ok {
+		return entry.userID == userID && now.Before(entry.sessionExpires), nil
+	}
+
+	version := cache.currentVersion()
+	var session database.Session
+	err := database.WithContext(ctx).
+		Where("id = ? AND revoked_at IS NULL", id).
+		First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	cache.put(id, cachedSession{userID: session.UserID, sessionExpires: session.ExpiresAt, expires: now.Add(cacheTTL)}, version)
+	return session.UserID == userID && now.Before(session.ExpiresAt), nil
+}
+
+// Rotate replaces the user's refresh token tokenID with nextTokenID, so each
+// refresh token can be exchanged only once. Presenting a replaced token means
+// it was copied, so the whole session is revoked and ErrReused returned, which
+// also logs out whoever holds the current token.
+func Rotate(ctx context.Context, id string, userID uint, tokenID, nextTokenID string) error {
+	db := database.WithContext(ctx)
+	result := db.Model(&database.Session{}).
+		Where("id = ? AND user_id = ? AND refresh_token_id = ? AND revoked_at IS NULL AND expires_at > ?", id, userID, tokenID, time.Now()).
+		Update("refresh_token_id", nextTokenID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 1 {
+		return nil
+	}
+
+	var session database.Session
+	err := db.Where("id = ? AND user_id = ?", id, userID).First(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInactive
+	}
+	if err != nil {
+		return err
+	}
+	if session.RevokedAt != nil || !time.Now().Before(session.ExpiresAt) {
+		return ErrInactive
+	}
+
+	if err := Revoke(ctx, id); err != nil {
+		return err
+	}
+	return ErrReused
+}
+
+// Revoke ends a single session, e.g. on logout
+func Revoke(ctx context.Context, id string) error {
+	defer cache.clear()
+	return database.WithContext(ctx).Model(&database.Session{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeAll ends every session of the user, e.g. after a password reset
+func RevokeAll(ctx context.Context, userID uint) error {
+	defer cache.clear()
+	return database.WithContext(ctx).Model(&database.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+type cachedSession struct {
+	userID         uint
+	sessionExpires time.Time
+	expires        time.Time
+}
+
+// sessionCache keeps the active sessions seen recently. Only active sessions
+// are cached, so a revocation on another instance shows within cacheTTL.
+type sessionCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedSession
+	// version changes on every clear, so a load that raced with a
+	// revocation is not stored
+	version uint64
+}
+
+var cache = &sessionCache{entries: map[string]cachedSession{}}
+
+func (c *sessionCache) get(id string, now time.Time) (cachedSession, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok || !now.Before(entry.expires) {
+		return cachedSession{}, false
+	}
+	return entry, true
+}
+
+func (c *sessionCache) currentVersion() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+func (c *sessionCache) put(id string, entry cachedSession, version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.version != version {
+		return
+	}
+	if len(c.entries) >= maxCacheEntries {
+		c.prune(time.Now())
+	}
+	c.entries[id] = entry
+}
+
+// prune drops the stale entries, or everything if all are still fresh
+func (c *sessionCache) prune(now time.Time) {
+	for id, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, id)
+		}
+	}
+	if len(c.entries) >= maxCacheEntries {
+		c.entries = map[string]cachedSession{}
+	}
+}
+
+func (c *sessionCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]cachedSession{}
+	c.version++
+}
@@ -0,0 +1,121 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mohammadshaad/golang-book-store-backend/database/databasetest"
+)
+
+func TestActive(t *testing.T) {
+	databasetest.Open(t)
+	cache.clear()
+	ctx := context.Background()
+
+	if err := Create(ctx, "current", 1, "refresh", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Creating a session failed: %v", err)
+	}
+	if err := Create(ctx, "expired", 1, "refresh", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("Creating a session failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		id     string
+		userID uint
+		want   bool
+	}{
+		{"current", 1, true},
+		{"current", 2, false},
+		{"expired", 1, false},
+		{"unknown", 1, false},
+		{"", 1, false},
+	} {
+		// Ask twice so the cached answer is checked as well
+		for i := 0; i < 2; i++ {
+			active, err := Active(ctx, tt.id, tt.userID)
+			if err != nil {
+				t.Fatalf("Active(%q, %d) failed: %v", tt.id, tt.userID, err)
+			}
+			if active != tt.want {
+				t.Errorf("Active(%q, %d) = %v, want %v", tt.id, tt.userID, active, tt.want)
+			}
+		}
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	databasetest.Open(t)
+	cache.clear()
+	ctx := context.Background()
+	expires := time.Now().Add(time.Hour)
+
+	for _, s := range []struct {
+		id     string
+		userID uint
+	}{{"phone", 1}, {"laptop", 1}, {"other", 2}} {
+		if err := Create(ctx, s.id, s.userID, "refresh-"+s.id, expires); err != nil {
+			t.Fatalf("Creating a session failed: %v", err)
+		}
+		// Load the session into the cache, which revoking has to clear
+		if active, _ := Active(ctx, s.id, s.userID); !active {
+			t.Fatalf("Expected new session %q to be active", s.id)
+		}
+	}
+
+	if err := Revoke(ctx, "phone"); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if active, _ := Active(ctx, "phone", 1); active {
+		t.Error("Expected a revoked session to be inactive")
+	}
+	if active, _ := Active(ctx, "laptop", 1); !active {
+		t.Error("Expected revoking one session to keep the others")
+	}
+
+	if err := RevokeAll(ctx, 1); err != nil {
+		t.Fatalf("RevokeAll failed: %v", err)
+	}
+	if active, _ := Active(ctx, "laptop", 1); active {
+		t.Error("Expected RevokeAll to end every session of the user")
+	}
+	if active, _ := Active(ctx, "other", 2); !active {
+		t.Error("Expected RevokeAll to keep other users' sessions")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	databasetest.Open(t)
+	cache.clear()
+	ctx := context.Background()
+
+	if err := Create(ctx, "laptop", 1, "first", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Creating a session failed: %v", err)
+	}
+
+	if err := Rotate(ctx, "laptop", 2, "first", "second"); !errors.Is(err, ErrInactive) {
+		t.Errorf("Expected another user's session to be inactive, got %v", err)
+	}
+	if err := Rotate(ctx, "laptop", 1, "first", "second"); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if err := Rotate(ctx, "laptop", 1, "second", "third"); err != nil {
+		t.Fatalf("Rotating the new token failed: %v", err)
+	}
+
+	// Using a replaced token again ends the session for everyone
+	if err := Rotate(ctx, "laptop", 1, "first", "stolen"); !errors.Is(err, ErrReused) {
+		t.Fatalf("Expected ErrReused, got %v", err)
+	}
+	if active, _ := Active(ctx, "laptop", 1); active {
+		t.Error("Expected the session to be revoked after a reuse")
+	}
+	if err := Rotate(ctx, "laptop", 1, "third", "fourth"); !errors.Is(err, ErrInactive) {
+		t.Errorf("Expected the current token to stop working, got %v", err)
+	}
+
+	if err := Rotate(ctx, "unknown", 1, "first", "second"); !errors.Is(err, ErrInactive) {
+		t.Errorf("Expected an unknown session to be inactive, got %v", err)
+	}
+}